@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Алиасы заказчиков: имя из лога (в нижнем регистре) -> репозиторий в системе контроля версий.
+// Может быть такая ситуация: в логе пишется длинное имя, а в системе контроля версий репозиторий называется по-другому, кратко.
+// Читаем из файла aliasesFile (JSON-объект), новые алиасы, которые подтвердил пользователь, дописываем туда же.
+// Если файла нет, начинаем с этих
+var clientsAliases = newCustomerAliases(map[string]string{
+	"demo":      "demo",
+	"cdi test":  "test",
+	"bank":      "bank",
+	"long name": "name",
+})
+
+type customerAliases struct {
+	mu      sync.RWMutex
+	path    string
+	aliases map[string]string
+}
+
+func newCustomerAliases(aliases map[string]string) *customerAliases {
+	res := &customerAliases{aliases: map[string]string{}}
+	for name, repo := range aliases {
+		res.aliases[strings.ToLower(name)] = repo
+	}
+	return res
+}
+
+// load replaces the aliases with the file content.
+// If there is no file yet, the current aliases are kept and will be saved there
+func (ca *customerAliases) load(path string) error {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.path = path
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	aliases := map[string]string{}
+	if err := json.Unmarshal(content, &aliases); err != nil {
+		return fmt.Errorf("bad aliases file %s: %w", path, err)
+	}
+	ca.aliases = map[string]string{}
+	for name, repo := range aliases {
+		if repo == "" {
+			return fmt.Errorf("bad aliases file %s: empty repository for %q", path, name)
+		}
+		ca.aliases[strings.ToLower(name)] = repo
+	}
+	return nil
+}
+
+// resolve the customer name from the log to the repository
+func (ca *customerAliases) resolve(name string) (string, bool) {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+	repo, ok := ca.aliases[strings.ToLower(name)]
+	return repo, ok
+}
+
+// remember the alias confirmed by the user and save all aliases to the file
+func (ca *customerAliases) remember(name, repo string) error {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.aliases[strings.ToLower(name)] = repo
+	if ca.path == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(ca.aliases, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ca.path, append(content, '\n'))
+}
+
+// known repositories, sorted
+func (ca *customerAliases) repos() []string {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+	unique := map[string]bool{}
+	for _, repo := range ca.aliases {
+		unique[repo] = true
+	}
+	res := make([]string, 0, len(unique))
+	for repo := range unique {
+		res = append(res, repo)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// suggest the repositories for the unknown name: the closest by edit distance
+// to the repository or any of its aliases first
+func (ca *customerAliases) suggest(name string, n int) []string {
+	name = strings.ToLower(name)
+	ca.mu.RLock()
+	distances := map[string]int{}
+	for alias, repo := range ca.aliases {
+		for _, candidate := range []string{alias, strings.ToLower(repo)} {
+			d := editDistance(name, candidate)
+			if current, ok := distances[repo]; !ok || d < current {
+				distances[repo] = d
+			}
+		}
+	}
+	ca.mu.RUnlock()
+	res := ca.repos()
+	sort.SliceStable(res, func(i, j int) bool {
+		return distances[res[i]] < distances[res[j]]
+	})
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// Levenshtein distance by runes
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(first int, rest ...int) int {
+	res := first
+	for _, v := range rest {
+		if v < res {
+			res = v
+		}
+	}
+	return res
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_editDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"bank", "bank", 0},
+		{"bank", "", 4},
+		{"kitten", "sitting", 3},
+		{"сбер", "сбербанк", 4},
+		{"demo", "dmeo", 2},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func Test_customerAliases_suggest(t *testing.T) {
+	aliases := newCustomerAliases(map[string]string{
+		"demo":      "demo",
+		"cdi test":  "test",
+		"bank":      "bank",
+		"long name": "name",
+	})
+	tests := []struct {
+		name  string
+		title string
+		n     int
+		want  []string
+	}{
+		{name: "typo in repository", title: "Bnak", n: 2, want: []string{"bank", "name"}},
+		{name: "close to the alias", title: "CDI Tests", n: 1, want: []string{"test"}},
+		{name: "all repositories", title: "x", n: 10, want: []string{"bank", "demo", "name", "test"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := aliases.suggest(tt.title, tt.n); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("suggest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_customerAliases_loadAndRemember(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aliases.json")
+	aliases := newCustomerAliases(map[string]string{"demo": "demo"})
+	// файла еще нет — остаемся с тем, что было
+	if err := aliases.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if repo, ok := aliases.resolve("Demo"); !ok || repo != "demo" {
+		t.Errorf("resolve(Demo) = %v, %v", repo, ok)
+	}
+	if err := aliases.remember("Sony Bank", "sony"); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newCustomerAliases(nil)
+	if err := loaded.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.repos(), []string{"demo", "sony"}) {
+		t.Errorf("repos() after load = %v", loaded.repos())
+	}
+	if repo, _ := loaded.resolve("SONY BANK"); repo != "sony" {
+		t.Errorf("resolve(SONY BANK) = %v, want sony", repo)
+	}
+
+	for name, content := range map[string]string{
+		"not json":   "demo: demo",
+		"empty repo": `{"demo": ""}`,
+	} {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := newCustomerAliases(nil).load(path); err == nil {
+			t.Errorf("load() with %s: no error", name)
+		}
+	}
+}
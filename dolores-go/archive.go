@@ -0,0 +1,334 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bodgit/sevenzip"
+)
+
+// Архив с диагностикой. Пользователи присылают zip, tar, tar.gz и 7z.
+// Формат определяем по первым байтам файла, а не по расширению:
+// поддержка часто переименовывает архивы как попало
+
+type archiveFormat string
+
+const (
+	formatZip   archiveFormat = "zip"
+	formatTar   archiveFormat = "tar"
+	formatTarGz archiveFormat = "tar.gz"
+	format7z    archiveFormat = "7z"
+)
+
+var (
+	errUnknownArchive = errors.New("unknown archive format")
+	errArchiveTooBig  = errors.New("archive is too big after decompression")
+)
+
+var (
+	zipMagic      = []byte("PK\x03\x04")
+	zipEmptyMagic = []byte("PK\x05\x06")
+	gzipMagic     = []byte{0x1f, 0x8b}
+	sevenZipMagic = []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}
+	// tar has "ustar" at the offset 257 of the first header
+	tarMagic       = []byte("ustar")
+	tarMagicOffset = 257
+)
+
+// archiveEntry is a file inside the archive
+type archiveEntry struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	Mode    os.FileMode
+	open    func() (io.ReadCloser, error)
+}
+
+// Open returns the reader of the entry content
+func (e *archiveEntry) Open() (io.ReadCloser, error) {
+	return e.open()
+}
+
+// diagArchive is the opened archive of any supported format
+type diagArchive struct {
+	format  archiveFormat
+	entries []*archiveEntry
+	closer  io.Closer
+}
+
+func (a *diagArchive) Format() archiveFormat {
+	return a.format
+}
+
+// Entries returns all files of the archive, directories are skipped
+func (a *diagArchive) Entries() []*archiveEntry {
+	return a.entries
+}
+
+func (a *diagArchive) Close() error {
+	if a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+// detect the archive format by the first bytes of the file
+func detectArchiveFormat(header []byte) (archiveFormat, error) {
+	switch {
+	case bytes.HasPrefix(header, zipMagic), bytes.HasPrefix(header, zipEmptyMagic):
+		return formatZip, nil
+	case bytes.HasPrefix(header, sevenZipMagic):
+		return format7z, nil
+	case bytes.HasPrefix(header, gzipMagic):
+		return formatTarGz, nil
+	case len(header) >= tarMagicOffset+len(tarMagic) &&
+		bytes.Equal(header[tarMagicOffset:tarMagicOffset+len(tarMagic)], tarMagic):
+		return formatTar, nil
+	}
+	return "", errUnknownArchive
+}
+
+// detect the archive format of the file on disk
+func detectArchiveFile(path string) (archiveFormat, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return detectArchiveFormat(header[:n])
+}
+
+// openArchive opens the archive of any supported format
+// and checks it against zip bombs by the declared sizes
+func openArchive(path string) (*diagArchive, error) {
+	format, err := detectArchiveFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var a *diagArchive
+	switch format {
+	case formatZip:
+		a, err = openZipArchive(path)
+	case format7z:
+		a, err = open7zArchive(path)
+	case formatTar, formatTarGz:
+		a, err = openTarArchive(path, format)
+	default:
+		err = errUnknownArchive
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkArchiveLimits(a.entries, maxArchiveEntries, maxUncompressedSize); err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// openArchives opens several archives of one diagnostic as one archive.
+// The files of every archive are put into the folder named after it, the folders are stripped when looking for the files
+func openArchives(paths []string) (*diagArchive, error) {
+	if len(paths) == 1 {
+		return openArchive(paths[0])
+	}
+	res := &diagArchive{}
+	closers := multiCloser{}
+	formats := make([]string, 0, len(paths))
+	for _, path := range paths {
+		a, err := openArchive(path)
+		if err != nil {
+			closers.Close()
+			return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		closers = append(closers, a)
+		formats = append(formats, string(a.format))
+		prefix := filepath.Base(path) + "/"
+		for _, e := range a.entries {
+			entry := *e
+			entry.Name = prefix + e.Name
+			res.entries = append(res.entries, &entry)
+		}
+	}
+	res.format = archiveFormat(strings.Join(formats, " + "))
+	res.closer = closers
+	if err := checkArchiveLimits(res.entries, maxArchiveEntries, maxUncompressedSize); err != nil {
+		res.Close()
+		return nil, err
+	}
+	return res, nil
+}
+
+func checkArchiveLimits(entries []*archiveEntry, maxEntries int, maxSize int64) error {
+	if len(entries) > maxEntries {
+		return fmt.Errorf("%w: %d files, limit is %d", errArchiveTooBig, len(entries), maxEntries)
+	}
+	var total int64
+	for _, e := range entries {
+		if e.Size < 0 {
+			return fmt.Errorf("%w: %s has negative size", errArchiveTooBig, e.Name)
+		}
+		total += e.Size
+		if total > maxSize {
+			return fmt.Errorf("%w: more than %d bytes", errArchiveTooBig, maxSize)
+		}
+	}
+	return nil
+}
+
+func openZipArchive(path string) (*diagArchive, error) {
+	z, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open zip file: %w", err)
+	}
+	a := &diagArchive{format: formatZip, closer: z}
+	for _, f := range z.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		// расшифровываем заранее, см. encrypted-zip.go
+		if f.Flags&0x1 != 0 {
+			z.Close()
+			return nil, errEncryptedArchive
+		}
+		a.entries = append(a.entries, &archiveEntry{
+			Name:    f.Name,
+			Size:    int64(f.UncompressedSize64),
+			ModTime: f.Modified,
+			Mode:    f.Mode(),
+			open:    f.Open,
+		})
+	}
+	return a, nil
+}
+
+func open7zArchive(path string) (*diagArchive, error) {
+	z, err := sevenzip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open 7z file: %w", err)
+	}
+	a := &diagArchive{format: format7z, closer: z}
+	for _, f := range z.File {
+		info := f.FileInfo()
+		if info.IsDir() {
+			continue
+		}
+		a.entries = append(a.entries, &archiveEntry{
+			Name:    f.Name,
+			Size:    info.Size(),
+			ModTime: f.Modified,
+			Mode:    info.Mode(),
+			open:    f.Open,
+		})
+	}
+	return a, nil
+}
+
+// tar can be read only sequentially, so we scan headers once
+// and reread the file up to the entry when it is opened
+func openTarArchive(path string, format archiveFormat) (*diagArchive, error) {
+	a := &diagArchive{format: format}
+	err := walkTar(path, format, func(index int, hdr *tar.Header) {
+		if !hdr.FileInfo().Mode().IsRegular() {
+			return
+		}
+		a.entries = append(a.entries, &archiveEntry{
+			Name:    hdr.Name,
+			Size:    hdr.Size,
+			ModTime: hdr.ModTime,
+			Mode:    hdr.FileInfo().Mode(),
+			open: func() (io.ReadCloser, error) {
+				return openTarEntry(path, format, index)
+			},
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s file: %w", format, err)
+	}
+	return a, nil
+}
+
+// walk all tar headers
+func walkTar(path string, format archiveFormat, fn func(index int, hdr *tar.Header)) error {
+	tr, closer, err := newTarReader(path, format)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(index, hdr)
+	}
+}
+
+func newTarReader(path string, format archiveFormat) (*tar.Reader, io.Closer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if format != formatTarGz {
+		return tar.NewReader(f), f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return tar.NewReader(gz), multiCloser{gz, f}, nil
+}
+
+type multiCloser []io.Closer
+
+func (mc multiCloser) Close() error {
+	var res error
+	for _, c := range mc {
+		if err := c.Close(); err != nil && res == nil {
+			res = err
+		}
+	}
+	return res
+}
+
+// entryReader reads the content and closes everything behind it
+type entryReader struct {
+	io.Reader
+	io.Closer
+}
+
+func openTarEntry(path string, format archiveFormat, entryIndex int) (io.ReadCloser, error) {
+	tr, closer, err := newTarReader(path, format)
+	if err != nil {
+		return nil, err
+	}
+	for index := 0; ; index++ {
+		_, err := tr.Next()
+		if err != nil {
+			closer.Close()
+			return nil, fmt.Errorf("entry %d not found in %s: %w", entryIndex, path, err)
+		}
+		if index == entryIndex {
+			return entryReader{tr, closer}, nil
+		}
+	}
+}
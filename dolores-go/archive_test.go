@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Проверяем, что архивы разных форматов читаются одинаково
+
+func Test_detectArchiveFormat(t *testing.T) {
+	tarHeader := make([]byte, 512)
+	copy(tarHeader[257:], "ustar")
+	tests := []struct {
+		name    string
+		header  []byte
+		want    archiveFormat
+		wantErr bool
+	}{
+		{name: "zip", header: []byte("PK\x03\x04\x14\x00"), want: formatZip},
+		{name: "empty zip", header: []byte("PK\x05\x06\x00\x00"), want: formatZip},
+		{name: "gzip", header: []byte{0x1f, 0x8b, 0x08, 0x00}, want: formatTarGz},
+		{name: "7z", header: []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c, 0x00, 0x04}, want: format7z},
+		{name: "tar", header: tarHeader, want: formatTar},
+		{name: "text", header: []byte("2020-07-21 00:05:11,828 INFO"), wantErr: true},
+		{name: "empty", header: []byte{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := detectArchiveFormat(tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("detectArchiveFormat() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("detectArchiveFormat() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenArchive(t *testing.T) {
+	wantEntries := []string{
+		"cdi.logs/cdi-jms.log",
+		"cdi.logs/cdi-lifecycle.log",
+		"cdi.logs/cdi-security.log",
+		"cdi.logs/cdi-soap-stats.log",
+		"cdi.logs/cdi.log",
+		"cdi.versions",
+		"factor.versions",
+		"sql.party.xls",
+	}
+	tests := []struct {
+		name       string
+		path       string
+		wantFormat archiveFormat
+		wantErr    bool
+	}{
+		{name: "zip", path: "test_data/diag_good.zip", wantFormat: formatZip},
+		{name: "tar.gz", path: "test_data/diag_good.tar.gz", wantFormat: formatTarGz},
+		{name: "7z", path: "test_data/diag_good.7z", wantFormat: format7z},
+		{name: "not an archive", path: "test_data/cdi-lifecycle.log", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := openArchive(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("openArchive() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			defer a.Close()
+			if a.Format() != tt.wantFormat {
+				t.Errorf("openArchive() format = %v, want %v", a.Format(), tt.wantFormat)
+			}
+			names := make([]string, 0, len(a.Entries()))
+			for _, e := range a.Entries() {
+				names = append(names, e.Name)
+				// содержимое читается и совпадает по размеру с заголовком
+				r, err := e.Open()
+				if err != nil {
+					t.Errorf("entry %s: open error = %v", e.Name, err)
+					continue
+				}
+				n, err := io.Copy(io.Discard, r)
+				r.Close()
+				if err != nil || n != e.Size {
+					t.Errorf("entry %s: read %d bytes, error = %v, want %d bytes", e.Name, n, err, e.Size)
+				}
+			}
+			sort.Strings(names)
+			if len(names) != len(wantEntries) {
+				t.Fatalf("openArchive() entries = %v, want %v", names, wantEntries)
+			}
+			for i := range names {
+				if names[i] != wantEntries[i] {
+					t.Errorf("openArchive() entries = %v, want %v", names, wantEntries)
+					break
+				}
+			}
+		})
+	}
+}
+
+func Test_checkArchiveLimits(t *testing.T) {
+	entries := func(sizes ...int64) []*archiveEntry {
+		res := make([]*archiveEntry, 0, len(sizes))
+		for _, size := range sizes {
+			res = append(res, &archiveEntry{Name: "file", Size: size})
+		}
+		return res
+	}
+	tests := []struct {
+		name    string
+		entries []*archiveEntry
+		wantErr bool
+	}{
+		{name: "fits", entries: entries(40, 60)},
+		{name: "too many files", entries: entries(1, 1, 1, 1), wantErr: true},
+		{name: "too big", entries: entries(50, 51), wantErr: true},
+		{name: "negative size", entries: entries(-1), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkArchiveLimits(tt.entries, 3, 100)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkArchiveLimits() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errArchiveTooBig) {
+				t.Errorf("checkArchiveLimits() error = %v, want errArchiveTooBig", err)
+			}
+		})
+	}
+}
+
+func TestOpenArchives(t *testing.T) {
+	a, err := openArchives([]string{"test_data/diag_without_versions.zip", "test_data/diag_good.7z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if a.Format() != "zip + 7z" {
+		t.Errorf("openArchives() format = %v", a.Format())
+	}
+	// файлы каждого архива — в папке с его именем, при поиске папки отрезаются
+	files := locateDiagFiles(a.Entries())
+	if len(files[diagCdiVersions]) != 2 {
+		t.Errorf("openArchives() cdi.versions found %d times, want 2", len(files[diagCdiVersions]))
+	}
+	for _, e := range a.Entries() {
+		if !strings.HasPrefix(e.Name, "diag_without_versions.zip/") && !strings.HasPrefix(e.Name, "diag_good.7z/") {
+			t.Errorf("openArchives() entry %s has no archive folder", e.Name)
+		}
+	}
+
+	if _, err := openArchives([]string{"test_data/diag_good.zip", "test_data/cdi.versions"}); !errors.Is(err, errUnknownArchive) {
+		t.Errorf("openArchives() with not an archive: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Код для обработки cdi.log. Его никто не читает, пока стенд не поднят,
+// а там часто видно, что сломалось у заказчика. Собираем ERROR и WARN записи и java-исключения
+// в группы по логгеру и «сигнатуре» сообщения: одинаковые сообщения с разными именами файлов и числами — одна группа
+
+const cdiLogTimeFormat = "2006-01-02 15:04:05,000"
+
+var (
+	// 2020-07-23 23:11:01,723 [TaskManagerExecutor-118] ERROR FilesImportPerformer - Failed to load file 'SSO_20200723.csv'
+	cdiLogLineTemplate = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2},\d{3}) \[.*?\] (TRACE|DEBUG|INFO|WARN|ERROR|FATAL)\s+(\S+) - (.*)$`)
+	// java.lang.IllegalStateException: message или Caused by: org.postgresql.util.PSQLException: message
+	cdiLogExceptionTemplate = regexp.MustCompile(`^(?:Caused by: )?((?:[a-zA-Z_$][\w$]*\.)+[A-Z][\w$]*(?:Exception|Error|Throwable))(?::|\s*$)`)
+
+	// что меняется от записи к записи и не должно разбивать группу
+	signatureQuoted = regexp.MustCompile(`'[^']*'|"[^"]*"`)
+	signatureHex    = regexp.MustCompile(`\b[0-9a-fA-F-]{8,}\b`)
+	signatureNumber = regexp.MustCompile(`\d+`)
+)
+
+// logGroup is the entries of cdi.log with the same signature
+type logGroup struct {
+	Level     string
+	Logger    string
+	Signature string
+	// first exception of the stack trace and its root cause, if any
+	Exception string
+	// the first message as is
+	Example     string
+	Count       int
+	First, Last time.Time
+}
+
+// logSummary is what we have found in cdi.log
+type logSummary struct {
+	Groups   []*logGroup
+	Errors   int
+	Warnings int
+}
+
+func logSignature(message string) string {
+	message = signatureQuoted.ReplaceAllString(message, "'…'")
+	message = signatureHex.ReplaceAllString(message, "#")
+	return signatureNumber.ReplaceAllString(message, "N")
+}
+
+// cdiLogEntry is the line with the date and its continuation lines
+type cdiLogEntry struct {
+	time      time.Time
+	level     string
+	logger    string
+	message   string
+	exception string
+	root      string
+}
+
+func parseCdiLog(in io.Reader) (*logSummary, error) {
+	scanner := bufio.NewScanner(in)
+	// в строках бывают огромные SQL и xml
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	res := new(logSummary)
+	groups := map[string]*logGroup{}
+
+	var current *cdiLogEntry
+	flush := func() {
+		if current == nil {
+			return
+		}
+		e := current
+		current = nil
+		if e.level != "ERROR" && e.level != "WARN" && e.level != "FATAL" && e.exception == "" {
+			return
+		}
+		switch e.level {
+		case "ERROR", "FATAL":
+			res.Errors++
+		case "WARN":
+			res.Warnings++
+		}
+		exception := e.exception
+		if e.root != "" && e.root != e.exception {
+			exception = fmt.Sprintf("%s (caused by %s)", e.exception, e.root)
+		}
+		signature := logSignature(e.message)
+		key := strings.Join([]string{e.level, e.logger, signature, exception}, "\x00")
+		g, ok := groups[key]
+		if !ok {
+			g = &logGroup{Level: e.level, Logger: e.logger, Signature: signature, Exception: exception, Example: e.message, First: e.time}
+			groups[key] = g
+			res.Groups = append(res.Groups, g)
+		}
+		g.Count++
+		g.Last = e.time
+	}
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if m := cdiLogLineTemplate.FindStringSubmatch(line); m != nil {
+			flush()
+			t, err := time.Parse(cdiLogTimeFormat, m[1])
+			if err != nil {
+				return nil, err
+			}
+			current = &cdiLogEntry{time: t, level: m[2], logger: m[3], message: m[4]}
+			continue
+		}
+		// строки стектрейса относятся к последней записи с датой
+		if current == nil {
+			continue
+		}
+		m := cdiLogExceptionTemplate.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		if current.exception == "" {
+			current.exception = m[1]
+		} else {
+			current.root = m[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return res, nil
+}
+
+// the most important groups: errors before warnings, then the most frequent
+func (s *logSummary) top(n int) []*logGroup {
+	groups := append([]*logGroup{}, s.Groups...)
+	rank := func(g *logGroup) int {
+		switch g.Level {
+		case "FATAL", "ERROR":
+			return 0
+		case "WARN":
+			return 1
+		}
+		return 2
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		if rank(groups[i]) != rank(groups[j]) {
+			return rank(groups[i]) < rank(groups[j])
+		}
+		return groups[i].Count > groups[j].Count
+	})
+	if len(groups) > n {
+		groups = groups[:n]
+	}
+	return groups
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Автотесты на группировку ошибок из cdi.log
+
+const testCdiLog = `2020-07-23 23:10:59,001 [main] INFO  start - CDI application started
+2020-07-23 23:11:01,723 [TaskManagerExecutor-118] ERROR FilesImportPerformer - Failed to load file 'SSO_20200723.csv' for system 'SSO'.
+2020-07-23 23:11:02,051 [TaskManagerExecutor-118] INFO  FilesImportPerformer - Processed 999 rows
+2020-07-23 23:11:04,973 [TaskManagerExecutor-118] ERROR FilesImportPerformer - Failed to load file 'ADB_20200723.csv' for system 'ADB'.
+2020-07-23 23:12:00,000 [http-nio-8080-exec-3 task-51453] WARN  SoapService - Slow request 1532 ms
+2020-07-23 23:13:00,000 [http-nio-8080-exec-4] INFO  JobRunner - job failed, will retry
+java.lang.IllegalStateException: job 42 failed
+	at ru.hflabs.cdi.JobRunner.run(JobRunner.java:10)
+Caused by: org.postgresql.util.PSQLException: connection refused
+	at org.postgresql.Driver.connect(Driver.java:1)
+ — cleanupPhysicalBufferTaskPerformer: processed 0 entities
+2020-07-23 23:14:00,000 [http-nio-8080-exec-4] ERROR JobRunner - job 43 failed
+`
+
+func TestParseCdiLog(t *testing.T) {
+	got, err := parseCdiLog(strings.NewReader(testCdiLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Errors != 3 || got.Warnings != 1 {
+		t.Errorf("parseCdiLog() errors = %d, warnings = %d, want 3 and 1", got.Errors, got.Warnings)
+	}
+	top := got.top(10)
+	want := []struct {
+		level     string
+		logger    string
+		signature string
+		exception string
+		count     int
+	}{
+		{"ERROR", "FilesImportPerformer", "Failed to load file '…' for system '…'.", "", 2},
+		{"ERROR", "JobRunner", "job N failed", "", 1},
+		{"WARN", "SoapService", "Slow request N ms", "", 1},
+		{"INFO", "JobRunner", "job failed, will retry", "java.lang.IllegalStateException (caused by org.postgresql.util.PSQLException)", 1},
+	}
+	if len(top) != len(want) {
+		t.Fatalf("top() = %d groups, want %d", len(top), len(want))
+	}
+	for i, w := range want {
+		g := top[i]
+		if g.Level != w.level || g.Logger != w.logger || g.Signature != w.signature || g.Exception != w.exception || g.Count != w.count {
+			t.Errorf("top()[%d] = %+v, want %+v", i, g, w)
+		}
+	}
+	if first, last := top[0].First.Format(cdiLogTimeFormat), top[0].Last.Format(cdiLogTimeFormat); first != "2020-07-23 23:11:01,723" || last != "2020-07-23 23:11:04,973" {
+		t.Errorf("top()[0] first = %s, last = %s", first, last)
+	}
+	if len(got.top(1)) != 1 {
+		t.Errorf("top(1) returned more than one group")
+	}
+}
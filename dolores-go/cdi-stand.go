@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Подключение к развернутому стенду. Раньше клиент TaskWS создавался один раз в main на http://localhost:8080,
+// и стенд за TLS или на другом хосте было никак не достать. Теперь клиент собираем для каждой сессии:
+// хост и порт — те, на которые docker опубликовал cdiPort контейнера сессии (cdiHost, если задан, важнее хоста),
+// схема — из настроек (cdiScheme). Для https можно указать свой CA и клиентский сертификат.
+// Ссылку на UI для пользователя строим из того же стенда
+
+var (
+	errBadCdiStand = errors.New("bad CDI stand settings")
+	// клиента стенда нет: контейнер еще не запустили или сессию уже закрыли
+	errNoStand = errors.New("the session has no stand")
+)
+
+var cdiStandMessages = struct {
+	badSettings  string
+	notPublished string
+}{
+	notPublished: "Не нашла, куда docker опубликовал порт ЕК контейнера. Проверь cdiPort и ports",
+	badSettings:  "Не могу подключиться к стенду: %v. Проверь настройки cdiScheme, cdiCAFile, cdiCertFile и cdiKeyFile",
+}
+
+// cdiStand is where CDI of the stand listens and how to connect to it
+type cdiStand struct {
+	scheme   string
+	host     string
+	port     string
+	username string
+	password string
+	// PEM files: CA bundle to trust the certificate of the stand, empty means the system roots,
+	// the client certificate and its key, if the stand asks for it
+	caFile   string
+	certFile string
+	keyFile  string
+	// the whole request to the stand, with the connection and the response
+	timeout time.Duration
+}
+
+// the stand at the host and port where cdiPort of the container is published, the rest is from the settings
+func newCdiStand(host, port string) cdiStand {
+	if cdiHost != "" {
+		host = cdiHost
+	}
+	return cdiStand{
+		scheme:   cdiScheme,
+		host:     host,
+		port:     port,
+		username: cdiUsername,
+		password: cdiPassword,
+		caFile:   cdiCAFile,
+		certFile: cdiCertFile,
+		keyFile:  cdiKeyFile,
+		timeout:  cdiRequestTimeout,
+	}
+}
+
+// baseURL is scheme://host:port without the path
+func (s cdiStand) baseURL() string {
+	return fmt.Sprintf("%s://%s", s.scheme, net.JoinHostPort(s.host, s.port))
+}
+
+// uiURL is the link to the UI of the stand for the user. The stand on the loopback is on the same machine
+// as Dolores, the user opens it by serverIP
+func (s cdiStand) uiURL() string {
+	host := s.host
+	if ip := net.ParseIP(host); host == "localhost" || ip != nil && ip.IsLoopback() {
+		host = serverIP
+	}
+	return fmt.Sprintf("%s://%s/cdi/ui/", s.scheme, net.JoinHostPort(host, s.port))
+}
+
+// newCdiHTTPClient returns the client for the stand: with the timeout and, for https, the CA and the client certificate
+func newCdiHTTPClient(stand cdiStand) (*http.Client, error) {
+	if stand.scheme != "http" && stand.scheme != "https" {
+		return nil, fmt.Errorf("%w: scheme %q, need http or https", errBadCdiStand, stand.scheme)
+	}
+	if stand.host == "" || stand.port == "" {
+		return nil, fmt.Errorf("%w: no host or port", errBadCdiStand)
+	}
+	if (stand.certFile == "") != (stand.keyFile == "") {
+		return nil, fmt.Errorf("%w: the client certificate needs both cert and key files", errBadCdiStand)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if stand.scheme == "https" {
+		tlsConfig, err := newCdiTLSConfig(stand)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &http.Client{Transport: transport, Timeout: stand.timeout}, nil
+}
+
+func newCdiTLSConfig(stand cdiStand) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if stand.caFile != "" {
+		pem, err := os.ReadFile(stand.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: CA bundle: %v", errBadCdiStand, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%w: no certificates in the CA bundle %s", errBadCdiStand, stand.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if stand.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(stand.certFile, stand.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: client certificate: %v", errBadCdiStand, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func (as *activeSession) setCdi(stand cdiStand, cdi cdiChecker) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.stand = stand
+	as.cdi = cdi
+}
+
+// the client of the stand of the session, false until the container is run and after the session is closed
+func (as *activeSession) getCdi() (cdiChecker, bool) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return as.cdi, as.cdi != nil
+}
+
+// connectToStand makes the CDI client for the container of the session, before waiting for it to start
+func (as *activeSession) connectToStand(update tgbotapi.Update) error {
+	host, port, err := as.docker.PublishedAddress(as.getCustomer(), cdiPort)
+	if err != nil {
+		log.Println(err)
+		_, sendErr := as.bot.Send(newMessage(update.Message.Chat.ID, cdiStandMessages.notPublished))
+		if sendErr != nil {
+			log.Println("ERROR: ", sendErr)
+		}
+		as.deactivate()
+		return err
+	}
+	stand := newCdiStand(host, port)
+	cdi, err := newConnectToCdi(stand)
+	if err != nil {
+		log.Println(err)
+		_, sendErr := as.bot.Send(newMessage(update.Message.Chat.ID, fmt.Sprintf(cdiStandMessages.badSettings, err)))
+		if sendErr != nil {
+			log.Println("ERROR: ", sendErr)
+		}
+		as.deactivate()
+		return err
+	}
+	log.Printf("CDI of the stand %s\n", stand.baseURL())
+	as.setCdi(stand, cdi)
+	return nil
+}
+
+// the link to the UI of the stand of the session for the user
+func (as *activeSession) standUIURL() string {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return as.stand.uiURL()
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Автотесты на подключение к стенду: хост и порт от docker, https со своим CA и клиентским сертификатом
+
+func Test_newCdiStand(t *testing.T) {
+	serverIP = "10.0.0.5"
+	defer func() { serverIP = "127.0.0.1" }()
+	tests := []struct {
+		name      string
+		cdiHost   string
+		host      string
+		wantURL   string
+		wantUIURL string
+	}{
+		{name: "docker socket", host: "localhost", wantURL: "https://localhost:9443", wantUIURL: "https://10.0.0.5:9443/cdi/ui/"},
+		{name: "loopback binding", host: "127.0.0.1", wantURL: "https://127.0.0.1:9443", wantUIURL: "https://10.0.0.5:9443/cdi/ui/"},
+		{name: "remote docker", host: "10.0.0.7", wantURL: "https://10.0.0.7:9443", wantUIURL: "https://10.0.0.7:9443/cdi/ui/"},
+		{name: "cdiHost", cdiHost: "stand.local", host: "localhost", wantURL: "https://stand.local:9443", wantUIURL: "https://stand.local:9443/cdi/ui/"},
+	}
+	cdiScheme = "https"
+	defer func() { cdiScheme = "http" }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cdiHost = tt.cdiHost
+			defer func() { cdiHost = "" }()
+			stand := newCdiStand(tt.host, "9443")
+			if got := stand.baseURL(); got != tt.wantURL {
+				t.Errorf("baseURL() = %q, want %q", got, tt.wantURL)
+			}
+			if got := stand.uiURL(); got != tt.wantUIURL {
+				t.Errorf("uiURL() = %q, want %q", got, tt.wantUIURL)
+			}
+		})
+	}
+}
+
+// docker, который не опубликовал порт ЕК
+type notPublishedDocker struct {
+	testDockerRunner
+}
+
+func (d *notPublishedDocker) PublishedAddress(containerName string, containerPort string) (string, string, error) {
+	return "", "", fmt.Errorf("port %s of the container %s is not published", containerPort, containerName)
+}
+
+func Test_activeSession_connectToStand(t *testing.T) {
+	cdiPort = "8080"
+	defer func() { cdiPort = "" }()
+	update := tgbotapi.Update{Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1}}}
+	as := newASFromFields(fields{user: newTelegramUser("1", 1)})
+	if err := as.connectToStand(update); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := as.getCdi(); !ok {
+		t.Errorf("no client after connectToStand()")
+	}
+	if got, want := as.standUIURL(), "http://127.0.0.1:8080/cdi/ui/"; got != want {
+		t.Errorf("standUIURL() = %q, want %q", got, want)
+	}
+
+	as = newASFromFields(fields{user: newTelegramUser("1", 1), status: ACTIVE, q: newSessionsQueue()})
+	as.docker = &notPublishedDocker{}
+	if err := as.connectToStand(update); err == nil {
+		t.Errorf("connectToStand() without the published port passed")
+	}
+	if _, ok := as.getCdi(); ok {
+		t.Errorf("the client is set without the published port")
+	}
+	if as.status != DISACTIVE {
+		t.Errorf("the session is still active without the published port")
+	}
+}
+
+func Test_newCdiHTTPClient_badSettings(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		stand cdiStand
+	}{
+		{name: "scheme", stand: cdiStand{scheme: "ftp", host: "localhost", port: "8080"}},
+		{name: "no host", stand: cdiStand{scheme: "http", port: "8080"}},
+		{name: "cert without key", stand: cdiStand{scheme: "https", host: "localhost", port: "8443", certFile: "client.pem"}},
+		{name: "no CA file", stand: cdiStand{scheme: "https", host: "localhost", port: "8443", caFile: filepath.Join(dir, "missing.pem")}},
+		{name: "bad CA file", stand: cdiStand{scheme: "https", host: "localhost", port: "8443", caFile: notPEM}},
+		{name: "bad client cert", stand: cdiStand{scheme: "https", host: "localhost", port: "8443", certFile: notPEM, keyFile: notPEM}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newConnectToCdi(tt.stand); !errors.Is(err, errBadCdiStand) {
+				t.Errorf("newConnectToCdi() error = %v, want errBadCdiStand", err)
+			}
+		})
+	}
+}
+
+// writePEM saves the block to the file in dir and returns the path
+func writePEM(t *testing.T, dir, name, blockType string, bytes []byte) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: bytes}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newClientCert makes the self-signed client certificate, returns it and the paths of cert and key files
+func newClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dolores"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, writePEM(t, dir, "client.pem", "CERTIFICATE", der), writePEM(t, dir, "client.key", "EC PRIVATE KEY", keyDER)
+}
+
+// the stand of the test server, the certificate of the server is trusted through caFile if withCA
+func testServerStand(t *testing.T, server *httptest.Server, withCA bool) cdiStand {
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stand := cdiStand{scheme: "https", host: u.Hostname(), port: u.Port(), timeout: 5 * time.Second}
+	if withCA {
+		stand.caFile = writePEM(t, t.TempDir(), "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+	}
+	return stand
+}
+
+func Test_connectToCdi_https(t *testing.T) {
+	ui := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cdi/ui" {
+			http.NotFound(w, r)
+		}
+	})
+	server := httptest.NewTLSServer(ui)
+	defer server.Close()
+
+	cdi, err := newConnectToCdi(testServerStand(t, server, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// сертификат тестового сервера никто не подписывал: без CA ему не верим
+	if err := cdi.uiAvailable(context.Background()); !errors.Is(err, errTaskWSTransport) {
+		t.Errorf("uiAvailable() without CA error = %v, want errTaskWSTransport", err)
+	}
+	cdi, err = newConnectToCdi(testServerStand(t, server, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cdi.uiAvailable(context.Background()); err != nil {
+		t.Errorf("uiAvailable() with CA error = %v", err)
+	}
+}
+
+func Test_connectToCdi_clientCert(t *testing.T) {
+	clientCert, certFile, keyFile := newClientCert(t, t.TempDir())
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	stand := testServerStand(t, server, true)
+	cdi, err := newConnectToCdi(stand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cdi.uiAvailable(context.Background()); err == nil {
+		t.Errorf("uiAvailable() without the client certificate passed")
+	}
+	stand.certFile, stand.keyFile = certFile, keyFile
+	cdi, err = newConnectToCdi(stand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cdi.uiAvailable(context.Background()); err != nil {
+		t.Errorf("uiAvailable() with the client certificate error = %v", err)
+	}
+}
+
+func Test_connectToCdi_timeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	u, _ := url.Parse(server.URL)
+	cdi, err := newConnectToCdi(cdiStand{scheme: "http", host: u.Hostname(), port: u.Port(), timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cdi.uiAvailable(context.Background()); !errors.Is(err, errTaskWSTransport) {
+		t.Errorf("uiAvailable() of the hung stand error = %v, want errTaskWSTransport", err)
+	}
+}
+
+func Test_activeSession_noStand(t *testing.T) {
+	update := tgbotapi.Update{Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1}}}
+	as := newASFromFields(fields{user: newTelegramUser("1", 1), q: &sessionsQueue{}})
+	// сессию закрыли, пока стенд запускался: deactivate обнулил клиента
+	as.cdi = &testCdiChecker{}
+	as.deactivate()
+	if _, ok := as.getCdi(); ok {
+		t.Fatalf("getCdi() after deactivate returned the client")
+	}
+	if err := as.waitCDIToStart(update); !errors.Is(err, errNoStand) {
+		t.Errorf("waitCDIToStart() = %v, want errNoStand", err)
+	}
+	if err := as.runTasks(update); !errors.Is(err, errNoStand) {
+		t.Errorf("runTasks() = %v, want errNoStand", err)
+	}
+}
+
+func Test_activeSession_connectToStand_badSettings(t *testing.T) {
+	cdiScheme = "ftp"
+	defer func() { cdiScheme = "http" }()
+	update := tgbotapi.Update{Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1}}}
+	as := newASFromFields(fields{user: newTelegramUser("1", 1), status: ACTIVE, q: newSessionsQueue()})
+	if err := as.connectToStand(update); !errors.Is(err, errBadCdiStand) {
+		t.Errorf("connectToStand() = %v, want errBadCdiStand", err)
+	}
+	if _, ok := as.getCdi(); ok {
+		t.Errorf("the client is set with bad settings")
+	}
+	if as.status != DISACTIVE {
+		t.Errorf("the session is still active with bad settings")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Команды, которые понимает Долорес помимо файла с диагностикой.
+// Команда — первое слово сообщения, остальные слова передаются как аргументы
+
+type commandHandler func(as *activeSession, update tgbotapi.Update, args []string)
+
+var doloresCommands = map[string]commandHandler{
+	"/snapshot":  (*activeSession).handleSnapshot,
+	"/restore":   (*activeSession).handleRestore,
+	"/soapstats": (*activeSession).handleSoapStats,
+	"/lifecycle": (*activeSession).handleLifecycleLine,
+	"/go":        (*activeSession).handleGo,
+	"/task":      (*activeSession).handleTask,
+}
+
+// parse the command and its arguments from the message text
+// * /command@botname is the same as /command
+func parseCommand(text string) (string, []string) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return "", nil
+	}
+	command := strings.ToLower(strings.SplitN(fields[0], "@", 2)[0])
+	return command, fields[1:]
+}
+
+// the text after the command as is, for the commands which need the spaces
+func commandText(text string) string {
+	text = strings.TrimLeft(text, " \t\n")
+	i := strings.IndexAny(text, " \t\n")
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimLeft(text[i:], " \t\n")
+}
+
+// run the command if the message is a known command
+// returns false if the message is not a command
+func (as *activeSession) handleCommand(update tgbotapi.Update) bool {
+	command, args := parseCommand(update.Message.Text)
+	handler, ok := doloresCommands[command]
+	if !ok {
+		return false
+	}
+	handler(as, update, args)
+	return true
+}
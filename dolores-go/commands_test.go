@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseCommand(t *testing.T) {
+	tests := []struct {
+		name        string
+		text        string
+		wantCommand string
+		wantArgs    []string
+	}{
+		{
+			name:        "command with args",
+			text:        "/restore demo-20.12-1-snapshot-20220406-183000",
+			wantCommand: "/restore",
+			wantArgs:    []string{"demo-20.12-1-snapshot-20220406-183000"},
+		},
+		{
+			name:        "command with bot name",
+			text:        "/Snapshot@dolores_bot",
+			wantCommand: "/snapshot",
+			wantArgs:    []string{},
+		},
+		{
+			name:        "not a command",
+			text:        "привет",
+			wantCommand: "",
+			wantArgs:    nil,
+		},
+		{
+			name:        "empty",
+			text:        "",
+			wantCommand: "",
+			wantArgs:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotCommand, gotArgs := parseCommand(tt.text)
+			if gotCommand != tt.wantCommand {
+				t.Errorf("parseCommand() command = %v, want %v", gotCommand, tt.wantCommand)
+			}
+			if !reflect.DeepEqual(gotArgs, tt.wantArgs) {
+				t.Errorf("parseCommand() args = %#v, want %#v", gotArgs, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func Test_commandText(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "spaces are kept", text: "/lifecycle 2020-07-17 16:00:38,406 INFO  start - CDI", want: "2020-07-17 16:00:38,406 INFO  start - CDI"},
+		{name: "new line after command", text: "/lifecycle\nline", want: "line"},
+		{name: "no text", text: "/lifecycle", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := commandText(tt.text); got != tt.want {
+				t.Errorf("commandText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Выбор репозитория заказчика, если для имени из лога нет алиаса. Раньше неизвестное имя
+// превращалось в пустой CUSTOMER_NAME и ломало сборку образа где-то в глубине Docker.
+// Теперь спрашиваем: показываем известные репозитории, похожие по имени — первыми.
+// Выбор запоминаем как новый алиас, см. aliases.go
+
+const (
+	// callback data of the repository button: customer:<repository>, empty repository cancels
+	customerCallbackPrefix = "customer:"
+	maxCustomerButtons     = 8
+)
+
+// buttons for the closest repositories and the cancel button
+func customerButtons(title string) []inlineButton {
+	buttons := make([]inlineButton, 0, maxCustomerButtons+1)
+	for _, repo := range clientsAliases.suggest(title, maxCustomerButtons) {
+		buttons = append(buttons, inlineButton{text: repo, action: customerCallbackPrefix + repo})
+	}
+	return append(buttons, inlineButton{text: doloresMessages.customerCancel, action: customerCallbackPrefix})
+}
+
+func (as *activeSession) setCustomerChoice(choice chan string) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.customerChoice = choice
+}
+
+// chooseCustomer asks the owner which repository the customer from the log has.
+// Blocks until the choice or the timeout, there is no default: without the repository the image cannot be built
+func (as *activeSession) chooseCustomer(update tgbotapi.Update, title string) (string, error) {
+	chatID := update.Message.Chat.ID
+	choice := make(chan string, 1)
+	as.setCustomerChoice(choice)
+	defer as.setCustomerChoice(nil)
+	_, err := as.bot.Send(newMessageWithButtons(chatID,
+		fmt.Sprintf(doloresMessages.chooseCustomer, title, int(as.choiceTimeout.Minutes())),
+		customerButtons(title)))
+	if err != nil {
+		log.Println("ERROR: ", err)
+	}
+
+	repo := ""
+	select {
+	case repo = <-choice:
+	case <-time.After(as.choiceTimeout):
+		log.Printf("no repository chosen by %s for %s\n", as.getUser(), title)
+	}
+	if repo == "" {
+		_, err := as.bot.Send(newMessage(chatID, fmt.Sprintf(doloresMessages.customerNotChosen, title)))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		as.deactivate()
+		return "", fmt.Errorf("no repository chosen for customer %s", title)
+	}
+
+	text := fmt.Sprintf(doloresMessages.customerRemembered, title, repo)
+	if err := clientsAliases.remember(title, repo); err != nil {
+		log.Println("ERROR: could not save aliases: ", err)
+		text = fmt.Sprintf(doloresMessages.customerNotSaved, title, repo)
+	}
+	_, err = as.bot.Send(newMessage(chatID, text))
+	if err != nil {
+		log.Println("ERROR: ", err)
+	}
+	return repo, nil
+}
+
+// set the chosen repository to the versions and to the history with the same customer name
+func (d *diagnostic) setCustomerRepo(repo string) {
+	d.versions.CustomerName = repo
+	d.versions.Sources["CustomerName"] = sourceUser
+	for _, start := range d.history {
+		if strings.EqualFold(start.Versions.CustomerTitle, d.unknownCustomer) {
+			start.Versions.CustomerName = repo
+		}
+	}
+	d.unknownCustomer = ""
+}
+
+// the button of the repository is pressed
+func (as *activeSession) handleCustomerCallback(update tgbotapi.Update) {
+	userID := int64(update.CallbackQuery.From.ID)
+	repo := strings.TrimPrefix(update.CallbackQuery.Data, customerCallbackPrefix)
+	known := repo == ""
+	for _, r := range clientsAliases.repos() {
+		known = known || r == repo
+	}
+	as.mu.Lock()
+	choice := as.customerChoice
+	as.mu.Unlock()
+	if !as.isOwner(userID) || choice == nil || !known {
+		_, err := as.bot.Send(newMessage(userID, doloresMessages.customerTooLate))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		return
+	}
+	// выбор принимаем только первый
+	select {
+	case choice <- repo:
+	default:
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Поиск файлов диагностики в архиве. Архивы собирают по-разному:
+// - с верхней папкой (diag_192/cdi.logs/...)
+// - на винде, с обратными слешами в путях
+// - с ротированными логами (cdi-lifecycle.log.1, cdi-lifecycle.log.2, ...)
+// Поэтому ищем файлы по шаблону, отрезая лишние папки сверху.
+// Тут только файлы, которые Долорес читает сама, что положить на стенд — см. extraction.go
+
+type diagFileKind string
+
+const (
+	diagLifecycleLog   diagFileKind = "cdi.logs/cdi-lifecycle.log"
+	diagCdiLog         diagFileKind = "cdi.logs/cdi.log"
+	diagSoapStats      diagFileKind = "cdi.logs/cdi-soap-stats.log"
+	diagCdiVersions    diagFileKind = "cdi.versions"
+	diagFactorVersions diagFileKind = "factor.versions"
+)
+
+// Шаблоны путей файлов относительно корня диагностики.
+// Первая группа, если есть, — номер ротированного лога
+var diagFilePatterns = map[diagFileKind]*regexp.Regexp{
+	diagLifecycleLog: regexp.MustCompile(`^cdi\.logs/cdi-lifecycle\.log(?:\.(\d+))?$`),
+	diagCdiLog:       regexp.MustCompile(`^cdi\.logs/cdi\.log(?:\.(\d+))?$`),
+	diagSoapStats:    regexp.MustCompile(`^cdi\.logs/cdi-soap-stats\.log(?:\.(\d+))?$`),
+	// бывают и с расширением .txt
+	diagCdiVersions:    regexp.MustCompile(`^cdi\.versions(?:\.txt)?$`),
+	diagFactorVersions: regexp.MustCompile(`^factor\.versions(?:\.txt)?$`),
+}
+
+// locatedFile is the file of the diagnostic found in the archive
+type locatedFile struct {
+	*archiveEntry
+	// path relative to the diagnostic root
+	path string
+	// number of the rotated log, 0 for the current one
+	rotation int
+}
+
+// diagFiles are the located files by kind,
+// rotated logs are in chronological order: the oldest first
+type diagFiles map[diagFileKind][]*locatedFile
+
+// bring the path to the slash-separated form and skip macOS junk
+func normalizeEntryName(name string) (string, bool) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = strings.TrimLeft(path.Clean("/"+name), "/")
+	if strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(path.Base(name), "._") {
+		return "", false
+	}
+	return name, true
+}
+
+// match the path and all its suffixes after the stripped folders
+func matchDiagFile(name string) (diagFileKind, string, int, bool) {
+	for {
+		for kind, re := range diagFilePatterns {
+			m := re.FindStringSubmatch(name)
+			if m == nil {
+				continue
+			}
+			rotation := 0
+			if len(m) > 1 && m[1] != "" {
+				rotation, _ = strconv.Atoi(m[1])
+			}
+			return kind, name, rotation, true
+		}
+		i := strings.Index(name, "/")
+		if i < 0 {
+			return "", "", 0, false
+		}
+		name = name[i+1:]
+	}
+}
+
+func locateDiagFiles(entries []*archiveEntry) diagFiles {
+	res := make(diagFiles)
+	for _, e := range entries {
+		name, ok := normalizeEntryName(e.Name)
+		if !ok {
+			continue
+		}
+		kind, relPath, rotation, ok := matchDiagFile(name)
+		if !ok {
+			continue
+		}
+		res[kind] = append(res[kind], &locatedFile{archiveEntry: e, path: relPath, rotation: rotation})
+	}
+	// the bigger number of the rotated log the older it is
+	for _, files := range res {
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].rotation > files[j].rotation
+		})
+	}
+	return res
+}
+
+// first file of the kind, nil if there is no such file
+func (df diagFiles) first(kind diagFileKind) *locatedFile {
+	if len(df[kind]) == 0 {
+		return nil
+	}
+	return df[kind][0]
+}
+
+// paths of the found files to tell the user
+func (df diagFiles) found() []string {
+	res := make([]string, 0)
+	for _, files := range df {
+		for _, f := range files {
+			res = append(res, f.path)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// open all files of the kind as one stream in chronological order
+func (df diagFiles) openMerged(kind diagFileKind) (io.ReadCloser, error) {
+	files := df[kind]
+	readers := make([]io.Reader, 0, 2*len(files))
+	closers := make(multiCloser, 0, len(files))
+	for _, f := range files {
+		r, err := f.Open()
+		if err != nil {
+			_ = closers.Close()
+			return nil, err
+		}
+		closers = append(closers, r)
+		// the file may not end with the new line
+		readers = append(readers, r, strings.NewReader("\n"))
+	}
+	return entryReader{io.MultiReader(readers...), closers}, nil
+}
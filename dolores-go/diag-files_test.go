@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Проверяем, что файлы диагностики находятся независимо от структуры архива
+
+func newTestEntry(name, content string) *archiveEntry {
+	return &archiveEntry{
+		Name: name,
+		Size: int64(len(content)),
+		open: func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(content)), nil
+		},
+	}
+}
+
+func Test_locateDiagFiles(t *testing.T) {
+	tests := []struct {
+		name      string
+		entries   []*archiveEntry
+		wantFound []string
+		wantLog   string
+	}{
+		{
+			name: "plain",
+			entries: []*archiveEntry{
+				newTestEntry("cdi.logs/cdi-lifecycle.log", "current"),
+				newTestEntry("cdi.logs/cdi.log", ""),
+				newTestEntry("sql.party.xls", ""),
+			},
+			wantFound: []string{"cdi.logs/cdi-lifecycle.log", "cdi.logs/cdi.log"},
+			wantLog:   "current\n",
+		},
+		{
+			name: "top folder and backslashes",
+			entries: []*archiveEntry{
+				newTestEntry(`diag_192\cdi.logs\cdi-lifecycle.log`, "current"),
+				newTestEntry(`diag_192\sql.party.xls`, ""),
+			},
+			wantFound: []string{"cdi.logs/cdi-lifecycle.log"},
+			wantLog:   "current\n",
+		},
+		{
+			name: "rotated logs",
+			entries: []*archiveEntry{
+				newTestEntry("diag/cdi.logs/cdi-lifecycle.log.1", "older"),
+				newTestEntry("diag/cdi.logs/cdi-lifecycle.log", "current"),
+				newTestEntry("diag/cdi.logs/cdi-lifecycle.log.10", "oldest"),
+				newTestEntry("diag/cdi.logs/cdi-lifecycle.log.2", "old"),
+			},
+			wantFound: []string{
+				"cdi.logs/cdi-lifecycle.log",
+				"cdi.logs/cdi-lifecycle.log.1",
+				"cdi.logs/cdi-lifecycle.log.10",
+				"cdi.logs/cdi-lifecycle.log.2",
+			},
+			wantLog: "oldest\nold\nolder\ncurrent\n",
+		},
+		{
+			name: "macos junk",
+			entries: []*archiveEntry{
+				newTestEntry("__MACOSX/diag/cdi.logs/._cdi-lifecycle.log", "junk"),
+				newTestEntry("diag/cdi.logs/._cdi-lifecycle.log", "junk"),
+			},
+			wantFound: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := locateDiagFiles(tt.entries)
+			if got := files.found(); !reflect.DeepEqual(got, tt.wantFound) {
+				t.Errorf("locateDiagFiles() found = %#v, want %#v", got, tt.wantFound)
+			}
+			if tt.wantLog == "" {
+				return
+			}
+			r, err := files.openMerged(diagLifecycleLog)
+			if err != nil {
+				t.Fatalf("openMerged() error = %v", err)
+			}
+			defer r.Close()
+			got, _ := io.ReadAll(r)
+			if string(got) != tt.wantLog {
+				t.Errorf("openMerged() = %q, want %q", got, tt.wantLog)
+			}
+		})
+	}
+}
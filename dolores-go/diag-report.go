@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/go-units"
+)
+
+// Отчет по архиву, который Долорес присылает до сборки:
+// какие файлы нашла и каких нет, какие версии достала и откуда, что с алиасом заказчика
+// и главное — можно ли это разворачивать
+
+// what we expect to see in the diagnostic, in the order of the report
+var expectedDiagFiles = []struct {
+	kind    diagFileKind
+	purpose string
+}{
+	{kind: diagLifecycleLog, purpose: "версии приложения"},
+	{kind: diagCdiLog, purpose: "ошибки приложения"},
+	{kind: diagSoapStats, purpose: "производительность SOAP"},
+	{kind: diagCdiVersions, purpose: "запасной источник версий"},
+	{kind: diagFactorVersions, purpose: "версия Фактора"},
+}
+
+var reportMessages = struct {
+	header        string
+	filePresent   string
+	fileMissing   string
+	fileRequired  string
+	extraction    string
+	fileExtracted string
+	versions      string
+	field         string
+	fieldSource   string
+	notParsed     string
+	aliasResolved string
+	aliasUnknown  string
+	aliasFallback string
+	factor        string
+	warnings      string
+	cdiLog        string
+	cdiLogClean   string
+	logGroup      string
+	logException  string
+	soapStats     string
+	verdictOk     string
+	verdictFail   string
+	verdictAsk    string
+	more          string
+}{
+	header:        "Что нашла в архиве (%s):",
+	filePresent:   "+ %s — %s, %s (%s)",
+	fileMissing:   "- %s — нет (%s)",
+	fileRequired:  "- %s — нет, а без него никак (%s)",
+	extraction:    "На стенд положу:",
+	fileExtracted: "+ %s → %s, %s (%s)",
+	versions:      "Версии:",
+	field:         "%s: %s",
+	fieldSource:   "%s: %s (%s)",
+	notParsed:     "не определила",
+	aliasResolved: "заказчик: «%s» → %s (%s)",
+	aliasUnknown:  "заказчик: «%s» → алиас не знаю",
+	aliasFallback: "заказчик: «%s» → алиас не знаю, беру %s из %s",
+	factor:        "Фактор: %s, ревизия %s, собран %s (%s)",
+	warnings:      "Обрати внимание:",
+	cdiLog:        "В cdi.log ошибок: %d, предупреждений: %d. Чаще всего:",
+	cdiLogClean:   "В cdi.log ни ошибок, ни предупреждений",
+	logGroup:      "• %s ×%d %s: %s (%s — %s)",
+	logException:  "  %s",
+	soapStats:     "SOAP: %d методов за %s — %s, худший p99 — %s %d мс. Подробнее: /soapstats",
+	verdictOk:     "Итог: можно разворачивать",
+	verdictFail:   "Итог: разворачивать не буду:",
+	verdictAsk:    "Итог: можно разворачивать, только скажи, чей это репозиторий",
+	more:          "… и еще %d",
+}
+
+func (d *diagnostic) report() string {
+	lines := []string{fmt.Sprintf(reportMessages.header, d.format)}
+
+	for _, expected := range expectedDiagFiles {
+		files := d.files[expected.kind]
+		if len(files) == 0 {
+			lines = append(lines, fmt.Sprintf(reportMessages.fileMissing, expected.kind, expected.purpose))
+			continue
+		}
+		for i, f := range files {
+			if i == maxReportFiles {
+				lines = append(lines, fmt.Sprintf(reportMessages.more, len(files)-i))
+				break
+			}
+			lines = append(lines, fmt.Sprintf(reportMessages.filePresent,
+				f.path, units.HumanSize(float64(f.Size)), f.ModTime.Format("2006-01-02 15:04"), expected.purpose))
+		}
+	}
+
+	if d.extraction != nil {
+		lines = append(lines, "", reportMessages.extraction)
+		for i, f := range d.extraction.files {
+			if i == maxReportFiles {
+				lines = append(lines, fmt.Sprintf(reportMessages.more, len(d.extraction.files)-i))
+				break
+			}
+			lines = append(lines, fmt.Sprintf(reportMessages.fileExtracted,
+				f.source, f.mountedPath(), units.HumanSize(float64(f.size)), f.rule.purpose))
+		}
+		for _, rule := range d.extraction.unmatched {
+			format := reportMessages.fileMissing
+			if rule.required {
+				format = reportMessages.fileRequired
+			}
+			lines = append(lines, fmt.Sprintf(format, rule.pattern, rule.purpose))
+		}
+	}
+
+	lines = append(lines, "", reportMessages.versions)
+	lines = append(lines, d.customerLine())
+	v := d.versions
+	lines = append(lines,
+		d.fieldLine("сборка заказчика", v.CustomerRevision, "CustomerRevision"),
+		d.fieldLine("core", v.CoreRevision, "CoreRevision"),
+		d.fieldLine("версия CDI", v.FactorTagVersion, "FactorTagVersion"),
+	)
+	if v.FactorVersion != "" {
+		lines = append(lines, fmt.Sprintf(reportMessages.factor,
+			v.FactorVersion, v.FactorRevision, v.FactorBuildTime, v.Sources["FactorVersion"]))
+	}
+
+	if d.cdiLog != nil {
+		lines = append(lines, "")
+		lines = append(lines, d.cdiLog.report(topLogGroups)...)
+	}
+
+	if d.soapStats != nil {
+		first, last := d.soapStats.period()
+		worst := d.soapStats.worstByP99(1)[0]
+		lines = append(lines, "", fmt.Sprintf(reportMessages.soapStats,
+			len(d.soapStats.methods()), first.Format("2006-01-02 15:04"), last.Format("2006-01-02 15:04"),
+			worst.Service+"."+worst.Method, worst.P99))
+	}
+
+	if len(d.warnings) != 0 {
+		lines = append(lines, "", reportMessages.warnings)
+		lines = append(lines, d.warnings...)
+	}
+
+	lines = append(lines, "")
+	switch {
+	case d.deployable() && d.unknownCustomer != "":
+		lines = append(lines, reportMessages.verdictAsk)
+	case d.deployable():
+		lines = append(lines, reportMessages.verdictOk)
+	default:
+		lines = append(lines, reportMessages.verdictFail)
+		for _, problem := range d.problems {
+			lines = append(lines, "- "+problem)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// сколько групп из cdi.log показываем и насколько длинный пример сообщения,
+// сколько файлов одного вида перечисляем. Остальное влезает, а если нет — отчет уйдет несколькими сообщениями
+const (
+	maxReportFiles   = 20
+	topLogGroups     = 5
+	maxLogExampleLen = 200
+)
+
+func (s *logSummary) report(n int) []string {
+	if len(s.Groups) == 0 {
+		return []string{reportMessages.cdiLogClean}
+	}
+	lines := []string{fmt.Sprintf(reportMessages.cdiLog, s.Errors, s.Warnings)}
+	for _, g := range s.top(n) {
+		example := []rune(g.Example)
+		if len(example) > maxLogExampleLen {
+			example = append(example[:maxLogExampleLen], '…')
+		}
+		lines = append(lines, fmt.Sprintf(reportMessages.logGroup,
+			g.Level, g.Count, g.Logger, string(example), g.First.Format("2006-01-02 15:04:05"), g.Last.Format("2006-01-02 15:04:05")))
+		if g.Exception != "" {
+			lines = append(lines, fmt.Sprintf(reportMessages.logException, g.Exception))
+		}
+	}
+	return lines
+}
+
+func (d *diagnostic) fieldLine(title, value, field string) string {
+	if value == "" {
+		return fmt.Sprintf(reportMessages.field, title, reportMessages.notParsed)
+	}
+	return fmt.Sprintf(reportMessages.fieldSource, title, value, d.versions.Sources[field])
+}
+
+// how the customer name from the log turned into the repository name
+func (d *diagnostic) customerLine() string {
+	v := d.versions
+	switch {
+	case v.CustomerTitle == "":
+		return d.fieldLine("заказчик", v.CustomerName, "CustomerName")
+	case v.CustomerName != "" && v.Sources["CustomerName"] == v.Sources["CustomerTitle"]:
+		return fmt.Sprintf(reportMessages.aliasResolved, v.CustomerTitle, v.CustomerName, v.Sources["CustomerName"])
+	case v.CustomerName != "":
+		return fmt.Sprintf(reportMessages.aliasFallback, v.CustomerTitle, v.CustomerName, v.Sources["CustomerName"])
+	}
+	return fmt.Sprintf(reportMessages.aliasUnknown, v.CustomerTitle)
+}
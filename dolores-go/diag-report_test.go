@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Проверяем отчет по архиву: что нашли, чего нет и можно ли разворачивать
+
+func TestDiagnosticReport(t *testing.T) {
+	extractionRules = testExtractionRules
+	tests := []struct {
+		name         string
+		zippath      string
+		wantContains []string
+	}{
+		{
+			name:    "good",
+			zippath: "test_data/diag_good.zip",
+			wantContains: []string{
+				"Что нашла в архиве (zip):",
+				"+ cdi.logs/cdi-lifecycle.log — 43.99kB, 2022-04-06 18:32 (версии приложения)",
+				"На стенд положу:\n+ sql.party.xls → /opt/diag/sql.party.xls, 24.58kB (данные для заливки)",
+				"заказчик: «Demo» → demo (cdi-lifecycle.log)",
+				"Фактор: 20.06, ревизия 9ca5f232, собран 2020-07-08T17:55:00.000+03:00 (factor.versions)",
+				"SOAP: 2 методов за 2020-07-21 00:00 — 2020-07-21 00:20, худший p99 — soap_PartyWS.fuzzySearch 938 мс. Подробнее: /soapstats",
+				"Итог: можно разворачивать",
+			},
+		},
+		{
+			name:    "unknown customer without diag",
+			zippath: "test_data/diag_empty.zip",
+			wantContains: []string{
+				"- cdi.versions — нет (запасной источник версий)",
+				"- sql.party.xls — нет, а без него никак (данные для заливки)",
+				"- sql.*.xls — нет (другие датасеты)",
+				"заказчик: «Sony» → алиас не знаю",
+				"В cdi.log ошибок: 2, предупреждений: 0. Чаще всего:\n• ERROR ×2 FilesImportPerformer: Failed to load file 'SSO_20200723.csv' for system 'SSO'. (2020-07-23 23:11:01 — 2020-07-23 23:11:04)",
+				"Итог: разворачивать не буду:",
+				"- не знаю репозиторий для заказчика «Sony»",
+				"- нет sql.party.xls, а без него никак (данные для заливки)",
+			},
+		},
+		{
+			name:    "without lifecycle log",
+			zippath: "test_data/diag_without_versions.zip",
+			wantContains: []string{
+				"- cdi.logs/cdi-lifecycle.log — нет (версии приложения)",
+				"+ cdi.versions.txt — 1.82kB",
+				"заказчик: «demo» → demo (cdi.versions)",
+				"FactorTagVersion: 20.12 в cdi.versions, но 20.06 в factor.versions",
+				"core: 2c980808 (cdi.versions)",
+				"Итог: можно разворачивать",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diag, _ := parseZipFile(tt.zippath, t.TempDir())
+			if diag == nil {
+				t.Fatal("parseZipFile() returned no diagnostic")
+			}
+			report := diag.report()
+			for _, want := range tt.wantContains {
+				if !strings.Contains(report, want) {
+					t.Errorf("report() does not contain %q:\n%s", want, report)
+				}
+			}
+		})
+	}
+}
+
+func TestDiagnosticReportManyFiles(t *testing.T) {
+	files := make([]*locatedFile, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		files = append(files, &locatedFile{archiveEntry: &archiveEntry{Size: 1}, path: fmt.Sprintf("cdi.logs/cdi.log.%d", i)})
+	}
+	diag := &diagnostic{format: "zip", files: diagFiles{diagCdiLog: files}, versions: &applicationVersions{}}
+	report := diag.report()
+	if !strings.Contains(report, fmt.Sprintf("… и еще %d", 1000-maxReportFiles)) {
+		t.Errorf("report() does not cut the files:\n%s", report)
+	}
+	if len(splitMessage(report)) != 1 {
+		t.Errorf("report() of %d files takes %d messages", len(files), len(splitMessage(report)))
+	}
+}
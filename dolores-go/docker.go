@@ -5,11 +5,15 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"os"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/archive"
@@ -41,6 +45,27 @@ type DockerRunner interface {
 	KillRunningContainers(containerNameToDelete string) error
 	// CheckRunningContainer checks if is the container running right now by name
 	CheckRunningContainer(containerName string) (bool, error)
+	// PublishedAddress returns the host and the port where the port of the container is published
+	// * containerName – the running container
+	// * containerPort – the port inside the container. Ex: "8080"
+	PublishedAddress(containerName string, containerPort string) (string, string, error)
+	// CommitContainer saves the current state of the container as a new image
+	// * containerName – the container to commit
+	// * imageName – the name of the new image
+	// * labels – labels to set on the new image
+	CommitContainer(containerName string, imageName string, labels map[string]string) error
+	// ListImages returns images which have the specified label
+	ListImages(label string) ([]imageInfo, error)
+	// ImageExists checks if the image with the name is still there
+	ImageExists(imageName string) (bool, error)
+}
+
+// imageInfo is the short description of the docker image
+type imageInfo struct {
+	ID      string
+	Tags    []string
+	Labels  map[string]string
+	Created time.Time
 }
 
 // DockerClient is the implementation of the DockerRunner interface
@@ -244,6 +269,43 @@ func (d *DockerClient) CheckRunningContainer(containerName string) (bool, error)
 	return false, nil
 }
 
+// Where the port of the container is published: the host IP of the binding,
+// or the host of the docker daemon if the port is bound to all interfaces
+func (d *DockerClient) PublishedAddress(containerName string, containerPort string) (string, string, error) {
+	ctx := context.Background()
+
+	info, err := d.client.ContainerInspect(ctx, containerName)
+	if err != nil {
+		return "", "", err
+	}
+	port, err := nat.NewPort("tcp", containerPort)
+	if err != nil {
+		return "", "", err
+	}
+	if info.NetworkSettings != nil {
+		for _, binding := range info.NetworkSettings.Ports[port] {
+			if binding.HostPort == "" {
+				continue
+			}
+			host := binding.HostIP
+			if host == "" || host == "0.0.0.0" || host == "::" {
+				host = d.daemonHost()
+			}
+			return host, binding.HostPort, nil
+		}
+	}
+	return "", "", fmt.Errorf("port %s of the container %s is not published", containerPort, containerName)
+}
+
+// the host of the docker daemon, localhost for the socket
+func (d *DockerClient) daemonHost() string {
+	u, err := url.Parse(d.client.DaemonHost())
+	if err != nil || u.Scheme == "unix" || u.Scheme == "npipe" || u.Hostname() == "" {
+		return "localhost"
+	}
+	return u.Hostname()
+}
+
 func (d *DockerClient) KillRunningContainers(containerNameToDelete string) error {
 	containers, err := d.listContainers()
 	if err != nil {
@@ -269,3 +331,58 @@ func (d *DockerClient) KillRunningContainers(containerNameToDelete string) error
 	}
 	return nil
 }
+
+// Commit the container into the image with labels
+func (d *DockerClient) CommitContainer(containerName string, imageName string, labels map[string]string) error {
+	changes := make([]string, 0, len(labels))
+	for key, value := range labels {
+		changes = append(changes, fmt.Sprintf("LABEL %s=%q", key, value))
+	}
+	// docker applies changes in order, keep it stable
+	sort.Strings(changes)
+
+	resp, err := d.client.ContainerCommit(context.Background(), containerName, types.ContainerCommitOptions{
+		Reference: imageName,
+		Comment:   "dolores snapshot",
+		Changes:   changes,
+		Pause:     true,
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Container %s is committed to %s (%s)", containerName, imageName, resp.ID)
+
+	return nil
+}
+
+// List images which have the label
+func (d *DockerClient) ListImages(label string) ([]imageInfo, error) {
+	images, err := d.client.ImageList(context.Background(), types.ImageListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", label)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := make([]imageInfo, 0, len(images))
+	for _, image := range images {
+		res = append(res, imageInfo{
+			ID:      image.ID,
+			Tags:    image.RepoTags,
+			Labels:  image.Labels,
+			Created: time.Unix(image.Created, 0),
+		})
+	}
+	return res, nil
+}
+
+// Check the image by name, false if docker does not know it
+func (d *DockerClient) ImageExists(imageName string) (bool, error) {
+	_, _, err := d.client.ImageInspectWithRaw(context.Background(), imageName)
+	if client.IsErrNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/docker/docker/client"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
@@ -15,6 +16,11 @@ const (
 	waitInPendingSeconds = 600
 	// как в коде называется dockerfile
 	dockerfile = "Dockerfile"
+	// куда в контейнере монтируем распакованную диагностику
+	diagMountPoint = "/opt/diag"
+	// защита от zip-бомб: сколько файлов и сколько байт после распаковки готовы принять в одном архиве
+	maxArchiveEntries   = 10000
+	maxUncompressedSize = 2 << 30
 )
 
 // IP виртуалки, на которой будет работать бот
@@ -23,19 +29,79 @@ var serverIP = "127.0.0.1"
 // Cоздаем бота в телеге через botFather, получаем токен и потом с ним работаем
 var botToken = "1319000055:AAFHVUNFLS"
 
+// Адрес своего сервера Bot API (telegram-bot-api --local), например http://127.0.0.1:8081.
+// Пусто — api.telegram.org, там бот скачивает файлы только до 20 МБ
+var botAPIURL = ""
+
+// Задачи ЕК: статус сначала спрашиваем раз в taskPollInterval, потом все реже, но не реже taskMaxPollInterval.
+// Сколько ждем задачу — timeout в taskChain, если не задан — defaultTaskTimeout.
+// Пока задача идет, раз в taskProgressInterval пишем, что она еще работает
+var (
+	taskPollInterval     = 5 * time.Second
+	taskMaxPollInterval  = time.Minute
+	taskProgressInterval = 10 * time.Minute
+	defaultTaskTimeout   = time.Hour
+)
+
+// Как Долорес ходит в ЕК развернутого стенда (TaskWS и страница входа), см. cdi-stand.go.
+// Хост и порт — те, на которые docker опубликовал cdiPort контейнера сессии.
+// cdiHost — свой хост стенда, если до docker Долорес ходит не так, как его видит docker. Для https:
+// cdiCAFile — PEM с CA, которым подписан сертификат стенда (пусто — системные),
+// cdiCertFile и cdiKeyFile — клиентский сертификат и ключ, если стенд его требует.
+// cdiRequestTimeout — сколько ждем ответа на один запрос
+var (
+	cdiScheme                          = "http"
+	cdiHost                            = ""
+	cdiUsername                        = "admin_login"
+	cdiPassword                        = "admin_pass"
+	cdiCAFile, cdiCertFile, cdiKeyFile = "", "", ""
+	cdiRequestTimeout                  = time.Minute
+)
+
+// Откуда еще можно взять большую диагностику: ссылка на файловый сервер или путь в общей папке, см. download.go
+var (
+	sharedFileServers = []string{}
+	sharedFilesDirs   = []string{}
+)
+
 var (
 	// Массив taskToRun см в helpers.go
-	taskChain                                   []taskToRun
-	ports, filesToIncludeToContext, volumeBinds []string
-	schemaName, dirToSave, cdiPort              string
+	taskChain                                      []taskToRun
+	extractionRules                                []extractionRule
+	lifecycleLineFormats                           []lifecycleLineFormat
+	ports, filesToIncludeToContext, volumeBinds    []string
+	taskWSVersions, adHocTasks                     []string
+	schemaName, sessionsDir, cdiPort, snapshotsDir string
+	aliasesFile, uploadsIndexFile, taskWSVersion   string
+	uploadTimeout                                  time.Duration
 )
 
-func initVars(taskChain *[]taskToRun,
-	ports, filesToIncludeToContext, volumeBinds *[]string,
-	schemaName, dirToSave, cdiPort *string,
+func initVars(taskChain *[]taskToRun, extractionRules *[]extractionRule, lifecycleLineFormats *[]lifecycleLineFormat,
+	ports, filesToIncludeToContext, volumeBinds, taskWSVersions, adHocTasks *[]string,
+	schemaName, sessionsDir, cdiPort, snapshotsDir, aliasesFile, uploadsIndexFile, taskWSVersion *string,
+	uploadTimeout *time.Duration,
 ) {
 	*cdiPort = "8080"
-	*dirToSave = "diag"
+	// Тут для каждой сессии создаем временную директорию: в неё скачиваем архив,
+	// а её поддиректорию diag монтируем в /opt/diag. После сессии директорию удаляем
+	*sessionsDir = "sessions"
+	// Сюда копируем данные из /opt/diag, когда сохраняем стенд в снапшот
+	*snapshotsDir = "snapshots"
+	// Алиасы заказчиков: {"имя из лога": "репозиторий"}, см. aliases.go.
+	// Сюда же дописываем алиасы, которые подтвердил пользователь
+	*aliasesFile = "aliases.json"
+	// Сколько ждем недостающие части диагностики. Не дождались — закрываем сессию, чтобы стенд не простаивал
+	*uploadTimeout = 30 * time.Minute
+	// Индекс присланных диагностик по sha256: версии, образы и снапшоты, см. upload-index.go
+	*uploadsIndexFile = "uploads.json"
+	// Версии API TaskWS, которые знает Долорес: namespace http://hflabs.ru/cdi/task/{версия}
+	// и адрес /cdi/soap/services/{версия}/TaskWS. Для стенда берем самую новую, не новее версии ЕК
+	// из диагностики, и проверяем, что стенд ее отдает. Появится новая версия API — дописать сюда
+	*taskWSVersions = []string{"15_3"}
+	// Если задать, то всегда эта версия TaskWS, без выбора по версии ЕК
+	*taskWSVersion = ""
+	// Какие задачи владелец стенда может запустить из чата командой /task, см. task-commands.go
+	*adHocTasks = []string{"importDataSetTask", "enginesFullRebuild"}
 	*schemaName = "cdi_temp_user_1"
 	*ports = []string{
 		"8080:8080",
@@ -48,61 +114,110 @@ func initVars(taskChain *[]taskToRun,
 	*filesToIncludeToContext = []string{
 		dockerfile,
 		"settings_hflabs.xml",
-		"diag/sql.party.xls",
 	}
-	// В директорию /opt/diag хост-машины докера будем монтировать /root/cdi-misc/dolores-bot/diag
-	*volumeBinds = []string{
-		"/root/cdi-misc/dolores-bot/diag:/opt/diag",
+	// Дополнительные директории хост-машины, которые монтируем в контейнер.
+	// Директорию с диагностикой текущей сессии монтируем в /opt/diag сами
+	*volumeBinds = []string{}
+	// Форматы строки о старте приложения в lifecycle-логе. В разных версиях CDI строка пишется по-разному,
+	// новый формат добавляем сюда, код менять не нужно. Именованные группы обязательны:
+	// timestamp (в формате lifecycleTimeFormat), customer, version, customerRevision, coreRevision.
+	// Проверить строку из лога на всех форматах: /lifecycle <строка>
+	*lifecycleLineFormats = []lifecycleLineFormat{
+		{
+			name:    "start",
+			pattern: `^(?P<timestamp>\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2},\d{3}) INFO  start - CDI application \[(?P<customer>[\w ]+) (?P<version>[0-9\.]+)-SNAPSHOT (?:.*?)\((?P<customerRevision>[0-9a-z]+), core (?P<coreRevision>[0-9a-z]+)\)\] \[(?:.*?)\] started in \d+ s\.$`,
+		},
+		{
+			name:    "LifecycleEventListener",
+			pattern: `^(?P<timestamp>\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2},\d{3}) INFO  LifecycleEventListener - CDI application \[(?P<customer>[\w ]+) (?P<version>[0-9\.]+)-SNAPSHOT (?:.*?)\((?P<customerRevision>[0-9a-z]+), core (?P<coreRevision>[0-9a-z]+)\)\] \[[0-9\.]+\] started in \d+ s\.`,
+		},
+	}
+	// Какие файлы из диагностики положить на стенд, см. extraction.go
+	// pattern — glob по пути в диагностике, target — куда положить относительно /opt/diag (с / на конце — в папку)
+	// required — без файла не разворачиваем, param — имя, под которым пути к файлам доступны в taskParams.
+	// У нескольких правил может быть один param, тогда файлы идут в порядке правил:
+	// так задаем порядок загрузки датасетов — сначала party, потом остальные по имени
+	*extractionRules = []extractionRule{
+		{pattern: "sql.party.xls", target: "sql.party.xls", required: true, param: "dataSets", purpose: "данные для заливки"},
+		{pattern: "sql.*.xls", target: "datasets/", param: "dataSets", purpose: "другие датасеты"},
+		{pattern: "*.conf/*.xml", target: "conf/", param: "configs", purpose: "конфигурация"},
+		{pattern: "dictionaries/*", target: "dictionaries/", param: "dictionaries", purpose: "справочники"},
 	}
 	// Какие задачи запускать внутри приложения. У нас есть API, по которому можно дергать задачи из админки
 	// Тут указываем, какие задачи будем использовать:
 	// taskName — название задачи (по нему дергаем)
-	// taskParams — параметры задачи
+	// taskParams — параметры задачи. Строковые значения — шаблоны text/template,
+	// в них есть пути к файлам из extractionRules: {{.File.dataSets}}, {{join .Files.dataSets ","}},
+	// схема {{.Schema}}, заказчик {{.Customer}}, версии {{.Versions.FactorTagVersion}} и владелец стенда {{.User}}
+	// forEach — запустить задачу для каждого файла с этим param, путь к файлу — {{.Current}}
 	// message — сообщение, которое напишет Долорес, если сможет успешно выполнить задачу
+	// customers, ifFiles, when — условия запуска, continueOnError — не останавливать цепочку,
+	// group — запускать вместе с соседними задачами той же группы, см. helpers.go и task-chain.go.
+	// Что вышло у каждой задачи, Долорес пишет в конце одним отчетом
 	*taskChain = []taskToRun{
 		{
-			// Задача, которая загрузит данные из эксельки в БД
+			// Задача, которая загрузит данные из эксельки в БД, по разу на каждый датасет
 			taskName: "importDataSetTask",
 			taskParams: []*TaskParam{
-				{ParamName: "dataSetFile", ParamValue: "/opt/diag/sql.party.xls"},
-				{ParamName: "schemaName", ParamValue: *schemaName},
+				{ParamName: "dataSetFile", ParamValue: "{{.Current}}"},
+				{ParamName: "schemaName", ParamValue: "{{.Schema}}"},
 			},
 			message: "Успешно загрузила диагностику",
+			forEach: "dataSets",
+			timeout: 30 * time.Minute,
 		},
 		{
 			// Задача, которая перестраивает индексы lucene, по факту очищает кеши и приводит систему в консистентное состояние
 			taskName:   "enginesFullRebuild",
 			taskParams: nil,
 			message:    "Успешно перестроила индексы",
+			// на больших диагностиках перестроение идет долго, но не бесконечно
+			timeout: 3 * time.Hour,
 		},
 	}
 }
 
 func main() {
 	flag.Parse()
-	initVars(&taskChain,
-		&ports, &filesToIncludeToContext, &volumeBinds,
-		&schemaName, &dirToSave, &cdiPort)
+	initVars(&taskChain, &extractionRules, &lifecycleLineFormats,
+		&ports, &filesToIncludeToContext, &volumeBinds, &taskWSVersions, &adHocTasks,
+		&schemaName, &sessionsDir, &cdiPort, &snapshotsDir, &aliasesFile, &uploadsIndexFile, &taskWSVersion,
+		&uploadTimeout)
+	// с кривым форматом lifecycle-лога не узнаем версии ни одной диагностики
+	var err error
+	lifecyclePatterns, err = compileLifecycleFormats(lifecycleLineFormats)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// с битым файлом алиасов лучше не стартовать, чем потом не узнавать заказчиков
+	if err := clientsAliases.load(aliasesFile); err != nil {
+		log.Fatal(err)
+	}
+	if err := uploadsIndex.load(uploadsIndexFile); err != nil {
+		log.Fatal(err)
+	}
+
+	// кривой CA или сертификат лучше увидеть сразу, а не на первом развертывании.
+	// Хост и порт здесь для проверки, настоящие берем у контейнера сессии
+	if _, err := newConnectToCdi(newCdiStand("localhost", cdiPort)); err != nil {
+		log.Fatal(err)
+	}
 
 	for _, task := range taskChain[0].taskParams {
 		fmt.Printf("%+v\n", task)
 	}
 	log.SetOutput(os.Stdout)
 
-	// Данные для входа в админку приложения
-	cdiClient := newConnectToCdi(
-		"admin_login",
-		"admin_pass",
-		"localhost",
-		"8080",
-	)
-
 	dockerClient, err := client.NewClientWithOpts(client.FromEnv)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	botClient, err := tgbotapi.NewBotAPI(botToken)
+	telegramClient, err := newTelegramHTTPClient(botAPIURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	botClient, err := tgbotapi.NewBotAPIWithClient(botToken, telegramClient)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -115,7 +230,7 @@ func main() {
 		panic(err)
 	}
 
-	as := newActiveSession(botClient, cdiClient, dockerClient)
+	as := newActiveSession(botClient, dockerClient)
 
 	for update := range updates {
 		go func(update tgbotapi.Update) {
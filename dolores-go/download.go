@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Откуда берем диагностику:
+// - документ в телеге. Через api.telegram.org бот скачивает файлы только до 20 МБ,
+//   свой сервер Bot API (botAPIURL) — до 2 ГБ
+// - ссылка на файловый сервер из sharedFileServers или путь внутри sharedFilesDirs в тексте сообщения,
+//   можно с контрольной суммой: https://files.hflabs.ru/diag.zip sha256:<hex>
+// Скачиваем потоком, не больше maxDownloadSize, и сразу считаем sha256
+
+const (
+	// столько скачивает бот через api.telegram.org
+	telegramDownloadLimit = 20 << 20
+	// больше архив не качаем, даже со своего сервера
+	maxDownloadSize = 2 << 30
+	telegramAPIHost = "api.telegram.org"
+	// столько ждем ответа Bot API: getUpdates ждет сообщений минуту,
+	// а свой сервер на getFile сначала сам скачивает файл из телеги
+	telegramRequestTimeout = 10 * time.Minute
+	// описание ошибки getFile в ответе Bot API, код ошибки библиотека v4 не отдает
+	telegramFileTooBig = "Bad Request: file is too big"
+)
+
+// Столько качаем один файл диагностики, дальше считаем, что сервер завис
+var downloadTimeout = 30 * time.Minute
+
+var (
+	errFileTooBig       = errors.New("file is too big")
+	errChecksumMismatch = errors.New("checksum mismatch")
+	errNoDownloadLink   = errors.New("cannot get the download link")
+	errBadDiagSource    = errors.New("not a link or a path to the diagnostic")
+
+	sha256Template = regexp.MustCompile(`^(?:sha256:)?([0-9a-fA-F]{64})$`)
+)
+
+// botAPITransport sends the requests to api.telegram.org to the own Bot API server
+type botAPITransport struct {
+	base *url.URL
+	next http.RoundTripper
+}
+
+func (t *botAPITransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != telegramAPIHost {
+		return t.next.RoundTrip(req)
+	}
+	rewritten := req.Clone(req.Context())
+	rewritten.URL.Scheme = t.base.Scheme
+	rewritten.URL.Host = t.base.Host
+	rewritten.URL.Path = strings.TrimSuffix(t.base.Path, "/") + req.URL.Path
+	rewritten.Host = ""
+	return t.next.RoundTrip(rewritten)
+}
+
+// newTelegramHTTPClient returns the client for the Bot API: the default one for api.telegram.org
+// or the one which rewrites the requests to apiURL
+func newTelegramHTTPClient(apiURL string) (*http.Client, error) {
+	if apiURL == "" {
+		return &http.Client{Timeout: telegramRequestTimeout}, nil
+	}
+	base, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad Bot API url %q: %w", apiURL, err)
+	}
+	if (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("bad Bot API url %q: need http(s)://host[:port]", apiURL)
+	}
+	return &http.Client{Transport: &botAPITransport{base: base, next: http.DefaultTransport}, Timeout: telegramRequestTimeout}, nil
+}
+
+// downloaded is the file of the diagnostic on the disk
+type downloaded struct {
+	size   int64
+	sha256 string
+}
+
+// copy no more than limit bytes, count the checksum on the fly and check it if expected is not empty
+func saveWithLimit(target string, in io.Reader, limit int64, expected string) (*downloaded, error) {
+	out, err := os.Create(target)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, hash), io.LimitReader(in, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > limit {
+		return nil, fmt.Errorf("%w: more than %d bytes", errFileTooBig, limit)
+	}
+	res := &downloaded{size: n, sha256: hex.EncodeToString(hash.Sum(nil))}
+	if expected != "" && !strings.EqualFold(expected, res.sha256) {
+		return nil, fmt.Errorf("%w: got %s, want %s", errChecksumMismatch, res.sha256, expected)
+	}
+	return res, nil
+}
+
+// Метод для скачивания файла. Мы же открываем чат с Долорес и кидаем ей некий файл. Она должна его скачать
+func downloadFile(client *http.Client, target, fileURL string, limit int64, expected string) (*downloaded, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), downloadTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download: %s", resp.Status)
+	}
+	// сервер может сказать размер заранее, тогда даже не начинаем
+	if resp.ContentLength > limit {
+		return nil, fmt.Errorf("%w: %d bytes", errFileTooBig, resp.ContentLength)
+	}
+	return saveWithLimit(target, resp.Body, limit, expected)
+}
+
+func copyLocalFile(target, source string, limit int64, expected string) (*downloaded, error) {
+	in, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	return saveWithLimit(target, in, limit, expected)
+}
+
+// diagSource is where to take the diagnostic from, only one of fileID, url and path is set
+type diagSource struct {
+	// file name to save as
+	name   string
+	fileID string
+	// declared by telegram, 0 if unknown
+	size   int64
+	url    string
+	path   string
+	sha256 string
+}
+
+// diagSourceFromMessage takes the document or the link or the path from the text
+func diagSourceFromMessage(message *tgbotapi.Message) (*diagSource, error) {
+	if message.Document != nil {
+		return &diagSource{name: message.Document.FileName, fileID: message.Document.FileID, size: int64(message.Document.FileSize)}, nil
+	}
+	fields := strings.Fields(message.Text)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, errBadDiagSource
+	}
+	res := new(diagSource)
+	if len(fields) == 2 {
+		m := sha256Template.FindStringSubmatch(fields[1])
+		if m == nil {
+			return nil, fmt.Errorf("%w: bad sha256 %q", errBadDiagSource, fields[1])
+		}
+		res.sha256 = strings.ToLower(m[1])
+	}
+	source := fields[0]
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		u, err := url.Parse(source)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errBadDiagSource, err)
+		}
+		if !allowedFileServer(u.Host) {
+			return nil, fmt.Errorf("%w: %s is not in sharedFileServers", errBadDiagSource, u.Host)
+		}
+		res.url = u.String()
+		res.name = path.Base(u.Path)
+		return res, nil
+	}
+	if !filepath.IsAbs(source) {
+		return nil, errBadDiagSource
+	}
+	resolved, err := sharedFilePath(source)
+	if err != nil {
+		return nil, err
+	}
+	res.path = resolved
+	res.name = filepath.Base(resolved)
+	return res, nil
+}
+
+// the text is the link or the path, not just a message to Dolores
+func looksLikeDiagSource(text string) bool {
+	fields := strings.Fields(text)
+	return len(fields) != 0 &&
+		(strings.HasPrefix(fields[0], "http://") || strings.HasPrefix(fields[0], "https://") || filepath.IsAbs(fields[0]))
+}
+
+func allowedFileServer(host string) bool {
+	for _, allowed := range sharedFileServers {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// the same client, but it follows the redirects only to sharedFileServers:
+// проверить одну ссылку мало, файловый сервер может отправить куда угодно
+func sharedFileClient(client *http.Client) *http.Client {
+	res := *client
+	res.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !allowedFileServer(req.URL.Host) {
+			return fmt.Errorf("%w: redirect to %s is not in sharedFileServers", errBadDiagSource, req.URL.Host)
+		}
+		// как у http.Client по умолчанию
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return &res
+}
+
+// the path must stay inside one of sharedFilesDirs even after the symlinks
+func sharedFilePath(source string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(source))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errBadDiagSource, err)
+	}
+	for _, dir := range sharedFilesDirs {
+		root, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s is not in sharedFilesDirs", errBadDiagSource, source)
+}
+
+// fetch the diagnostic to target
+func (s *diagSource) fetch(bot botSender, client *http.Client, target string) (*downloaded, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	switch {
+	case s.url != "":
+		return downloadFile(sharedFileClient(client), target, s.url, maxDownloadSize, s.sha256)
+	case s.path != "":
+		return copyLocalFile(target, s.path, maxDownloadSize, s.sha256)
+	}
+	// через api.telegram.org большой файл все равно не отдадут, не тратим время
+	if botAPIURL == "" && s.size > telegramDownloadLimit {
+		return nil, fmt.Errorf("%w: %d bytes", errFileTooBig, s.size)
+	}
+	file, err := bot.GetFile(tgbotapi.FileConfig{FileID: s.fileID})
+	if err != nil {
+		var apiErr tgbotapi.Error
+		if errors.As(err, &apiErr) && apiErr.Message == telegramFileTooBig {
+			return nil, fmt.Errorf("%w: %v", errFileTooBig, err)
+		}
+		return nil, fmt.Errorf("%w: %v", errNoDownloadLink, err)
+	}
+	// свой сервер Bot API в режиме --local не отдает файлы по http, а возвращает путь на своем диске.
+	// Долорес запускаем рядом с ним, с тем же путем к его данным
+	if filepath.IsAbs(file.FilePath) {
+		return copyLocalFile(target, file.FilePath, maxDownloadSize, "")
+	}
+	return downloadFile(client, target, file.Link(botToken), maxDownloadSize, "")
+}
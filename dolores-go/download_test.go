@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Автотесты на скачивание диагностики
+
+func Test_botAPITransport(t *testing.T) {
+	paths := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	client, err := newTelegramHTTPClient(server.URL + "/tg/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(fmt.Sprintf(tgbotapi.FileEndpoint, "token", "documents/file_1.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := <-paths; got != "/tg/file/bottoken/documents/file_1.zip" {
+		t.Errorf("rewritten path = %v", got)
+	}
+
+	for _, bad := range []string{"127.0.0.1:8081", "ftp://host", "http://"} {
+		if _, err := newTelegramHTTPClient(bad); err == nil {
+			t.Errorf("newTelegramHTTPClient(%q): no error", bad)
+		}
+	}
+}
+
+func Test_saveWithLimit(t *testing.T) {
+	wrongSum := strings.Repeat("0", 64)
+	target := filepath.Join(t.TempDir(), "diag.zip")
+	got, err := saveWithLimit(target, strings.NewReader("diag"), 4, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.size != 4 || len(got.sha256) != 64 {
+		t.Errorf("saveWithLimit() = %+v", got)
+	}
+	if _, err := saveWithLimit(target, strings.NewReader("diag"), 4, strings.ToUpper(got.sha256)); err != nil {
+		t.Errorf("saveWithLimit() with the right checksum: %v", err)
+	}
+	if _, err := saveWithLimit(target, strings.NewReader("diag"), 4, wrongSum); !errors.Is(err, errChecksumMismatch) {
+		t.Errorf("saveWithLimit() with the wrong checksum: %v", err)
+	}
+	if _, err := saveWithLimit(target, strings.NewReader("diag!"), 4, ""); !errors.Is(err, errFileTooBig) {
+		t.Errorf("saveWithLimit() over the limit: %v", err)
+	}
+}
+
+func Test_diagSourceFromMessage(t *testing.T) {
+	shared := t.TempDir()
+	outside := t.TempDir()
+	for _, dir := range []string{shared, outside} {
+		if err := os.WriteFile(filepath.Join(dir, "diag.zip"), []byte("diag"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(outside, "diag.zip"), filepath.Join(shared, "link.zip")); err != nil {
+		t.Fatal(err)
+	}
+	sharedFileServers = []string{"files.hflabs.ru"}
+	sharedFilesDirs = []string{shared}
+	defer func() {
+		sharedFileServers = []string{}
+		sharedFilesDirs = []string{}
+	}()
+	sum := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		name    string
+		text    string
+		want    diagSource
+		wantErr bool
+	}{
+		{name: "url", text: "https://files.hflabs.ru/tickets/diag.zip", want: diagSource{name: "diag.zip", url: "https://files.hflabs.ru/tickets/diag.zip"}},
+		{name: "url with checksum", text: "https://files.hflabs.ru/diag.zip sha256:" + strings.ToUpper(sum), want: diagSource{name: "diag.zip", url: "https://files.hflabs.ru/diag.zip", sha256: sum}},
+		{name: "unknown server", text: "https://example.com/diag.zip", wantErr: true},
+		{name: "bad checksum", text: "https://files.hflabs.ru/diag.zip md5:123", wantErr: true},
+		{name: "path", text: filepath.Join(shared, "diag.zip") + " " + sum, want: diagSource{name: "diag.zip", path: filepath.Join(shared, "diag.zip"), sha256: sum}},
+		{name: "path outside", text: filepath.Join(outside, "diag.zip"), wantErr: true},
+		{name: "path escapes", text: filepath.Join(shared, "..", filepath.Base(outside), "diag.zip"), wantErr: true},
+		{name: "symlink outside", text: filepath.Join(shared, "link.zip"), wantErr: true},
+		{name: "just text", text: "привет", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := diagSourceFromMessage(&tgbotapi.Message{Text: tt.text})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("diagSourceFromMessage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			// t.TempDir может лежать за симлинком
+			if tt.want.path != "" {
+				tt.want.path, _ = filepath.EvalSymlinks(tt.want.path)
+			}
+			if *got != tt.want {
+				t.Errorf("diagSourceFromMessage() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+// бот, у которого getFile отвечает ошибкой
+type getFileErrorBot struct {
+	testBotSender
+	err error
+}
+
+func (b *getFileErrorBot) GetFile(config tgbotapi.FileConfig) (tgbotapi.File, error) {
+	return tgbotapi.File{}, b.err
+}
+
+func Test_diagSource_fetch_getFileError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "too big", err: tgbotapi.Error{Message: "Bad Request: file is too big"}, want: errFileTooBig},
+		{name: "other API error", err: tgbotapi.Error{Message: "Bad Request: invalid file_id"}, want: errNoDownloadLink},
+		// текст похож, но это не ответ Bot API
+		{name: "transport error", err: errors.New("dial tcp: file is too big"), want: errNoDownloadLink},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &diagSource{name: "diag.zip", fileID: "file_1"}
+			_, err := source.fetch(&getFileErrorBot{err: tt.err}, nil, filepath.Join(t.TempDir(), "diag.zip"))
+			if !errors.Is(err, tt.want) {
+				t.Errorf("fetch() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func Test_downloadFile_timeout(t *testing.T) {
+	defer func(timeout time.Duration) { downloadTimeout = timeout }(downloadTimeout)
+	downloadTimeout = 50 * time.Millisecond
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// отдаем начало и зависаем
+		fmt.Fprint(w, "PK")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	_, err := downloadFile(&http.Client{}, filepath.Join(t.TempDir(), "diag.zip"), server.URL, maxDownloadSize, "")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("downloadFile() from the stalled server error = %v, want the deadline", err)
+	}
+}
+
+func Test_diagSource_fetch_redirect(t *testing.T) {
+	defer func() { sharedFileServers = []string{} }()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "PK")
+	}))
+	defer other.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved.zip" {
+			fmt.Fprint(w, "PK")
+			return
+		}
+		target := "/moved.zip"
+		if r.URL.Path == "/elsewhere.zip" {
+			target = other.URL + "/diag.zip"
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+	}))
+	defer server.Close()
+	sharedFileServers = []string{strings.TrimPrefix(server.URL, "http://")}
+
+	source := &diagSource{name: "diag.zip", url: server.URL + "/diag.zip"}
+	if _, err := source.fetch(nil, nil, filepath.Join(t.TempDir(), "diag.zip")); err != nil {
+		t.Errorf("fetch() with the redirect inside sharedFileServers error = %v", err)
+	}
+	source = &diagSource{name: "diag.zip", url: server.URL + "/elsewhere.zip"}
+	if _, err := source.fetch(nil, nil, filepath.Join(t.TempDir(), "diag.zip")); !errors.Is(err, errBadDiagSource) {
+		t.Errorf("fetch() with the redirect outside sharedFileServers error = %v, want errBadDiagSource", err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	yekazip "github.com/yeka/zip"
+)
+
+// Зашифрованные zip. Заказчики иногда присылают диагностику под паролем (ZipCrypto или AES),
+// archive/zip такие не открывает. Спрашиваем пароль в чате, сообщение с паролем сразу удаляем,
+// а архив расшифровываем в обычный zip в папке сессии — дальше он разбирается как все
+
+const maxPasswordAttempts = 3
+
+var (
+	errEncryptedArchive = errors.New("archive is encrypted")
+	errWrongPassword    = errors.New("wrong password")
+)
+
+// the zip has at least one encrypted file
+func isEncryptedZip(path string) (bool, error) {
+	format, err := detectArchiveFile(path)
+	if err != nil || format != formatZip {
+		return false, err
+	}
+	z, err := zip.OpenReader(path)
+	if err != nil {
+		return false, err
+	}
+	defer z.Close()
+	for _, f := range z.File {
+		if f.Flags&0x1 != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// decryptZip writes the decrypted copy of the zip to dst.
+// The limits against zip bombs are the same as for the plain archives
+func decryptZip(src, dst, password string) error {
+	r, err := yekazip.OpenReader(src)
+	if err != nil {
+		return fmt.Errorf("could not open zip file: %w", err)
+	}
+	defer r.Close()
+	if len(r.File) > maxArchiveEntries {
+		return fmt.Errorf("%w: %d files, limit is %d", errArchiveTooBig, len(r.File), maxArchiveEntries)
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := zip.NewWriter(out)
+	var left int64 = maxUncompressedSize
+	for _, f := range r.File {
+		header := &zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: f.ModTime()}
+		header.SetMode(f.Mode())
+		if strings.HasSuffix(f.Name, "/") {
+			header.Method = zip.Store
+			if _, err := w.CreateHeader(header); err != nil {
+				return err
+			}
+			continue
+		}
+		if f.IsEncrypted() {
+			f.SetPassword(password)
+		}
+		n, err := copyZipEntry(w, header, f, left)
+		if err != nil {
+			// у ZipCrypto проверочный байт совпадает и с неверным паролем, тогда ломается распаковка или CRC
+			if f.IsEncrypted() && !errors.Is(err, errArchiveTooBig) {
+				return fmt.Errorf("%w: %s: %v", errWrongPassword, f.Name, err)
+			}
+			return err
+		}
+		left -= n
+	}
+	return w.Close()
+}
+
+func copyZipEntry(w *zip.Writer, header *zip.FileHeader, f *yekazip.File, left int64) (int64, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	dst, err := w.CreateHeader(header)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(dst, io.LimitReader(rc, left+1))
+	if err != nil {
+		return n, err
+	}
+	if n > left {
+		return n, fmt.Errorf("%w: more than %d bytes", errArchiveTooBig, int64(maxUncompressedSize))
+	}
+	return n, nil
+}
+
+func (as *activeSession) setPasswordPrompt(prompt chan string) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.passwordPrompt = prompt
+}
+
+// ask the password and wait for it, false on timeout
+func (as *activeSession) askPassword(chatID int64, text string) (string, bool) {
+	prompt := make(chan string, 1)
+	as.setPasswordPrompt(prompt)
+	defer as.setPasswordPrompt(nil)
+	_, err := as.bot.Send(newMessage(chatID, text))
+	if err != nil {
+		log.Println("ERROR: ", err)
+	}
+	select {
+	case password := <-prompt:
+		return password, true
+	case <-time.After(as.choiceTimeout):
+		return "", false
+	}
+}
+
+// handlePassword takes the message of the owner as the password if Dolores is waiting for it
+// and deletes the message from the chat
+func (as *activeSession) handlePassword(update tgbotapi.Update) bool {
+	chatID := update.Message.Chat.ID
+	as.mu.Lock()
+	prompt := as.passwordPrompt
+	owner := as.user != nil && as.user.id == chatID
+	as.mu.Unlock()
+	if prompt == nil || !owner || update.Message.Text == "" {
+		return false
+	}
+	_, err := as.bot.DeleteMessage(tgbotapi.NewDeleteMessage(chatID, update.Message.MessageID))
+	if err != nil {
+		log.Println("ERROR: could not delete the password: ", err)
+		_, err := as.bot.Send(newMessage(chatID, doloresMessages.passwordNotDeleted))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+	}
+	select {
+	case prompt <- update.Message.Text:
+	default:
+	}
+	return true
+}
+
+// decryptArchives replaces the encrypted zips with the decrypted copies, asking the password for each.
+// In case of error the user is told and the session is deactivated
+func (as *activeSession) decryptArchives(update tgbotapi.Update, archives []string) ([]string, error) {
+	chatID := update.Message.Chat.ID
+	send := func(text string) {
+		_, err := as.bot.Send(newMessage(chatID, text))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+	}
+	res := append([]string{}, archives...)
+	for i, path := range archives {
+		encrypted, err := isEncryptedZip(path)
+		if err != nil {
+			log.Println(err)
+		}
+		if !encrypted {
+			continue
+		}
+		name := strings.TrimPrefix(path, as.workDir+string(os.PathSeparator))
+		decrypted := strings.TrimSuffix(path, ".zip") + "-decrypted.zip"
+		text := fmt.Sprintf(doloresMessages.askPassword, name, int(as.choiceTimeout.Minutes()))
+		for attempt := 1; ; attempt++ {
+			password, ok := as.askPassword(chatID, text)
+			if !ok {
+				send(doloresMessages.passwordTimeout)
+				as.deactivate()
+				return nil, fmt.Errorf("no password for %s", name)
+			}
+			err = decryptZip(path, decrypted, password)
+			if err == nil {
+				break
+			}
+			log.Printf("could not decrypt %s: %v\n", name, err)
+			switch {
+			case errors.Is(err, errWrongPassword) && attempt < maxPasswordAttempts:
+				text = fmt.Sprintf(doloresMessages.wrongPassword, maxPasswordAttempts-attempt)
+				continue
+			case errors.Is(err, errWrongPassword):
+				send(doloresMessages.passwordAttemptsOver)
+			case errors.Is(err, errArchiveTooBig):
+				send(doloresMessages.archiveTooBig)
+			default:
+				send(doloresMessages.cannotOpenArchive)
+			}
+			as.deactivate()
+			return nil, err
+		}
+		os.Remove(path)
+		res[i] = decrypted
+		send(fmt.Sprintf(doloresMessages.decrypted, name))
+	}
+	return res, nil
+}
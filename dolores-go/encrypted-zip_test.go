@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	yekazip "github.com/yeka/zip"
+)
+
+// Автотесты на зашифрованные архивы
+
+// перепаковываем архив с диагностикой под пароль
+func encryptZip(t *testing.T, src, dst, password string, method yekazip.EncryptionMethod) {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	w := yekazip.NewWriter(out)
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		in, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := w.Encrypt(f.Name, password, method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(entry, in); err != nil {
+			t.Fatal(err)
+		}
+		in.Close()
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_decryptZip(t *testing.T) {
+	methods := map[string]yekazip.EncryptionMethod{
+		"ZipCrypto": yekazip.StandardEncryption,
+		"AES-256":   yekazip.AES256Encryption,
+	}
+	for name, method := range methods {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			encrypted := filepath.Join(dir, "diag.zip")
+			encryptZip(t, "test_data/diag_good.zip", encrypted, "secret", method)
+
+			if ok, err := isEncryptedZip(encrypted); !ok || err != nil {
+				t.Errorf("isEncryptedZip() = %v, %v", ok, err)
+			}
+			if _, err := openArchive(encrypted); !errors.Is(err, errEncryptedArchive) {
+				t.Errorf("openArchive() error = %v, want errEncryptedArchive", err)
+			}
+
+			decrypted := filepath.Join(dir, "diag-decrypted.zip")
+			if err := decryptZip(encrypted, decrypted, "wrong"); !errors.Is(err, errWrongPassword) {
+				t.Errorf("decryptZip() with the wrong password: %v", err)
+			}
+			if err := decryptZip(encrypted, decrypted, "secret"); err != nil {
+				t.Fatalf("decryptZip() = %v", err)
+			}
+			if ok, _ := isEncryptedZip(decrypted); ok {
+				t.Errorf("isEncryptedZip() of the decrypted copy = true")
+			}
+			diag, err := parseZipFile(decrypted, t.TempDir())
+			if err != nil {
+				t.Fatalf("parseZipFile() of the decrypted copy = %v", err)
+			}
+			if diag.versions.CustomerName != "demo" {
+				t.Errorf("parseZipFile() customer = %v", diag.versions.CustomerName)
+			}
+		})
+	}
+	if ok, err := isEncryptedZip("test_data/diag_good.zip"); ok || err != nil {
+		t.Errorf("isEncryptedZip() of the plain zip = %v, %v", ok, err)
+	}
+}
+
+func Test_activeSession_decryptArchives(t *testing.T) {
+	dir := t.TempDir()
+	encrypted := filepath.Join(dir, "diag.zip")
+	encryptZip(t, "test_data/diag_good.zip", encrypted, "secret", yekazip.AES256Encryption)
+	update := tgbotapi.Update{Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1}}}
+
+	as := newASFromFields(fields{user: newTelegramUser("1", 1), status: ACTIVE, q: newSessionsQueue()})
+	as.workDir = dir
+	as.choiceTimeout = time.Second
+	go func() {
+		var asked chan string
+		for _, password := range []string{"wrong", "secret"} {
+			// ждем, пока Долорес спросит пароль, каждый раз заново
+			for i := 0; i < 1000; i++ {
+				as.mu.Lock()
+				prompt := as.passwordPrompt
+				as.mu.Unlock()
+				if prompt != nil && prompt != asked {
+					asked = prompt
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			as.handlePassword(tgbotapi.Update{Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1}, Text: password}})
+		}
+	}()
+	got, err := as.decryptArchives(update, []string{"test_data/diag_good.7z", encrypted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"test_data/diag_good.7z", filepath.Join(dir, "diag-decrypted.zip")}
+	if got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("decryptArchives() = %v, want %v", got, want)
+	}
+	if _, err := os.Stat(encrypted); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("decryptArchives() kept the encrypted archive")
+	}
+}
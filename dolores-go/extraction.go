@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Что из диагностики положить на стенд. Правила задаются в профиле (см. initVars),
+// файлы распаковываются в директорию сессии, которая монтируется в /opt/diag
+
+// extractionRule maps the files of the diagnostic to the mounted volume
+type extractionRule struct {
+	// glob по пути относительно корня диагностики (см. path.Match): sql.*.xls, conf/*.xml.
+	// Верхние папки архива отрезаются, как и при поиске файлов с версиями
+	pattern string
+	// куда положить относительно /opt/diag. Если заканчивается на / — это папка, и файлы сохраняют свои имена
+	target string
+	// без этого файла разворачивать нельзя
+	required bool
+	// под этим именем пути к файлам доступны в параметрах задач: {{.File.param}} и {{.Files.param}}
+	param string
+	// зачем нужен файл, пишем в отчет
+	purpose string
+}
+
+func (r extractionRule) toDir() bool {
+	return strings.HasSuffix(r.target, "/")
+}
+
+// match the path and all its suffixes after the stripped folders
+func (r extractionRule) match(name string) bool {
+	for {
+		if ok, _ := path.Match(r.pattern, name); ok {
+			return true
+		}
+		i := strings.Index(name, "/")
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+// extractedFile is the file put to the stand by the rule
+type extractedFile struct {
+	rule *extractionRule
+	// path in the archive, normalized
+	source string
+	// path relative to the mounted dir
+	target string
+	size   int64
+}
+
+// path inside the container
+func (f *extractedFile) mountedPath() string {
+	return path.Join(diagMountPoint, f.target)
+}
+
+// extraction is the plan what to extract and what is missing
+type extraction struct {
+	files   []*extractedFile
+	entries map[*extractedFile]*archiveEntry
+	// rules without any file
+	unmatched []*extractionRule
+	// skipped files because of the same target
+	warnings []string
+}
+
+// planExtraction matches the entries of the archive with the rules.
+// The file goes to the first matched rule only
+func planExtraction(entries []*archiveEntry, rules []extractionRule) *extraction {
+	res := &extraction{entries: map[*extractedFile]*archiveEntry{}}
+	names := make([]string, 0, len(entries))
+	byName := make(map[string]*archiveEntry, len(entries))
+	for _, e := range entries {
+		name, ok := normalizeEntryName(e.Name)
+		if !ok {
+			continue
+		}
+		names = append(names, name)
+		byName[name] = e
+	}
+	sort.Strings(names)
+
+	taken := map[string]bool{}
+	targets := map[string]string{}
+	for i := range rules {
+		rule := &rules[i]
+		matched := 0
+		for _, name := range names {
+			if taken[name] || !rule.match(name) {
+				continue
+			}
+			matched++
+			target := path.Clean(rule.target)
+			if rule.toDir() {
+				target = path.Join(rule.target, path.Base(name))
+			}
+			if previous, ok := targets[target]; ok {
+				res.warnings = append(res.warnings, fmt.Sprintf("%s и %s ложатся в %s, беру первый", previous, name, target))
+				continue
+			}
+			taken[name] = true
+			targets[target] = name
+			f := &extractedFile{rule: rule, source: name, target: target, size: byName[name].Size}
+			res.files = append(res.files, f)
+			res.entries[f] = byName[name]
+		}
+		if matched == 0 {
+			res.unmatched = append(res.unmatched, rule)
+		}
+	}
+	return res
+}
+
+// required rules without any file
+func (ex *extraction) missing() []*extractionRule {
+	res := make([]*extractionRule, 0)
+	for _, rule := range ex.unmatched {
+		if rule.required {
+			res = append(res, rule)
+		}
+	}
+	return res
+}
+
+// extract all planned files to the dir
+func (ex *extraction) extract(dir string) error {
+	for _, f := range ex.files {
+		if err := extractFile(ex.entries[f], dir, f.target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractedFiles are the paths inside the container by the param name of the rule
+type extractedFiles map[string][]string
+
+func (ex *extraction) paths() extractedFiles {
+	res := extractedFiles{}
+	for _, f := range ex.files {
+		if f.rule.param == "" {
+			continue
+		}
+		res[f.rule.param] = append(res[f.rule.param], f.mountedPath())
+	}
+	return res
+}
+
+// taskParamsData is what can be used in the templates of the task params and conditions
+type taskParamsData struct {
+	// first file by the param name of the rule
+	File map[string]string
+	// all files by the param name of the rule
+	Files extractedFiles
+	// the file of the current run for the tasks with forEach
+	Current string
+	// the repository of the customer and the versions of the deployed stand
+	Customer string
+	Versions applicationVersions
+	// schemaName at the moment of the run, not at the start of Dolores
+	Schema string
+	// the telegram user who deployed the stand
+	User string
+}
+
+func newTaskParamsData(files extractedFiles, versions *applicationVersions, user string) taskParamsData {
+	data := taskParamsData{File: map[string]string{}, Files: files, Schema: schemaName, User: user}
+	for param, paths := range files {
+		if len(paths) != 0 {
+			data.File[param] = paths[0]
+		}
+	}
+	if versions != nil {
+		data.Customer = versions.CustomerName
+		data.Versions = *versions
+	}
+	return data
+}
+
+var taskParamsFuncs = template.FuncMap{"join": strings.Join}
+
+// renderTaskTemplate fills the text/template with the session data
+func renderTaskTemplate(name, text string, data taskParamsData) (string, error) {
+	tmpl, err := template.New(name).Funcs(taskParamsFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("bad template of %s: %w", name, err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("could not fill %s: %w", name, err)
+	}
+	return b.String(), nil
+}
+
+// renderTaskParams fills the string params of the task as text/template:
+// {{.File.partyDataSet}}, {{join .Files.configs ","}}, {{.Current}}, {{.Schema}} or {{.Versions.FactorTagVersion}}
+func renderTaskParams(params []*TaskParam, data taskParamsData) ([]*TaskParam, error) {
+	if params == nil {
+		return nil, nil
+	}
+	res := make([]*TaskParam, 0, len(params))
+	for _, p := range params {
+		value, ok := p.ParamValue.(string)
+		if !ok || !strings.Contains(value, "{{") {
+			res = append(res, p)
+			continue
+		}
+		value, err := renderTaskTemplate(p.ParamName, value, data)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, &TaskParam{ParamName: p.ParamName, ParamValue: value})
+	}
+	return res, nil
+}
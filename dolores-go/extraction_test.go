@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Проверяем, какие файлы по правилам попадут на стенд
+
+func Test_planExtraction(t *testing.T) {
+	rules := []extractionRule{
+		{pattern: "sql.party.xls", target: "sql.party.xls", required: true, param: "party"},
+		{pattern: "sql.*.xls", target: "datasets/", param: "dataSets"},
+		{pattern: "*.conf/*.xml", target: "conf/", param: "configs"},
+		{pattern: "dictionaries/*", target: "dictionaries/", required: true, param: "dictionaries"},
+	}
+	entries := []*archiveEntry{
+		newTestEntry(`diag_192\sql.party.xls`, "party"),
+		newTestEntry("diag_192/sql.address.xls", "address"),
+		newTestEntry("diag_192/cdi.conf/cdi.xml", "cdi"),
+		newTestEntry("diag_192/factor.conf/cdi.xml", "factor"),
+		newTestEntry("diag_192/cdi.logs/cdi.log", "log"),
+		newTestEntry("__MACOSX/diag_192/._sql.party.xls", ""),
+	}
+	ex := planExtraction(entries, rules)
+
+	got := map[string]string{}
+	for _, f := range ex.files {
+		got[f.source] = f.target
+	}
+	want := map[string]string{
+		"diag_192/sql.party.xls":    "sql.party.xls",
+		"diag_192/sql.address.xls":  "datasets/sql.address.xls",
+		"diag_192/cdi.conf/cdi.xml": "conf/cdi.xml",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("planExtraction() files = %v, want %v", got, want)
+	}
+	if len(ex.warnings) != 1 {
+		t.Errorf("planExtraction() warnings = %v, want one about conf/cdi.xml", ex.warnings)
+	}
+	missing := ex.missing()
+	if len(missing) != 1 || missing[0].param != "dictionaries" {
+		t.Errorf("planExtraction() missing = %v, want dictionaries", missing)
+	}
+	wantPaths := extractedFiles{
+		"party":    {"/opt/diag/sql.party.xls"},
+		"dataSets": {"/opt/diag/datasets/sql.address.xls"},
+		"configs":  {"/opt/diag/conf/cdi.xml"},
+	}
+	if gotPaths := ex.paths(); !reflect.DeepEqual(gotPaths, wantPaths) {
+		t.Errorf("paths() = %v, want %v", gotPaths, wantPaths)
+	}
+
+	dir := t.TempDir()
+	if err := ex.extract(dir); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "datasets", "sql.address.xls"))
+	if err != nil || string(content) != "address" {
+		t.Errorf("extract() datasets/sql.address.xls = %q, %v", content, err)
+	}
+}
+
+func Test_renderTaskParams(t *testing.T) {
+	files := extractedFiles{
+		"party":    {"/opt/diag/sql.party.xls"},
+		"dataSets": {"/opt/diag/datasets/sql.a.xls", "/opt/diag/datasets/sql.b.xls"},
+	}
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "plain string", value: "cdi_temp_user_1", want: "cdi_temp_user_1"},
+		{name: "not a string", value: 42, want: 42},
+		{name: "first file", value: "{{.File.party}}", want: "/opt/diag/sql.party.xls"},
+		{name: "all files", value: `{{join .Files.dataSets ","}}`, want: "/opt/diag/datasets/sql.a.xls,/opt/diag/datasets/sql.b.xls"},
+		{name: "current file", value: "{{.Current}}", want: "/opt/diag/sql.party.xls"},
+		{name: "schema", value: "{{.Schema}}", want: "cdi_temp_user_2"},
+		{name: "versions", value: "{{.Customer}}-{{.Versions.FactorTagVersion}}", want: "demo-21.19"},
+		{name: "user", value: "{{.User}}", want: "tester"},
+		{name: "unknown param", value: "{{.File.configs}}", wantErr: true},
+		{name: "bad template", value: "{{.File.party", wantErr: true},
+	}
+	defer func(schema string) { schemaName = schema }(schemaName)
+	schemaName = "cdi_temp_user_2"
+	data := newTaskParamsData(files, &applicationVersions{CustomerName: "demo", FactorTagVersion: "21.19"}, "tester")
+	data.Current = "/opt/diag/sql.party.xls"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderTaskParams([]*TaskParam{{ParamName: "p", ParamValue: tt.value}}, data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("renderTaskParams() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && !reflect.DeepEqual(got[0].ParamValue, tt.want) {
+				t.Errorf("renderTaskParams() = %v, want %v", got[0].ParamValue, tt.want)
+			}
+		})
+	}
+}
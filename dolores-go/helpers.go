@@ -1,10 +1,15 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 )
@@ -16,37 +21,148 @@ func newMessage(chatID int64, message string) tgbotapi.MessageConfig {
 
 // Стандартный метод для написания телеграм-ботом сообщения, в котором есть некая кнопка. Дальше мы на каждой кнопке укажем её текст (text) и действие, которое надо выполнить при нажатии (action)
 func newMessageWithButton(chatID int64, message, text, action string) tgbotapi.MessageConfig {
+	return newMessageWithButtons(chatID, message, []inlineButton{{text: text, action: action}})
+}
+
+// Телеграм не берет сообщения длиннее 4096 символов (считает в UTF-16)
+const maxMessageLength = 4096
+
+// Длинный текст режем на сообщения по строкам, слишком длинную строку — посередине
+func splitMessage(text string) []string {
+	res := make([]string, 0, 1)
+	var current strings.Builder
+	size := 0
+	flush := func() {
+		if current.Len() != 0 {
+			res = append(res, current.String())
+			current.Reset()
+			size = 0
+		}
+	}
+	for i, line := range strings.Split(text, "\n") {
+		if i != 0 {
+			line = "\n" + line
+		}
+		if lineSize := utf16Length(line); size+lineSize > maxMessageLength {
+			flush()
+			line = strings.TrimPrefix(line, "\n")
+		}
+		for _, r := range line {
+			rSize := utf16Length(string(r))
+			if size+rSize > maxMessageLength {
+				flush()
+			}
+			current.WriteRune(r)
+			size += rSize
+		}
+	}
+	flush()
+	if len(res) == 0 {
+		res = append(res, "")
+	}
+	return res
+}
+
+func utf16Length(s string) int {
+	res := 0
+	for _, r := range s {
+		res++
+		// за пределами BMP символ занимает два
+		if r > 0xFFFF {
+			res++
+		}
+	}
+	return res
+}
+
+// Кнопка для сообщения: текст и действие, которое придет в CallbackQuery.Data (не длиннее 64 байт)
+type inlineButton struct {
+	text   string
+	action string
+}
+
+// То же, но кнопок несколько, каждая на своей строке
+func newMessageWithButtons(chatID int64, message string, buttons []inlineButton) tgbotapi.MessageConfig {
 	msg := tgbotapi.NewMessage(chatID, message)
-	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData(
-				text,
-				action,
-			),
-		),
-	)
+	rows := make([][]tgbotapi.InlineKeyboardButton, 0, len(buttons))
+	for _, b := range buttons {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(b.text, b.action)))
+	}
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
 	return msg
 }
 
-// Метод для скачивания файла. Мы же открываем чат с Долорес и кидаем ей некий файл. Она должна его скачать
-func downloadFile(filepath string, url string) error {
-	// Get the data
-	resp, err := http.Get(url) //nolint:gosec
-	if err != nil {
-		return err
+// Имя файла от пользователя (или из архива) нельзя использовать как есть:
+// оставляем только само имя без папок и безопасные символы
+func sanitizeFileName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = unsafeFileNameChars.ReplaceAllString(name, "_")
+	name = strings.TrimLeft(name, ".")
+	if len(name) > 100 {
+		name = name[len(name)-100:]
+	}
+	if name == "" {
+		return "diag"
 	}
-	defer resp.Body.Close()
+	return name
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[^\w.\-]+`)
+
+// Склеиваем путь внутри dir и не даем выйти за её пределы через ../
+func safeJoin(dir, name string) (string, error) {
+	res := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
+	rel, err := filepath.Rel(dir, res)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("path %s escapes %s", name, dir)
+	}
+	return res, nil
+}
 
-	// Create the file
-	out, err := os.Create(filepath)
+// Пишем во временный файл рядом и переименовываем, чтобы не остаться с половиной файла
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
 	if err != nil {
 		return err
 	}
-	defer out.Close()
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
 
-	// Write the body to file
-	_, err = io.Copy(out, resp.Body)
-	return err
+// Копируем содержимое директории src в dst (нужно для снапшотов примонтированных данных)
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0o755)
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		_, err = io.Copy(out, in)
+		return err
+	})
 }
 
 // Тут показываем скруктуру переменной taskToRun. Это будет массив задач, в котором мы передаем имя задачи, её параметры и сообщение бота
@@ -54,6 +170,37 @@ type taskToRun struct {
 	taskName   string
 	taskParams []*TaskParam
 	message    string
+	// если задано — задача запускается для каждого файла с этим param из extractionRules,
+	// путь к текущему файлу в параметрах — {{.Current}}
+	forEach string
+	// сколько ждем задачу, 0 — defaultTaskTimeout
+	timeout time.Duration
+	// условия запуска, см. task-chain.go. Пустые — запускаем всегда.
+	// customers — только для этих заказчиков (репозиторий, как в CustomerName)
+	customers []string
+	// ifFiles — только если в диагностике есть файлы с этим param из extractionRules
+	ifFiles string
+	// when — шаблон как у параметров, запускаем, если получилось true
+	when string
+	// задача не отработала — пишем в отчет и идем дальше, а не останавливаем цепочку
+	continueOnError bool
+	// соседние задачи с одинаковой group запускаются параллельно, следующие ждут всю группу
+	group string
+}
+
+func (t taskToRun) deadline() time.Duration {
+	if t.timeout <= 0 {
+		return defaultTaskTimeout
+	}
+	return t.timeout
+}
+
+// с какими файлами запускать задачу, "" — один запуск без файла
+func (t taskToRun) invocations(files extractedFiles) []string {
+	if t.forEach == "" {
+		return []string{""}
+	}
+	return files[t.forEach]
 }
 
 // Создаем переменные и логируем их, полезно при отладке
@@ -2,6 +2,7 @@ package main
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -29,3 +30,85 @@ func Test_convertMapToDockerArgs(t *testing.T) {
 		})
 	}
 }
+
+func Test_sanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "plain", in: "diag_192.zip", want: "diag_192.zip"},
+		{name: "unix path", in: "../../etc/passwd", want: "passwd"},
+		{name: "windows path", in: "..\\..\\diag.zip", want: "diag.zip"},
+		{name: "hidden", in: ".bashrc", want: "bashrc"},
+		{name: "spaces and cyrillic", in: "диаг за май.zip", want: "_.zip"},
+		{name: "only dots", in: "..", want: "diag"},
+		{name: "empty", in: "", want: "diag"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeFileName(tt.in); got != tt.want {
+				t.Errorf("sanitizeFileName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_safeJoin(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{name: "file", in: "sql.party.xls", want: "diag/sql.party.xls"},
+		{name: "subdir", in: "cdi.logs/cdi.log", want: "diag/cdi.logs/cdi.log"},
+		{name: "escape is cut to the dir", in: "../../etc/passwd", want: "diag/etc/passwd"},
+		{name: "dir itself", in: "..", wantErr: true},
+		{name: "empty", in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := safeJoin("diag", tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("safeJoin() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("safeJoin() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_splitMessage(t *testing.T) {
+	line := strings.Repeat("я", 100)
+	long := strings.Repeat(line+"\n", 100)
+	huge := strings.Repeat("😀", maxMessageLength)
+	tests := []struct {
+		name string
+		in   string
+		want int
+	}{
+		{name: "short", in: "привет\nмир", want: 1},
+		{name: "empty", in: "", want: 1},
+		{name: "by lines", in: long, want: 3},
+		{name: "one huge line, emoji count twice", in: huge, want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitMessage(tt.in)
+			if len(got) != tt.want {
+				t.Errorf("splitMessage() = %d messages, want %d", len(got), tt.want)
+			}
+			for _, m := range got {
+				if utf16Length(m) > maxMessageLength {
+					t.Errorf("splitMessage() message of %d", utf16Length(m))
+				}
+			}
+			if strings.ReplaceAll(strings.Join(got, "\n"), "\n", "") != strings.ReplaceAll(tt.in, "\n", "") {
+				t.Errorf("splitMessage() lost the text")
+			}
+		})
+	}
+}
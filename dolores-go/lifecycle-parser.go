@@ -6,7 +6,11 @@ import (
 	"io"
 	"log"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 )
 
 // Код для обработки lifecycle-лога. Мы достанем оттуда:
@@ -14,57 +18,218 @@ import (
 // - версию, на которой воспроизвели проблему (последняя запись в логе будет актуальным на момент сбора диагностики состоянием системы)
 // - версию Фактора (смежная система, сборку которой скачаем из Team City)
 
-var (
-	// У нас 2 шаблона записи строки в этот лог, парсим оба
-	lifecycleStartLineTemplate  = regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2},\d{3} INFO  start - CDI application \[([\w ]+) ([0-9\.]+)-SNAPSHOT (?:.*?)\(([0-9a-z]+), core ([0-9a-z]+)\)\] \[(?:.*?)\] started in \d+ s\.$`)
-	lifecycleStartLineTemplate2 = regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2},\d{3} INFO  LifecycleEventListener - CDI application \[([\w ]+) ([0-9\.]+)-SNAPSHOT (?:.*?)\(([0-9a-z]+), core ([0-9a-z]+)\)\] \[[0-9\.]+\] started in \d+ s\.`)
-)
+const lifecycleTimeFormat = "2006-01-02 15:04:05,000"
+
+// Форматы строки о старте приложения задаются в initVars (lifecycleLineFormats), main компилирует их в lifecyclePatterns
+var lifecyclePatterns []*lifecyclePattern
+
+// lifecycleLineFormat is the configured format of the start line
+type lifecycleLineFormat struct {
+	name    string
+	pattern string
+}
+
+// lifecyclePattern is the compiled format
+type lifecyclePattern struct {
+	name string
+	re   *regexp.Regexp
+}
+
+var lifecycleRequiredGroups = []string{"timestamp", "customer", "version", "customerRevision", "coreRevision"}
+
+func compileLifecycleFormats(formats []lifecycleLineFormat) ([]*lifecyclePattern, error) {
+	res := make([]*lifecyclePattern, 0, len(formats))
+	for _, f := range formats {
+		re, err := regexp.Compile(f.pattern)
+		if err != nil {
+			return nil, fmt.Errorf("lifecycle format %s: %w", f.name, err)
+		}
+		for _, group := range lifecycleRequiredGroups {
+			if re.SubexpIndex(group) < 0 {
+				return nil, fmt.Errorf("lifecycle format %s: no group %s", f.name, group)
+			}
+		}
+		res = append(res, &lifecyclePattern{name: f.name, re: re})
+	}
+	return res, nil
+}
 
-// Устанавливаем алиасы на то, что прочитали в логе. Может быть такая ситуация: в логе пишется длинное имя, а в системе контроля версий репозиторий называется по-другому, кратко
-var clientsAliases = map[string]string{
-	"demo":      "demo",
-	"cdi test":  "test",
-	"bank":      "bank",
-	"long name": "name",
+// the groups of the line if it matches the pattern
+func (p *lifecyclePattern) match(line string) (map[string]string, bool) {
+	m := p.re.FindStringSubmatch(line)
+	if m == nil {
+		return nil, false
+	}
+	res := make(map[string]string, len(lifecycleRequiredGroups))
+	for _, group := range lifecycleRequiredGroups {
+		res[group] = m[p.re.SubexpIndex(group)]
+	}
+	return res, true
+}
+
+// the start of the application from the line, the first matched pattern wins
+func matchLifecycleLine(line string) (*lifecycleStart, error) {
+	for _, p := range lifecyclePatterns {
+		groups, ok := p.match(line)
+		if !ok {
+			continue
+		}
+		return newLifecycleStart(groups)
+	}
+	return nil, nil
+}
+
+func newLifecycleStart(groups map[string]string) (*lifecycleStart, error) {
+	startedAt, err := time.Parse(lifecycleTimeFormat, groups["timestamp"])
+	if err != nil {
+		return nil, err
+	}
+	customerName, _ := clientsAliases.resolve(groups["customer"])
+	return &lifecycleStart{
+		Versions: applicationVersions{
+			CoreRevision:     groups["coreRevision"],
+			CustomerRevision: groups["customerRevision"],
+			FactorTagVersion: groups["version"],
+			CustomerTitle:    groups["customer"],
+			CustomerName:     customerName,
+		},
+		First: startedAt,
+		Last:  startedAt,
+	}, nil
 }
 
 // Структура переменной applicationVersions: что мы достаем из лога и сохраняем в версию
+// (и из cdi.versions и factor.versions, см. versions-parser.go)
 type applicationVersions struct {
 	CoreRevision     string
 	CustomerRevision string
 	CustomerName     string
+	// имя заказчика, как оно записано в логе, до подстановки алиаса
+	CustomerTitle    string
 	FactorTagVersion string
+	FactorVersion    string
+	FactorRevision   string
+	FactorBuildTime  string
+	// откуда взяли каждое поле: имя поля -> файл диагностики
+	Sources map[string]string
 }
 
-func parseapplicationVersions(in io.Reader) (*applicationVersions, error) {
+// lifecycleStart is the version of the application started at least once
+type lifecycleStart struct {
+	Versions applicationVersions
+	// first and last start of this version
+	First, Last time.Time
+	// how many times the version was started
+	Count int
+}
+
+func (s *lifecycleStart) key() string {
+	v := s.Versions
+	return strings.Join([]string{v.CustomerTitle, v.FactorTagVersion, v.CustomerRevision, v.CoreRevision}, "|")
+}
+
+// parseLifecycleHistory returns all versions started according to the lifecycle log without duplicates,
+// ordered by the last start: the current version is the last one
+func parseLifecycleHistory(in io.Reader) ([]*lifecycleStart, error) {
 	scanner := bufio.NewScanner(in)
-	res := new(applicationVersions)
-	found := false
+	byKey := map[string]*lifecycleStart{}
+	res := make([]*lifecycleStart, 0)
 	for scanner.Scan() {
-		// Ищем соответствие с нашим шаблоном
-		if !lifecycleStartLineTemplate.MatchString(scanner.Text()) && !lifecycleStartLineTemplate2.MatchString(scanner.Text()) {
-			continue
+		// Ищем соответствие с одним из форматов
+		start, err := matchLifecycleLine(scanner.Text())
+		if err != nil {
+			return nil, err
 		}
-		matches := lifecycleStartLineTemplate.FindAllStringSubmatch(scanner.Text(), -1)
-		matches2 := lifecycleStartLineTemplate2.FindAllStringSubmatch(scanner.Text(), -1)
-		// Делаем выбор нужной строки
-		if len(matches) < len(matches2) {
-			matches = matches2
-		}
-		if len(matches[0]) != 5 {
+		if start == nil {
 			continue
 		}
-		found = true
-		// Из полученного паттерна достаем информацию по ревизии кода, версии Фактора и имени заказчика
-		res.CoreRevision = matches[0][4]
-		res.CustomerRevision = matches[0][3]
-		res.FactorTagVersion = matches[0][2]
-		res.CustomerName = clientsAliases[strings.ToLower(matches[0][1])]
+		startedAt := start.Last
+		if existing, ok := byKey[start.key()]; ok {
+			start = existing
+		} else {
+			byKey[start.key()] = start
+			res = append(res, start)
+		}
+		start.Last = startedAt
+		start.Count++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
-	if !found {
+	if len(res) == 0 {
 		return nil, fmt.Errorf("application version not found in lifecycle log")
 	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Last.Before(res[j].Last)
+	})
+	return res, nil
+}
+
+// the version started last
+func parseapplicationVersions(in io.Reader) (*applicationVersions, error) {
+	history, err := parseLifecycleHistory(in)
+	if err != nil {
+		return nil, err
+	}
+	res := history[len(history)-1].Versions
 	log.Printf("PARSED VERSIONS: %+v\n", res)
 
-	return res, nil
+	return &res, nil
+}
+
+var lifecycleLineMessages = struct {
+	usage    string
+	matched  string
+	groups   string
+	alias    string
+	noAlias  string
+	badTime  string
+	mismatch string
+}{
+	usage:    "Пришли строку из cdi-lifecycle.log после команды: /lifecycle <строка>",
+	matched:  "✓ %s",
+	groups:   "  customer=%s, version=%s, customerRevision=%s, coreRevision=%s, timestamp=%s",
+	alias:    "  репозиторий заказчика: %s",
+	noAlias:  "  репозиторий заказчика: алиас не знаю",
+	badTime:  "  timestamp не разобрала: %v",
+	mismatch: "✗ %s — не подходит",
+}
+
+// testLifecycleLine checks the line against every format, not only the first matched
+func testLifecycleLine(line string) string {
+	lines := make([]string, 0, 2*len(lifecyclePatterns))
+	for _, p := range lifecyclePatterns {
+		groups, ok := p.match(line)
+		if !ok {
+			lines = append(lines, fmt.Sprintf(lifecycleLineMessages.mismatch, p.name))
+			continue
+		}
+		lines = append(lines,
+			fmt.Sprintf(lifecycleLineMessages.matched, p.name),
+			fmt.Sprintf(lifecycleLineMessages.groups,
+				groups["customer"], groups["version"], groups["customerRevision"], groups["coreRevision"], groups["timestamp"]),
+		)
+		if _, err := time.Parse(lifecycleTimeFormat, groups["timestamp"]); err != nil {
+			lines = append(lines, fmt.Sprintf(lifecycleLineMessages.badTime, err))
+		}
+		if alias, ok := clientsAliases.resolve(groups["customer"]); ok {
+			lines = append(lines, fmt.Sprintf(lifecycleLineMessages.alias, alias))
+		} else {
+			lines = append(lines, lifecycleLineMessages.noAlias)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// /lifecycle <line> – which of the formats match the line from the log and what they extract
+func (as *activeSession) handleLifecycleLine(update tgbotapi.Update, args []string) {
+	line := strings.TrimSpace(commandText(update.Message.Text))
+	text := lifecycleLineMessages.usage
+	if line != "" {
+		text = testLifecycleLine(line)
+	}
+	_, err := as.bot.Send(newMessage(update.Message.Chat.ID, text))
+	if err != nil {
+		log.Println("ERROR: ", err)
+	}
 }
@@ -3,12 +3,40 @@ package main
 import (
 	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Любой код надо тестировать! Даже код бота =)
 // Автотесты на работу lifecycle-parser.go
 
+// версии TaskWS из initVars, для них ищем записанные ответы, см. Test_capturedResponses
+var configuredTaskWSVersions []string
+
+// Форматы lifecycle-лога берем из initVars и компилируем, как main, остальные настройки тестам не нужны
+func TestMain(m *testing.M) {
+	var (
+		chain                                []taskToRun
+		rules                                []extractionRule
+		ports, files, binds, versions, adHoc []string
+		schema, sessions, port, snapshots    string
+		aliases, uploads, version            string
+		uploadWait                           time.Duration
+	)
+	initVars(&chain, &rules, &lifecycleLineFormats,
+		&ports, &files, &binds, &versions, &adHoc,
+		&schema, &sessions, &port, &snapshots, &aliases, &uploads, &version,
+		&uploadWait)
+	configuredTaskWSVersions = versions
+	var err error
+	lifecyclePatterns, err = compileLifecycleFormats(lifecycleLineFormats)
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
 // Считываем тестовый файлик
 func readLifecycleLogAndParse(filepath string) (*applicationVersions, error) {
 	handle, err := os.Open(filepath)
@@ -35,6 +63,7 @@ func TestReadLifecycleLogAndParse(t *testing.T) {
 				CoreRevision:     "2c980808", // тут было другое значение, но по логике это же?
 				CustomerRevision: "01fbd6f4",
 				CustomerName:     "demo",
+				CustomerTitle:    "Demo",
 				FactorTagVersion: "21.19",
 			},
 			wantErr: false,
@@ -47,6 +76,7 @@ func TestReadLifecycleLogAndParse(t *testing.T) {
 				CoreRevision:     "badfd026",
 				CustomerRevision: "eb02e922",
 				CustomerName:     "name",
+				CustomerTitle:    "Long name",
 				FactorTagVersion: "20.12",
 			},
 			wantErr: false,
@@ -71,3 +101,97 @@ func TestReadLifecycleLogAndParse(t *testing.T) {
 		})
 	}
 }
+
+// Вся история версий без повторов, текущая — последняя
+func TestParseLifecycleHistory(t *testing.T) {
+	handle, err := os.Open("test_data/cdi-lifecycle.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	history, err := parseLifecycleHistory(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 35 {
+		t.Errorf("parseLifecycleHistory() = %d versions, want 35", len(history))
+	}
+	first := history[0]
+	if first.Versions.CustomerRevision != "16f88cc9184e" || first.Count != 1 || first.First.Format(lifecycleTimeFormat) != "2019-04-10 19:46:26,553" {
+		t.Errorf("parseLifecycleHistory() first = %+v", first)
+	}
+	second := history[1]
+	if second.Versions.CustomerRevision != "9f3dc906717c" || second.Count != 13 ||
+		second.First.Format(lifecycleTimeFormat) != "2019-04-16 17:51:54,930" || second.Last.Format(lifecycleTimeFormat) != "2019-04-22 09:25:12,504" {
+		t.Errorf("parseLifecycleHistory() second = %+v", second)
+	}
+	latest := history[len(history)-1].Versions
+	if latest.FactorTagVersion != "21.19" || latest.CustomerRevision != "01fbd6f4" || latest.CustomerName != "demo" {
+		t.Errorf("parseLifecycleHistory() latest = %+v", latest)
+	}
+}
+
+func Test_compileLifecycleFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		formats []lifecycleLineFormat
+		wantErr bool
+	}{
+		{name: "configured formats", formats: lifecycleLineFormats},
+		{name: "bad regexp", formats: []lifecycleLineFormat{{name: "bad", pattern: `(?P<customer>`}}, wantErr: true},
+		{
+			name:    "no group",
+			formats: []lifecycleLineFormat{{name: "no timestamp", pattern: `(?P<customer>\w+) (?P<version>\S+) (?P<customerRevision>\w+) (?P<coreRevision>\w+)`}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileLifecycleFormats(tt.formats)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("compileLifecycleFormats() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_testLifecycleLine(t *testing.T) {
+	tests := []struct {
+		name         string
+		line         string
+		wantContains []string
+	}{
+		{
+			name: "start format",
+			line: "2020-07-17 16:00:38,406 INFO  start - CDI application [Demo 21.19-SNAPSHOT (01fbd6f4, core 2c980808)] [10.221.0.41] started in 137 s.",
+			wantContains: []string{
+				"✓ start\n  customer=Demo, version=21.19, customerRevision=01fbd6f4, coreRevision=2c980808, timestamp=2020-07-17 16:00:38,406\n  репозиторий заказчика: demo",
+				"✗ LifecycleEventListener — не подходит",
+			},
+		},
+		{
+			name: "listener format, unknown customer",
+			line: "2020-07-17 16:00:38,406 INFO  LifecycleEventListener - CDI application [Sony 20.7-SNAPSHOT (85731ae1, core 14e65667)] [10.0.0.1] started in 37 s.",
+			wantContains: []string{
+				"✗ start — не подходит",
+				"✓ LifecycleEventListener",
+				"репозиторий заказчика: алиас не знаю",
+			},
+		},
+		{
+			name:         "not a start line",
+			line:         "2020-07-17 16:00:38,406 INFO  stop - CDI application stopped.",
+			wantContains: []string{"✗ start — не подходит", "✗ LifecycleEventListener — не подходит"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := testLifecycleLine(tt.line)
+			for _, want := range tt.wantContains {
+				if !strings.Contains(got, want) {
+					t.Errorf("testLifecycleLine() does not contain %q:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
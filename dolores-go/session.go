@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -35,7 +39,8 @@ func newTelegramUser(username string, id int64) *telegramUser {
 
 type botSender interface {
 	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
-	GetFileDirectURL(fileID string) (string, error)
+	GetFile(config tgbotapi.FileConfig) (tgbotapi.File, error)
+	DeleteMessage(config tgbotapi.DeleteMessageConfig) (tgbotapi.APIResponse, error)
 }
 
 // struct to handle active user session
@@ -48,31 +53,72 @@ type activeSession struct {
 	time string
 	// name of the image and container to run {customerName}-{customerVersion}-{chatID}
 	customer string
-	// path to diagnostic zip
-	diagZipPath string
+	// the files of the diagnostic received so far, see uploads.go
+	uploads *uploads
+	// the archives of the diagnostic to parse, when everything is received
+	archives []string
+	// sha256 of the diagnostic in the uploads index, see upload-index.go
+	diagKey string
+	// the image built for the same diagnostic before and its versions, empty if the image is built again
+	image         string
+	imageVersions string
+	// temp dir of the session, the archive and extracted files live here
+	workDir string
 	// version and revisions of cdi and factor to start
 	versions *applicationVersions
+	// files extracted from the diagnostic by the rules, paths inside the container
+	extracted extractedFiles
+	// SOAP stats from the diagnostic, see /soapstats
+	soapStats *soapStats
+	// versions started according to the lifecycle log, see version-choice.go
+	history []*lifecycleStart
+	// the choice of the version from the keyboard, not nil while Dolores is waiting for it
+	versionChoice chan int
+	// the repository of the unknown customer from the keyboard, see customer-choice.go
+	customerChoice chan string
+	// the password of the encrypted archive, not nil while Dolores is waiting for it, see encrypted-zip.go
+	passwordPrompt chan string
+	// what to reuse for the known diagnostic, see upload-index.go
+	reuseChoice chan int
+	// stops waiting for the tasks of the chain or /task when the session is over, nil if no tasks are running
+	cancelTasks context.CancelFunc
+	// the tasks run by /task, see task-commands.go
+	adHocRuns []adHocRun
 	// current status
 	status sessionStatus
+	// diagnostic is loaded and the stand can be used
+	standReady bool
 	// telegram bot connection
 	bot botSender
-	// cdi connection
-	cdi cdiChecker
+	// downloads the diagnostics, through the own Bot API server if configured
+	httpClient *http.Client
+	// cdi connection to the stand of the session, see cdi-stand.go, nil until the container is run
+	cdi   cdiChecker
+	stand cdiStand
 	// docker connection
 	docker DockerRunner
 	// sessions queue
 	q                    *sessionsQueue
 	waitInPendingSeconds time.Duration
+	choiceTimeout        time.Duration
+	uploadQuietPeriod    time.Duration
+	// the session is closed if the diagnostic is not complete for so long, 0 – wait forever
+	uploadTimeout time.Duration
 }
 
-func newActiveSession(bot *tgbotapi.BotAPI, cdi *connectToCdi, docker *client.Client) *activeSession {
+func newActiveSession(bot *tgbotapi.BotAPI, docker *client.Client) *activeSession {
 	return &activeSession{
-		status:               DISACTIVE,
-		bot:                  bot,
-		cdi:                  cdi,
+		status: DISACTIVE,
+		bot:    bot,
+		// тот же транспорт, что у бота (свой сервер Bot API), но без общего таймаута:
+		// большая диагностика качается дольше, ее ограничивает downloadTimeout
+		httpClient:           &http.Client{Transport: bot.Client.Transport},
 		docker:               NewDockerClient(docker),
 		q:                    newSessionsQueue(),
 		waitInPendingSeconds: waitInPendingSeconds,
+		choiceTimeout:        choiceTimeout,
+		uploadQuietPeriod:    uploadQuietPeriod,
+		uploadTimeout:        uploadTimeout,
 	}
 }
 
@@ -83,8 +129,21 @@ func (as *activeSession) cleanUp() {
 	as.user = nil
 	as.time = ""
 	as.customer = ""
-	as.diagZipPath = ""
+	as.uploads = nil
+	as.archives = nil
+	as.stopTasks()
+	as.adHocRuns = nil
+	as.cdi = nil
+	as.stand = cdiStand{}
+	as.diagKey = ""
+	as.image = ""
+	as.imageVersions = ""
 	as.versions = nil
+	as.extracted = nil
+	as.soapStats = nil
+	as.history = nil
+	as.standReady = false
+	as.removeWorkDir()
 	as.status = DISACTIVE
 	as.q = newSessionsQueue()
 }
@@ -124,8 +183,21 @@ func (as *activeSession) deactivate() {
 	as.user = as.q.getNext()
 	as.time = ""
 	as.customer = ""
-	as.diagZipPath = ""
+	as.uploads = nil
+	as.archives = nil
+	as.stopTasks()
+	as.adHocRuns = nil
+	as.cdi = nil
+	as.stand = cdiStand{}
+	as.diagKey = ""
+	as.image = ""
+	as.imageVersions = ""
 	as.versions = nil
+	as.extracted = nil
+	as.soapStats = nil
+	as.history = nil
+	as.standReady = false
+	as.removeWorkDir()
 	err := as.docker.KillRunningContainers(as.getCustomer())
 	if err != nil {
 		fmt.Printf("fail to cleanup: %v\n", err)
@@ -154,6 +226,11 @@ func (as *activeSession) isActive(userID int64) bool {
 	return false
 }
 
+// the user owns the active session
+func (as *activeSession) isOwner(userID int64) bool {
+	return as.user != nil && as.status == ACTIVE && as.user.id == userID
+}
+
 func (as *activeSession) getUser() string {
 	return as.user.username
 }
@@ -169,6 +246,56 @@ func (as *activeSession) setCustomer(name, version string, id int64) {
 	as.customer = fmt.Sprintf("%v-%v-%v", name, version, id)
 }
 
+func (as *activeSession) setCancelTasks(cancel context.CancelFunc) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.cancelTasks = cancel
+}
+
+// stop waiting for the running tasks, called under the lock
+func (as *activeSession) stopTasks() {
+	if as.cancelTasks != nil {
+		as.cancelTasks()
+		as.cancelTasks = nil
+	}
+}
+
+func (as *activeSession) getDiagKey() string {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return as.diagKey
+}
+
+// run the container from the image built before, if the versions are the same
+func (as *activeSession) setReusedImage(image, versions string) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.image = image
+	as.imageVersions = versions
+}
+
+// the image built before for the same diagnostic and its versions, empty if the image is built again
+func (as *activeSession) getReusedImage() (string, string) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return as.image, as.imageVersions
+}
+
+// the image to run the container from: the reused one or the built one with the name of the container
+func (as *activeSession) imageName() string {
+	if image, _ := as.getReusedImage(); image != "" {
+		return image
+	}
+	return as.getCustomer()
+}
+
+// set the name of the image and container as is
+func (as *activeSession) setContainerName(name string) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.customer = name
+}
+
 func (as *activeSession) setVersions(versions *applicationVersions) {
 	as.mu.Lock()
 	defer as.mu.Unlock()
@@ -176,10 +303,18 @@ func (as *activeSession) setVersions(versions *applicationVersions) {
 }
 
 func (as *activeSession) getVersions() *applicationVersions {
+	as.mu.Lock()
+	defer as.mu.Unlock()
 	return as.versions
 }
 
+// the versions for the user and for the snapshot label, "" if they are unknown, see parseVersionsString
 func (as *activeSession) getVersionsString() string {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.versions == nil {
+		return ""
+	}
 	return fmt.Sprintf(
 		"%s-%s (%s, core %s)",
 		as.versions.CustomerName,
@@ -189,10 +324,92 @@ func (as *activeSession) getVersionsString() string {
 	)
 }
 
-func (as *activeSession) setDiagZipPath(path string) {
+// every session gets its own dir, so the files of different users never mix
+func (as *activeSession) prepareWorkDir() error {
 	as.mu.Lock()
 	defer as.mu.Unlock()
-	as.diagZipPath = path
+	if err := os.MkdirAll(sessionsDir, 0o755); err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp(sessionsDir, "session-*")
+	if err != nil {
+		return err
+	}
+	as.workDir = dir
+	return os.Mkdir(as.diagDir(), 0o755)
+}
+
+// dir with the extracted diagnostic, it is mounted to the container
+func (as *activeSession) diagDir() string {
+	return filepath.Join(as.workDir, "diag")
+}
+
+// must be called under the lock
+func (as *activeSession) removeWorkDir() {
+	if as.workDir == "" {
+		return
+	}
+	if err := os.RemoveAll(as.workDir); err != nil {
+		log.Printf("fail to remove %s: %v\n", as.workDir, err)
+	}
+	as.workDir = ""
+}
+
+// volumes for the container: the common ones and the diagnostic of the session
+func (as *activeSession) volumeBinds() ([]string, error) {
+	diag, err := filepath.Abs(as.diagDir())
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]string{}, volumeBinds...), diag+":"+diagMountPoint), nil
+}
+
+func (as *activeSession) setExtractedFiles(files extractedFiles) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.extracted = files
+}
+
+func (as *activeSession) getExtractedFiles() extractedFiles {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return as.extracted
+}
+
+func (as *activeSession) setSoapStats(stats *soapStats) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.soapStats = stats
+}
+
+func (as *activeSession) getSoapStats() *soapStats {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return as.soapStats
+}
+
+func (as *activeSession) setHistory(history []*lifecycleStart) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.history = history
+}
+
+func (as *activeSession) getHistory() []*lifecycleStart {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return as.history
+}
+
+func (as *activeSession) setStandReady() {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.standReady = true
+}
+
+func (as *activeSession) isStandReady() bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return as.standReady
 }
 
 func (as *activeSession) getTimeFrom() string {
@@ -221,10 +438,40 @@ var doloresMessages = struct {
 	busyWrong                  string
 	hello                      string
 	tooBigFile                 string
+	badDiagSource              string
+	checksumMismatch           string
+	fileChecksum               string
 	cannotGetDownloadLink      string
 	cannotDownload             string
-	onlyZip                    string
+	onlyArchives               string
 	fileDownloaded             string
+	cannotOpenArchive          string
+	archiveTooBig              string
+	taskParamsFail             string
+	noSoapStats                string
+	chooseVersion              string
+	versionLatest              string
+	versionChosen              string
+	versionUnknownCustomer     string
+	versionTooLate             string
+	chooseCustomer             string
+	customerCancel             string
+	customerNotChosen          string
+	customerRemembered         string
+	customerNotSaved           string
+	customerTooLate            string
+	noCustomerRepo             string
+	askPassword                string
+	wrongPassword              string
+	passwordAttemptsOver       string
+	passwordTimeout            string
+	passwordNotDeleted         string
+	decrypted                  string
+	encryptedArchive           string
+	soapStatsNotOwner          string
+	taskFailedForFile          string
+	taskStillRunning           string
+	taskWSVersionFallback      string
 	cannotParseVersion         string
 	startDeploy                string
 	imageFail                  string
@@ -240,6 +487,27 @@ var doloresMessages = struct {
 	taskFailed                 string
 	allDone                    string
 	notifyForDelete            string
+	snapshotNotOwner           string
+	snapshotNotReady           string
+	snapshotFail               string
+	snapshotSuccess            string
+	snapshotsList              string
+	noSnapshots                string
+	restoreHasStand            string
+	restoreNotFound            string
+	restoreStart               string
+	restoreFail                string
+	knownUpload                string
+	knownUploadVersions        string
+	nothingToReuse             string
+	chooseReuse                string
+	reuseSnapshot              string
+	reuseImage                 string
+	reuseNothing               string
+	reuseTimeout               string
+	reuseTooLate               string
+	imageReused                string
+	imageOutdated              string
 }{
 	tryToStop:                  "Пытаюсь остановить работающий контейнер...",
 	addedToQueue:               "Добавила тебя в очередь на место %v",
@@ -251,11 +519,41 @@ var doloresMessages = struct {
 	busy:                       "Сейчас я уже помогаю человеку %s с развертыванием %s с %s. Можешь пока занять очередь, тогда я напишу тебе, как стенд освободится.",
 	busyWrong:                  "Сейчас уже есть запущенный контейнер, который никому не принадлежит. У меня не получилось его убить, позови создателя.",
 	hello:                      "Привет, человек, сейчас я свободна. Пришли мне файл с диагностикой, я постараюсь помочь",
-	tooBigFile:                 "Файл слишком большой :( Нужно до 20мб.",
+	tooBigFile:                 "Файл слишком большой :( Через телегу могу скачать до 20 МБ. Положи архив на файловый сервер и пришли ссылку или путь, можно с sha256 через пробел",
+	badDiagSource:              "Не могу взять диагностику отсюда: %v. Пришли архив, ссылку на файловый сервер или путь в общей папке",
+	checksumMismatch:           "Контрольная сумма скачанного файла не совпала с той, что ты прислал. Проверь файл и ссылку",
+	fileChecksum:               "Скачала %s (%s), sha256: %s",
 	cannotGetDownloadLink:      "Не смогла получить ссылку на файл, что-то не так",
 	cannotDownload:             "Не получилось скачать файл. Где-то ошибочка, пусть создатель посмотрит",
-	onlyZip:                    "Я понимаю только ZIP архивы с диагностиками, прости",
+	onlyArchives:               "Я понимаю только архивы zip, tar, tar.gz и 7z с диагностиками, прости",
 	fileDownloaded:             "Файл скачала, изучаю...",
+	cannotOpenArchive:          "Не смогла открыть архив, похоже он битый",
+	chooseVersion:              "В логе %d версий, какую разворачивать? Если не выберешь за %d мин, разверну последнюю",
+	versionLatest:              " — последняя",
+	versionChosen:              "Ок, разворачиваю %s",
+	versionUnknownCustomer:     "Для этой версии не знаю репозиторий заказчика «%s», не могу развернуть",
+	versionTooLate:             "Версию уже выбрали, или это не твоя сессия",
+	chooseCustomer:             "Не знаю репозиторий для заказчика «%s». Какой из этих? Жду %d мин",
+	customerCancel:             "Нет нужного, отмена",
+	customerNotChosen:          "Репозиторий для «%s» не выбрали, разворачивать не буду. Попроси создателя добавить алиас",
+	customerRemembered:         "Запомнила: «%s» → %s",
+	customerNotSaved:           "Разворачиваю «%s» из %s, но запомнить алиас не смогла, пусть создатель посмотрит",
+	customerTooLate:            "Репозиторий уже выбрали, или это не твоя сессия",
+	noCustomerRepo:             "Не знаю, из какого репозитория собирать образ, разворачивать не буду",
+	askPassword:                "Архив %s зашифрован. Пришли пароль следующим сообщением, я его сразу удалю. Жду %d мин",
+	wrongPassword:              "Пароль не подошел, попробуй еще. Осталось попыток: %d",
+	passwordAttemptsOver:       "Пароль так и не подошел, разворачивать не буду",
+	passwordTimeout:            "Не дождалась пароля, разворачивать не буду",
+	passwordNotDeleted:         "Не смогла удалить сообщение с паролем, удали его сам",
+	decrypted:                  "Расшифровала %s",
+	encryptedArchive:           "Архив зашифрован, а пароль я не спросила. Пришли диагностику заново",
+	noSoapStats:                "В диагностике нет cdi-soap-stats.log, статистики SOAP нет",
+	soapStatsNotOwner:          "Статистика SOAP есть только по диагностике твоей текущей сессии",
+	taskFailedForFile:          "Не смогла загрузить %s: %s",
+	taskStillRunning:           "Задача %s (id %s) еще идет, уже %d мин",
+	taskWSVersionFallback:      "Для этой версии ЕК ждала TaskWS %s, а стенд отдает %s — запускаю задачи через него",
+	taskParamsFail:             "Не смогла собрать параметры задачи %s: %v. Проверь extractionRules и taskChain",
+	archiveTooBig:              "В архиве слишком много файлов или они слишком большие после распаковки, такое открывать не буду",
 	cannotParseVersion:         "Не смогла понять версию приложения или найти диагностику. Где-то ошибочка, пусть создатель посмотрит",
 	startDeploy:                "Начинаю разворачивать %s",
 	imageFail:                  "Не смогла собрать докер образ. Где-то ошибочка, пусть создатель посмотрит",
@@ -268,9 +566,30 @@ var doloresMessages = struct {
 	cdiAlive:                   "Единый клиент жив! Начинаю заливать диагностику",
 	cdiStartingWait:            "Ещё жду... немного терпения",
 	cdiTimeout:                 "Единый клиент так и не поднялся, надо разбираться. Пусть создатель посмотрит.",
-	taskFailed:                 "Стенд развернут здесь http://%v:%v/cdi/ui/, но задача не отработала, что-то пошло не так: %s",
-	allDone:                    "Все готово! Любуйся http://%v:%v/cdi/ui/. Не забудь удалить контейнер, а то стенд всего один.",
+	taskFailed:                 "Стенд развернут здесь %s, но задача не отработала, что-то пошло не так: %s",
+	allDone:                    "Все готово! Любуйся %s. Задачи на стенде можно запускать командой /task. Не забудь удалить контейнер, а то стенд всего один.",
 	notifyForDelete:            "Может уже можно удалить контейнер и освободить стенд?",
+	snapshotNotOwner:           "Снапшот можно сделать только со своего развернутого стенда",
+	snapshotNotReady:           "Стенд еще не готов, дождись, пока я залью диагностику",
+	snapshotFail:               "Не смогла сохранить снапшот стенда. Где-то ошибочка, пусть создатель посмотрит",
+	snapshotSuccess:            "Сохранила стенд в снапшот %s. Чтобы поднять его заново без сборки и заливки: /restore %s",
+	snapshotsList:              "Сохраненные снапшоты:",
+	noSnapshots:                "Сохраненных снапшотов пока нет. Сделать снапшот развернутого стенда: /snapshot",
+	restoreHasStand:            "У тебя уже есть развернутый стенд, сначала удали контейнер",
+	restoreNotFound:            "Не нашла снапшот %s. Список снапшотов: /restore",
+	restoreStart:               "Поднимаю снапшот %s (%s)",
+	restoreFail:                "Не смогла восстановить данные снапшота. Где-то ошибочка, пусть создатель посмотрит",
+	knownUpload:                "Эту диагностику уже присылали: %s, последний раз %s.",
+	knownUploadVersions:        " Версии: %s.",
+	nothingToReuse:             " Ни снапшотов, ни образа от нее не осталось, разворачиваю заново",
+	chooseReuse:                " Можно не собирать заново, что берем? Если не выберешь за %d мин, соберу заново",
+	reuseSnapshot:              "Снапшот %s",
+	reuseImage:                 "Образ %s, залью диагностику заново",
+	reuseNothing:               "Собрать заново",
+	reuseTimeout:               "Не дождалась ответа, собираю заново",
+	reuseTooLate:               "Уже выбрали, или это не твоя сессия",
+	imageReused:                "Образ %s уже собран, беру его",
+	imageOutdated:              "Готовый образ был для %s, а разворачиваем другую версию — собираю заново",
 }
 
 // if bot receive the callback message:
@@ -278,6 +597,18 @@ var doloresMessages = struct {
 // * if there is an error in docker API, we need to see the result manually
 func (as *activeSession) handleCallbackQuery(update tgbotapi.Update) {
 	tgUser := newTelegramUser(update.CallbackQuery.From.String(), int64(update.CallbackQuery.From.ID))
+	if strings.HasPrefix(update.CallbackQuery.Data, versionCallbackPrefix) {
+		as.handleVersionCallback(update)
+		return
+	}
+	if strings.HasPrefix(update.CallbackQuery.Data, customerCallbackPrefix) {
+		as.handleCustomerCallback(update)
+		return
+	}
+	if strings.HasPrefix(update.CallbackQuery.Data, reuseCallbackPrefix) {
+		as.handleReuseCallback(update)
+		return
+	}
 	switch update.CallbackQuery.Data {
 	case "takePlace":
 		place, alreadyInQueue := as.q.takePlace(tgUser)
@@ -362,52 +693,29 @@ func (as *activeSession) handleBusy(update tgbotapi.Update) {
 	log.Printf("user %+v want to start building\n", update.Message.From)
 }
 
-// if bot receive a file
-// * check wheather it has .zip extension
-// * if the file is bigger then 20mb – fail
+// if bot receive the first file of the diagnostic or a link or a path to it
+// * if the file is bigger then the limit (20mb for api.telegram.org) – fail
+// * check wheather it is an archive of supported format or a part of the split one
 // * in case of fail – deactivate session
 func (as *activeSession) handleZipFile(update tgbotapi.Update) error {
 	as.activate()
 	as.setActiveUser(update)
 	log.Printf("open session for the user %s\n", update.Message.From.String())
-	url, err := as.bot.GetFileDirectURL(update.Message.Document.FileID)
+
+	err := as.prepareWorkDir()
 	if err != nil {
 		log.Println(err)
-		_, err := as.bot.Send(newMessage(update.Message.Chat.ID, doloresMessages.cannotGetDownloadLink))
+		_, err := as.bot.Send(newMessage(update.Message.Chat.ID, doloresMessages.cannotDownload))
 		if err != nil {
 			log.Println("ERROR: ", err)
 		}
 		as.deactivate()
 		return err
 	}
+	as.setUploads(newUploads(as.workDir))
 
-	as.setDiagZipPath(update.Message.Document.FileName)
-
-	if !strings.HasSuffix(as.diagZipPath, ".zip") {
-		_, err := as.bot.Send(newMessage(update.Message.Chat.ID, doloresMessages.onlyZip))
-		if err != nil {
-			log.Println("ERROR: ", err)
-		}
-		log.Printf("user %+v sent not a zip file\n", update.Message.From)
-		as.deactivate()
-		return fmt.Errorf("not a zip file")
-	}
-
-	err = downloadFile(as.diagZipPath, url)
+	err = as.receiveUpload(update)
 	if err != nil {
-		switch {
-		case strings.Contains("file is too big", err.Error()):
-			_, err := as.bot.Send(newMessage(update.Message.Chat.ID, doloresMessages.tooBigFile))
-			if err != nil {
-				log.Println("ERROR: ", err)
-			}
-		default:
-			log.Println(err)
-			_, err := as.bot.Send(newMessage(update.Message.Chat.ID, doloresMessages.cannotDownload))
-			if err != nil {
-				log.Println("ERROR: ", err)
-			}
-		}
 		as.deactivate()
 		return err
 	}
@@ -422,23 +730,78 @@ func (as *activeSession) parseVersions(update tgbotapi.Update) error {
 		log.Println("ERROR: ", err)
 	}
 
-	versions, err := parseZipFile(as.diagZipPath)
-	if err != nil {
+	diag, err := parseArchives(as.archives, as.diagDir())
+	if errors.Is(err, errArchiveTooBig) {
+		log.Println(err)
+		_, err := as.bot.Send(newMessage(update.Message.Chat.ID, doloresMessages.archiveTooBig))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		as.deactivate()
+		return err
+	}
+	if diag == nil {
 		log.Println(err)
-		_, err := as.bot.Send(newMessage(update.Message.Chat.ID, doloresMessages.cannotParseVersion))
+		text := doloresMessages.cannotOpenArchive
+		if errors.Is(err, errEncryptedArchive) {
+			text = doloresMessages.encryptedArchive
+		}
+		_, err := as.bot.Send(newMessage(update.Message.Chat.ID, text))
 		if err != nil {
 			log.Println("ERROR: ", err)
 		}
 		as.deactivate()
 		return err
 	}
-	as.setVersions(versions)
-	as.setCustomer(versions.CustomerName, versions.FactorTagVersion, update.Message.Chat.ID)
+	// отчет по архиву отправляем всегда, в нем же и вердикт
+	for _, text := range splitMessage(diag.report()) {
+		_, sendErr := as.bot.Send(newMessage(update.Message.Chat.ID, text))
+		if sendErr != nil {
+			log.Println("ERROR: ", sendErr)
+		}
+	}
+	if errors.Is(err, errUnknownCustomer) {
+		repo, chooseErr := as.chooseCustomer(update, diag.unknownCustomer)
+		if chooseErr != nil {
+			return chooseErr
+		}
+		diag.setCustomerRepo(repo)
+		err = nil
+	}
+	if err != nil {
+		log.Println(err)
+		if diag.deployable() {
+			_, err := as.bot.Send(newMessage(update.Message.Chat.ID, doloresMessages.cannotParseVersion))
+			if err != nil {
+				log.Println("ERROR: ", err)
+			}
+		}
+		as.deactivate()
+		return err
+	}
+	as.setVersions(diag.versions)
+	as.setExtractedFiles(diag.extraction.paths())
+	as.setSoapStats(diag.soapStats)
+	as.setHistory(diag.history)
+	as.setCustomer(diag.versions.CustomerName, diag.versions.FactorTagVersion, update.Message.Chat.ID)
+	err = uploadsIndex.setVersions(as.getDiagKey(), as.getVersionsString())
+	if err != nil {
+		log.Println("ERROR: could not save uploads index: ", err)
+	}
 	return nil
 }
 
 // build the image from parsed versions
 func (as *activeSession) buildImage(update tgbotapi.Update) error {
+	// без репозитория заказчика Docker упадет где-то в середине сборки, лучше сразу
+	if versions := as.getVersions(); versions == nil || versions.CustomerName == "" {
+		_, err := as.bot.Send(newMessage(update.Message.Chat.ID, doloresMessages.noCustomerRepo))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		as.deactivate()
+		return fmt.Errorf("no customer repository to build the image")
+	}
 	_, err := as.bot.Send(
 		newMessage(
 			update.Message.Chat.ID,
@@ -448,6 +811,23 @@ func (as *activeSession) buildImage(update tgbotapi.Update) error {
 	if err != nil {
 		log.Println("ERROR: ", err)
 	}
+	// ту же диагностику уже собирали — берем готовый образ, если версию выбрали ту же
+	if image, imageVersions := as.getReusedImage(); image != "" {
+		text := fmt.Sprintf(doloresMessages.imageReused, image)
+		reuse := imageVersions == as.getVersionsString()
+		if !reuse {
+			text = fmt.Sprintf(doloresMessages.imageOutdated, imageVersions)
+			as.setReusedImage("", "")
+		}
+		_, err := as.bot.Send(newMessage(update.Message.Chat.ID, text))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		if reuse {
+			log.Printf("reuse image %v\n", image)
+			return nil
+		}
+	}
 	tags := []string{as.getCustomer()}
 	log.Printf("start to build image %v\n", as.getCustomer())
 	dockerfile := "Dockerfile"
@@ -465,6 +845,10 @@ func (as *activeSession) buildImage(update tgbotapi.Update) error {
 		as.deactivate()
 		return err
 	}
+	err = uploadsIndex.setImage(as.getDiagKey(), as.getCustomer(), as.getVersionsString())
+	if err != nil {
+		log.Println("ERROR: could not save uploads index: ", err)
+	}
 	_, err = as.bot.Send(newMessage(update.Message.Chat.ID, doloresMessages.imageSuccess))
 	if err != nil {
 		log.Println("ERROR: ", err)
@@ -476,7 +860,10 @@ func (as *activeSession) buildImage(update tgbotapi.Update) error {
 // * if there is a conflict with existing container by name
 // try to delete and try one more time
 func (as *activeSession) runContainer(update tgbotapi.Update) error {
-	err := as.docker.RunContainer(as.getCustomer(), as.getCustomer(), ports, volumeBinds, []string{})
+	binds, err := as.volumeBinds()
+	if err == nil {
+		err = as.docker.RunContainer(as.imageName(), as.getCustomer(), ports, binds, []string{})
+	}
 	if err != nil {
 		log.Println(err)
 		// if conflict try to delete and repeat
@@ -494,7 +881,7 @@ func (as *activeSession) runContainer(update tgbotapi.Update) error {
 				}
 				as.deactivate()
 			}
-			err = as.docker.RunContainer(as.getCustomer(), as.getCustomer(), ports, volumeBinds, []string{})
+			err = as.docker.RunContainer(as.imageName(), as.getCustomer(), ports, binds, []string{})
 
 			if err != nil {
 				log.Println(err)
@@ -527,6 +914,11 @@ func (as *activeSession) waitCDIToStart(update tgbotapi.Update) error {
 	iter := 0
 	for {
 		iter++
+		// сессию закрыли, пока CDI стартовал: клиента стенда уже нет, и ждать некого
+		cdi, ok := as.getCdi()
+		if !ok {
+			return errNoStand
+		}
 		// check if container is running
 		ok, err := as.docker.CheckRunningContainer(as.getCustomer())
 		if err != nil {
@@ -544,20 +936,17 @@ func (as *activeSession) waitCDIToStart(update tgbotapi.Update) error {
 			}
 			return fmt.Errorf("problem to run the container")
 		}
-		resp, err := http.Get(fmt.Sprintf("http://localhost:%v/cdi/ui", cdiPort))
+		ctx, cancel := context.WithTimeout(context.Background(), cdiRequestTimeout)
+		err = cdi.uiAvailable(ctx)
+		cancel()
 		if err == nil {
-			if resp.StatusCode == 200 {
-				_, err := as.bot.Send(newMessage(update.Message.Chat.ID, doloresMessages.cdiAlive))
-				if err != nil {
-					log.Println("ERROR: ", err)
-				}
-				break
-			} else {
-				log.Println(resp.StatusCode)
+			_, err := as.bot.Send(newMessage(update.Message.Chat.ID, doloresMessages.cdiAlive))
+			if err != nil {
+				log.Println("ERROR: ", err)
 			}
-		} else {
-			log.Println(err)
+			break
 		}
+		log.Println(err)
 		if iter%6 == 0 {
 			_, err := as.bot.Send(newMessage(update.Message.Chat.ID, doloresMessages.cdiStartingWait))
 			if err != nil {
@@ -581,25 +970,29 @@ func (as *activeSession) waitCDIToStart(update tgbotapi.Update) error {
 	return nil
 }
 
-// run task chain and return error if any fails
-func (as *activeSession) runTasks(update tgbotapi.Update) error {
-	for _, task := range taskChain {
-		status, ok := as.cdi.runTaskAndWait(task.taskName, task.taskParams)
-		if !ok {
-			log.Println(status)
-			_, err := as.bot.Send(
-				newMessageWithButton(update.Message.Chat.ID,
-					fmt.Sprintf(doloresMessages.taskFailed, serverIP, cdiPort, status), "Удалить контейнер", as.getCustomer()))
-			if err != nil {
-				log.Println("ERROR: ", err)
-			}
-			return fmt.Errorf("error in running task: %v", status)
+// TaskWS of the stand should be of the same version as the application from the diagnostic,
+// if the stand has another one, the tasks are run through it
+func (as *activeSession) chooseTaskWSVersion(ctx context.Context, update tgbotapi.Update, cdi cdiChecker) error {
+	ctx, cancel := context.WithTimeout(ctx, taskCommandTimeout)
+	defer cancel()
+	preferred := taskWSVersionFor(as.getVersions())
+	version, err := cdi.useVersion(ctx, preferred)
+	if err != nil {
+		log.Println(err)
+		_, err := as.bot.Send(
+			newMessageWithButton(update.Message.Chat.ID,
+				fmt.Sprintf(doloresMessages.taskFailed, as.standUIURL(), taskFailureReason(err)), "Удалить контейнер", as.getCustomer()))
+		if err != nil {
+			log.Println("ERROR: ", err)
 		}
-		_, err := as.bot.Send(newMessage(update.Message.Chat.ID, fmt.Sprintf("%s: %s", task.message, status)))
+		return err
+	}
+	log.Printf("TaskWS version %s, preferred %q\n", version, preferred)
+	if preferred != "" && version != preferred {
+		_, err := as.bot.Send(newMessage(update.Message.Chat.ID, fmt.Sprintf(doloresMessages.taskWSVersionFallback, preferred, version)))
 		if err != nil {
 			log.Println("ERROR: ", err)
 		}
-
 	}
 	return nil
 }
@@ -617,6 +1010,41 @@ func (as *activeSession) notifyForDelete() {
 	}
 }
 
+// check that the stand is free for the user
+// * if Dolores is busy with another user – offer the queue
+// * otherwise cleanup running containers
+func (as *activeSession) acquireStand(update tgbotapi.Update) bool {
+	if as.isActive(update.Message.Chat.ID) {
+		as.handleBusy(update)
+		return false
+	}
+	err := as.docker.KillRunningContainers(as.getCustomer())
+	if err != nil {
+		_, err := as.bot.Send(newMessage(update.Message.Chat.ID, doloresMessages.busyWrong))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		log.Printf("cannot stop running containers: %v\n", err)
+		return false
+	}
+	return true
+}
+
+// the stand is ready: say it to the user and remind to delete the container
+func (as *activeSession) finishDeploy(update tgbotapi.Update) {
+	as.setStandReady()
+	// диагностика развернута, следующий файл – уже новая диагностика
+	as.setUploads(nil)
+	_, err := as.bot.Send(
+		newMessageWithButton(update.Message.Chat.ID,
+			fmt.Sprintf(doloresMessages.allDone, as.standUIURL()), "Удалить контейнер", as.getCustomer()))
+	if err != nil {
+		log.Println("ERROR: ", err)
+	}
+
+	go as.notifyForDelete()
+}
+
 // main message handler
 func (as *activeSession) handleMessage(update tgbotapi.Update) {
 	// if it is callback to stop container
@@ -630,6 +1058,11 @@ func (as *activeSession) handleMessage(update tgbotapi.Update) {
 		return
 	}
 
+	// the password of the encrypted archive, before everything else: it can look like a command
+	if as.handlePassword(update) {
+		return
+	}
+
 	if update.Message.Text == "дай мне суперсилу" {
 		_, err := as.bot.Send(newMessageWithButton(
 			update.Message.Chat.ID,
@@ -643,25 +1076,32 @@ func (as *activeSession) handleMessage(update tgbotapi.Update) {
 		return
 	}
 
-	// download file
-	if as.isActive(update.Message.Chat.ID) {
-		as.handleBusy(update)
+	if as.handleCommand(update) {
 		return
-	} else {
-		// cleanup running containers
-		err := as.docker.KillRunningContainers(as.getCustomer())
-		if err != nil {
-			_, err := as.bot.Send(newMessage(update.Message.Chat.ID, doloresMessages.busyWrong))
+	}
+
+	// the owner sends more files of the diagnostic
+	if as.isUploading(update.Message.Chat.ID) {
+		if update.Message.Document == nil && !looksLikeDiagSource(update.Message.Text) {
+			_, err := as.bot.Send(newMessage(update.Message.Chat.ID, uploadsMessages.waiting))
 			if err != nil {
 				log.Println("ERROR: ", err)
 			}
-			log.Printf("cannot stop running containers: %v\n", err)
 			return
 		}
+		if as.receiveUpload(update) == nil {
+			as.deployWhenReady(update)
+		}
+		return
+	}
+
+	// download file
+	if !as.acquireStand(update) {
+		return
 	}
 
-	// skip if no document
-	if update.Message.Document == nil {
+	// skip if no document and no link to it
+	if update.Message.Document == nil && !looksLikeDiagSource(update.Message.Text) {
 		_, err := as.bot.Send(newMessage(update.Message.Chat.ID, doloresMessages.hello))
 		if err != nil {
 			log.Println("ERROR: ", err)
@@ -675,9 +1115,19 @@ func (as *activeSession) handleMessage(update tgbotapi.Update) {
 	if err != nil {
 		return
 	}
+	as.deployWhenReady(update)
+}
 
+// deploy the received diagnostic: parse, build, run and fill the stand
+func (as *activeSession) deploy(update tgbotapi.Update) {
 	// parse versions and sql.party.xls
-	err = as.parseVersions(update)
+	err := as.parseVersions(update)
+	if err != nil {
+		return
+	}
+
+	// several versions in the lifecycle log – ask which one to deploy
+	err = as.chooseVersion(update)
 	if err != nil {
 		return
 	}
@@ -694,7 +1144,11 @@ func (as *activeSession) handleMessage(update tgbotapi.Update) {
 		return
 	}
 
-	// wait to start cdi
+	// connect to cdi of the container and wait to start it
+	err = as.connectToStand(update)
+	if err != nil {
+		return
+	}
 	err = as.waitCDIToStart(update)
 	if err != nil {
 		return
@@ -707,12 +1161,5 @@ func (as *activeSession) handleMessage(update tgbotapi.Update) {
 	}
 
 	// final
-	_, err = as.bot.Send(
-		newMessageWithButton(update.Message.Chat.ID,
-			fmt.Sprintf(doloresMessages.allDone, serverIP, cdiPort), "Удалить контейнер", as.getCustomer()))
-	if err != nil {
-		log.Println("ERROR: ", err)
-	}
-
-	go as.notifyForDelete()
+	as.finishDeploy(update)
 }
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -18,7 +20,12 @@ func (tbs *testBotSender) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
 	fmt.Printf("Message to send: %#v\n", c)
 	return tgbotapi.Message{}, nil
 }
-func (tbs *testBotSender) GetFileDirectURL(fileID string) (string, error) { return "", nil }
+func (tbs *testBotSender) GetFile(config tgbotapi.FileConfig) (tgbotapi.File, error) {
+	return tgbotapi.File{}, nil
+}
+func (tbs *testBotSender) DeleteMessage(config tgbotapi.DeleteMessageConfig) (tgbotapi.APIResponse, error) {
+	return tgbotapi.APIResponse{Ok: true}, nil
+}
 
 var testBot = &testBotSender{}
 
@@ -34,10 +41,53 @@ func (tdr *testDockerRunner) StopAndRemoveContainer(containername string) error
 func (tdr *testDockerRunner) CheckRunningContainer(containerName string) (bool, error) {
 	return false, nil
 }
+func (tdr *testDockerRunner) PublishedAddress(containerName string, containerPort string) (string, string, error) {
+	return "localhost", containerPort, nil
+}
 func (tdr *testDockerRunner) KillRunningContainers(containerNameToDelete string) error { return nil }
+func (tdr *testDockerRunner) CommitContainer(containerName string, imageName string, labels map[string]string) error {
+	return nil
+}
+func (tdr *testDockerRunner) ListImages(label string) ([]imageInfo, error) { return nil, nil }
+func (tdr *testDockerRunner) ImageExists(imageName string) (bool, error)   { return false, nil }
 
 var testDocker = &testDockerRunner{}
 
+// запоминает, какие задачи запускали, и падает на задачах с параметром из fail
+type testCdiChecker struct {
+	// задачи из одной группы приходят параллельно
+	mu   sync.Mutex
+	runs []string
+	fail string
+}
+
+func (tc *testCdiChecker) addRun(run string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.runs = append(tc.runs, run)
+}
+
+func (tc *testCdiChecker) runTaskAndWait(ctx context.Context, taskName string, taskParams []*TaskParam, progress func(id string, elapsed time.Duration)) (string, error) {
+	run := taskName
+	for _, p := range taskParams {
+		run += fmt.Sprintf(" %s=%v", p.ParamName, p.ParamValue)
+		if p.ParamValue == tc.fail {
+			tc.addRun(run)
+			return "", &taskFailedError{Status: "ERROR", Desc: "failed"}
+		}
+	}
+	tc.addRun(run)
+	return "FINISHED: done", nil
+}
+
+func (tc *testCdiChecker) useVersion(ctx context.Context, preferred string) (string, error) {
+	return "15_3", nil
+}
+
+func (tc *testCdiChecker) uiAvailable(ctx context.Context) error {
+	return nil
+}
+
 type fields struct {
 	user   *telegramUser
 	status sessionStatus
@@ -188,3 +238,191 @@ func Test_activeSession_handleCallbackQuery(t *testing.T) {
 		})
 	}
 }
+
+func Test_activeSession_runTasks(t *testing.T) {
+	taskChain = []taskToRun{
+		{
+			taskName:   "importDataSetTask",
+			taskParams: []*TaskParam{{ParamName: "dataSetFile", ParamValue: "{{.Current}}"}},
+			forEach:    "dataSets",
+		},
+		{taskName: "enginesFullRebuild"},
+	}
+	files := extractedFiles{"dataSets": {"/opt/diag/sql.party.xls", "/opt/diag/datasets/sql.address.xls"}}
+	update := tgbotapi.Update{Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1}}}
+	tests := []struct {
+		name     string
+		fail     string
+		wantRuns []string
+		wantErr  bool
+	}{
+		{
+			name: "all imported",
+			wantRuns: []string{
+				"importDataSetTask dataSetFile=/opt/diag/sql.party.xls",
+				"importDataSetTask dataSetFile=/opt/diag/datasets/sql.address.xls",
+				"enginesFullRebuild",
+			},
+		},
+		{
+			name: "one dataset failed",
+			fail: "/opt/diag/sql.party.xls",
+			// остальные датасеты все равно загружаем, но дальше по цепочке не идем
+			wantRuns: []string{
+				"importDataSetTask dataSetFile=/opt/diag/sql.party.xls",
+				"importDataSetTask dataSetFile=/opt/diag/datasets/sql.address.xls",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cdi := &testCdiChecker{fail: tt.fail}
+			as := newASFromFields(fields{user: newTelegramUser("1", 1)})
+			as.cdi = cdi
+			as.extracted = files
+			err := as.runTasks(update)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("runTasks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(cdi.runs, tt.wantRuns) {
+				t.Errorf("runTasks() runs = %v, want %v", cdi.runs, tt.wantRuns)
+			}
+		})
+	}
+}
+
+func Test_activeSession_chooseVersion(t *testing.T) {
+	history := []*lifecycleStart{
+		{Versions: applicationVersions{CustomerTitle: "Demo", CustomerName: "demo", FactorTagVersion: "20.5", CustomerRevision: "b2458686", CoreRevision: "e86995bd"}},
+		{Versions: applicationVersions{CustomerTitle: "Sony", FactorTagVersion: "20.7", CustomerRevision: "85731ae1", CoreRevision: "14e65667"}},
+		{Versions: applicationVersions{CustomerTitle: "Demo", CustomerName: "demo", FactorTagVersion: "21.19", CustomerRevision: "01fbd6f4", CoreRevision: "2c980808"}},
+	}
+	latest := &applicationVersions{CustomerName: "demo", FactorTagVersion: "21.19", CustomerRevision: "01fbd6f4", CoreRevision: "2c980808"}
+	update := tgbotapi.Update{Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1}}}
+	tests := []struct {
+		name         string
+		choice       string
+		wantErr      bool
+		wantRevision string
+	}{
+		{name: "nothing chosen", wantRevision: "01fbd6f4"},
+		{name: "older version", choice: "version:0", wantRevision: "b2458686"},
+		{name: "unknown customer", choice: "version:1", wantErr: true},
+		{name: "bad index", choice: "version:7", wantRevision: "01fbd6f4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			as := newASFromFields(fields{user: newTelegramUser("1", 1), status: ACTIVE, q: newSessionsQueue()})
+			as.choiceTimeout = 200 * time.Millisecond
+			as.history = history
+			as.versions = latest
+			if tt.choice != "" {
+				go func() {
+					// ждем, пока Долорес покажет клавиатуру
+					for i := 0; i < 100; i++ {
+						as.mu.Lock()
+						waiting := as.versionChoice != nil
+						as.mu.Unlock()
+						if waiting {
+							break
+						}
+						time.Sleep(time.Millisecond)
+					}
+					as.handleCallbackQuery(tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+						Data: tt.choice,
+						From: &tgbotapi.User{UserName: "1", ID: 1},
+					}})
+				}()
+			}
+			err := as.chooseVersion(update)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("chooseVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := as.getVersions().CustomerRevision; got != tt.wantRevision {
+				t.Errorf("chooseVersion() revision = %v, want %v", got, tt.wantRevision)
+			}
+		})
+	}
+}
+
+func Test_activeSession_chooseCustomer(t *testing.T) {
+	update := tgbotapi.Update{Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1}}}
+	tests := []struct {
+		name     string
+		choice   string
+		want     string
+		wantErr  bool
+		remember bool
+	}{
+		{name: "nothing chosen", wantErr: true},
+		{name: "cancel", choice: "customer:", wantErr: true},
+		{name: "unknown repository", choice: "customer:sony", wantErr: true},
+		{name: "known repository", choice: "customer:bank", want: "bank", remember: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := clientsAliases
+			defer func() { clientsAliases = saved }()
+			clientsAliases = newCustomerAliases(map[string]string{"demo": "demo", "bank": "bank"})
+
+			as := newASFromFields(fields{user: newTelegramUser("1", 1), status: ACTIVE, q: newSessionsQueue()})
+			as.choiceTimeout = 200 * time.Millisecond
+			if tt.choice != "" {
+				go func() {
+					// ждем, пока Долорес покажет клавиатуру
+					for i := 0; i < 100; i++ {
+						as.mu.Lock()
+						waiting := as.customerChoice != nil
+						as.mu.Unlock()
+						if waiting {
+							break
+						}
+						time.Sleep(time.Millisecond)
+					}
+					as.handleCallbackQuery(tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+						Data: tt.choice,
+						From: &tgbotapi.User{UserName: "1", ID: 1},
+					}})
+				}()
+			}
+			got, err := as.chooseCustomer(update, "Sony Bank")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("chooseCustomer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("chooseCustomer() = %v, want %v", got, tt.want)
+			}
+			if _, ok := clientsAliases.resolve("sony bank"); ok != tt.remember {
+				t.Errorf("alias remembered = %v, want %v", ok, tt.remember)
+			}
+		})
+	}
+}
+
+// поля сессии пишут обработчики разных сообщений, читать их тоже надо под блокировкой (go test -race)
+func Test_activeSession_gettersUnderLock(t *testing.T) {
+	as := newASFromFields(fields{user: newTelegramUser("1", 1), status: ACTIVE, q: newSessionsQueue()})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		as.setVersions(&applicationVersions{CustomerName: "demo"})
+		as.setHistory([]*lifecycleStart{{}})
+		as.setSoapStats(&soapStats{})
+		as.setExtractedFiles(extractedFiles{})
+		as.setStandReady()
+	}()
+	as.getVersions()
+	as.getVersionsString()
+	as.getHistory()
+	as.getSoapStats()
+	as.getExtractedFiles()
+	as.isStandReady()
+	<-done
+	if !as.isStandReady() || as.getVersions().CustomerName != "demo" {
+		t.Errorf("the setters are lost")
+	}
+}
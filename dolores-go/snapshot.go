@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Снапшоты стенда. После того как Долорес залила диагностику и перестроила индексы,
+// стенд можно сохранить в докер-образ и потом поднять его заново без сборки и заливки.
+// Данные из примонтированной директории копируем рядом, в snapshotsDir/{имя снапшота}
+
+// labels of the snapshot image
+const (
+	snapshotLabel         = "dolores.snapshot"
+	snapshotCustomerLabel = "dolores.customer"
+	snapshotVersionsLabel = "dolores.versions"
+	snapshotUserLabel     = "dolores.user"
+	snapshotDataLabel     = "dolores.data"
+)
+
+// getVersionsString of the stand, to read the versions back on restore
+var versionsStringTemplate = regexp.MustCompile(`^(.*)-(\S*) \((.*), core (.*)\)$`)
+
+type snapshot struct {
+	// name of the image and of the container to run
+	name     string
+	customer string
+	versions string
+	user     string
+	// copy of the mounted data
+	dataDir string
+	created time.Time
+}
+
+// {customer}-snapshot-{time}, docker wants image names in lower case
+func newSnapshotName(customer string, t time.Time) string {
+	return strings.ToLower(fmt.Sprintf("%s-snapshot-%s", customer, t.Format("20060102-150405")))
+}
+
+func newSnapshotFromImage(image imageInfo) *snapshot {
+	return &snapshot{
+		name:     image.Labels[snapshotLabel],
+		customer: image.Labels[snapshotCustomerLabel],
+		versions: image.Labels[snapshotVersionsLabel],
+		user:     image.Labels[snapshotUserLabel],
+		dataDir:  image.Labels[snapshotDataLabel],
+		created:  image.Created,
+	}
+}
+
+// the versions of the stand from the snapshot label, nil if the snapshot has none
+func parseVersionsString(versions string) *applicationVersions {
+	m := versionsStringTemplate.FindStringSubmatch(versions)
+	if m == nil {
+		return nil
+	}
+	return &applicationVersions{CustomerName: m[1], FactorTagVersion: m[2], CustomerRevision: m[3], CoreRevision: m[4]}
+}
+
+// list of the snapshots, newest first
+func (as *activeSession) listSnapshots() ([]*snapshot, error) {
+	images, err := as.docker.ListImages(snapshotLabel)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*snapshot, 0, len(images))
+	for _, image := range images {
+		res = append(res, newSnapshotFromImage(image))
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].created.After(res[j].created)
+	})
+	return res, nil
+}
+
+func (as *activeSession) findSnapshot(name string) (*snapshot, error) {
+	snapshots, err := as.listSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range snapshots {
+		if s.name == name {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("snapshot %s not found", name)
+}
+
+// /snapshot – commit the prepared stand of the owner into the image
+func (as *activeSession) handleSnapshot(update tgbotapi.Update, args []string) {
+	chatID := update.Message.Chat.ID
+	if !as.isOwner(chatID) {
+		_, err := as.bot.Send(newMessage(chatID, doloresMessages.snapshotNotOwner))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		return
+	}
+	if !as.isStandReady() {
+		_, err := as.bot.Send(newMessage(chatID, doloresMessages.snapshotNotReady))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		return
+	}
+
+	name := newSnapshotName(as.getCustomer(), time.Now())
+	dataDir := filepath.Join(snapshotsDir, name)
+	log.Printf("make snapshot %s of %s\n", name, as.getCustomer())
+	err := copyDir(as.diagDir(), dataDir)
+	if err == nil {
+		err = as.docker.CommitContainer(as.getCustomer(), name, map[string]string{
+			snapshotLabel:         name,
+			snapshotCustomerLabel: as.getCustomer(),
+			snapshotVersionsLabel: as.getVersionsString(),
+			snapshotUserLabel:     as.getUser(),
+			snapshotDataLabel:     dataDir,
+		})
+	}
+	if err != nil {
+		log.Println(err)
+		_, err := as.bot.Send(newMessage(chatID, doloresMessages.snapshotFail))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		return
+	}
+	err = uploadsIndex.addSnapshot(as.getDiagKey(), name)
+	if err != nil {
+		log.Println("ERROR: could not save uploads index: ", err)
+	}
+	_, err = as.bot.Send(newMessage(chatID, fmt.Sprintf(doloresMessages.snapshotSuccess, name, name)))
+	if err != nil {
+		log.Println("ERROR: ", err)
+	}
+}
+
+// /restore – list snapshots
+// /restore {name} – run the container from the snapshot, skipping the build and the tasks
+func (as *activeSession) handleRestore(update tgbotapi.Update, args []string) {
+	chatID := update.Message.Chat.ID
+	if len(args) == 0 {
+		as.sendSnapshotsList(chatID)
+		return
+	}
+	if as.isOwner(chatID) {
+		_, err := as.bot.Send(newMessage(chatID, doloresMessages.restoreHasStand))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		return
+	}
+	if !as.acquireStand(update) {
+		return
+	}
+
+	s, err := as.findSnapshot(args[0])
+	if err != nil {
+		log.Println(err)
+		_, err := as.bot.Send(newMessage(chatID, fmt.Sprintf(doloresMessages.restoreNotFound, args[0])))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		return
+	}
+
+	as.activate()
+	as.setActiveUser(update)
+	err = as.prepareWorkDir()
+	if err != nil {
+		log.Println(err)
+		_, err := as.bot.Send(newMessage(chatID, doloresMessages.restoreFail))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		as.deactivate()
+		return
+	}
+	as.restoreSnapshot(update, s)
+}
+
+// run the container from the snapshot in the active session with the prepared work dir
+func (as *activeSession) restoreSnapshot(update tgbotapi.Update, s *snapshot) {
+	chatID := update.Message.Chat.ID
+	as.setContainerName(s.name)
+	// без версий следующий /snapshot не знал бы, что в нем, а задачи — какую версию TaskWS брать
+	as.setVersions(parseVersionsString(s.versions))
+	log.Printf("restore snapshot %s for the user %s\n", s.name, update.Message.From.String())
+	_, err := as.bot.Send(newMessage(chatID, fmt.Sprintf(doloresMessages.restoreStart, s.name, s.versions)))
+	if err != nil {
+		log.Println("ERROR: ", err)
+	}
+
+	err = copyDir(s.dataDir, as.diagDir())
+	if err != nil {
+		log.Println(err)
+		_, err := as.bot.Send(newMessage(chatID, doloresMessages.restoreFail))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		as.deactivate()
+		return
+	}
+
+	err = as.runContainer(update)
+	if err != nil {
+		return
+	}
+
+	err = as.connectToStand(update)
+	if err != nil {
+		return
+	}
+
+	err = as.waitCDIToStart(update)
+	if err != nil {
+		return
+	}
+
+	as.finishDeploy(update)
+}
+
+func (as *activeSession) sendSnapshotsList(chatID int64) {
+	snapshots, err := as.listSnapshots()
+	if err != nil {
+		log.Println(err)
+		_, err := as.bot.Send(newMessage(chatID, doloresMessages.somethingWrong))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		return
+	}
+	if len(snapshots) == 0 {
+		_, err := as.bot.Send(newMessage(chatID, doloresMessages.noSnapshots))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		return
+	}
+	var b strings.Builder
+	b.WriteString(doloresMessages.snapshotsList)
+	for _, s := range snapshots {
+		fmt.Fprintf(&b, "\n/restore %s — %s, %s, %s", s.name, s.versions, s.user, s.created.Format("2006-01-02 15:04"))
+	}
+	_, err = as.bot.Send(newMessage(chatID, b.String()))
+	if err != nil {
+		log.Println("ERROR: ", err)
+	}
+}
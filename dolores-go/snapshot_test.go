@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Автотесты на снапшоты: стенд из снапшота снова можно сохранить
+
+// docker со снапшотами: отдает их образы, стенд публикует на тестовом сервере и запоминает, что коммитили
+type snapshotDocker struct {
+	testDockerRunner
+	images    []imageInfo
+	stand     *url.URL
+	committed map[string]string
+}
+
+func (d *snapshotDocker) CheckRunningContainer(containerName string) (bool, error) {
+	return true, nil
+}
+
+func (d *snapshotDocker) PublishedAddress(containerName string, containerPort string) (string, string, error) {
+	return d.stand.Hostname(), d.stand.Port(), nil
+}
+
+func (d *snapshotDocker) ListImages(label string) ([]imageInfo, error) {
+	return d.images, nil
+}
+
+func (d *snapshotDocker) CommitContainer(containerName string, imageName string, labels map[string]string) error {
+	d.committed = labels
+	return nil
+}
+
+func Test_parseVersionsString(t *testing.T) {
+	tests := []struct {
+		versions string
+		want     *applicationVersions
+	}{
+		{
+			versions: "demo-21.19 (01fbd6f4, core 2c980808)",
+			want:     &applicationVersions{CustomerName: "demo", FactorTagVersion: "21.19", CustomerRevision: "01fbd6f4", CoreRevision: "2c980808"},
+		},
+		{
+			versions: "big-bank-20.7 (85731ae1, core 14e65667)",
+			want:     &applicationVersions{CustomerName: "big-bank", FactorTagVersion: "20.7", CustomerRevision: "85731ae1", CoreRevision: "14e65667"},
+		},
+		{versions: "", want: nil},
+		{versions: "demo", want: nil},
+	}
+	for _, tt := range tests {
+		if got := parseVersionsString(tt.versions); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseVersionsString(%q) = %+v, want %+v", tt.versions, got, tt.want)
+		}
+	}
+}
+
+func Test_activeSession_restoreThenSnapshot(t *testing.T) {
+	sessionsDir, snapshotsDir = t.TempDir(), t.TempDir()
+	defer func() { sessionsDir, snapshotsDir = "", "" }()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	stand, _ := url.Parse(server.URL)
+
+	dataDir := filepath.Join(snapshotsDir, "demo-snapshot-20220406-183000")
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "sql.party.xls"), []byte("party"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	versions := "demo-21.19 (01fbd6f4, core 2c980808)"
+	docker := &snapshotDocker{stand: stand, images: []imageInfo{{
+		Labels: map[string]string{
+			snapshotLabel:         "demo-snapshot-20220406-183000",
+			snapshotCustomerLabel: "demo",
+			snapshotVersionsLabel: versions,
+			snapshotUserLabel:     "someone",
+			snapshotDataLabel:     dataDir,
+		},
+		Created: time.Now(),
+	}}}
+	as := newASFromFields(fields{q: &sessionsQueue{}})
+	as.docker = docker
+	update := tgbotapi.Update{Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1}, From: &tgbotapi.User{UserName: "owner"}}}
+
+	as.handleRestore(update, []string{"demo-snapshot-20220406-183000"})
+	if !as.isStandReady() {
+		t.Fatalf("the stand is not ready after restore")
+	}
+	if got := as.getVersionsString(); got != versions {
+		t.Errorf("versions after restore = %q, want %q", got, versions)
+	}
+
+	as.handleSnapshot(update, nil)
+	if docker.committed == nil {
+		t.Fatalf("snapshot of the restored stand is not committed")
+	}
+	if got := docker.committed[snapshotVersionsLabel]; got != versions {
+		t.Errorf("versions of the new snapshot = %q, want %q", got, versions)
+	}
+	content, err := os.ReadFile(filepath.Join(docker.committed[snapshotDataLabel], "sql.party.xls"))
+	if err != nil || string(content) != "party" {
+		t.Errorf("data of the new snapshot = %q, %v", content, err)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Код для обработки cdi-soap-stats.log. Раз в интервал CDI пишет статистику SOAP-вызовов
+// по каждому сервису и методу: отдельно по каждой ноде и строку <ALL> — по всем сразу.
+// Поля разделены табами, значения выровнены пробелами:
+// 2020-07-21 '00:00'	soap_PartyWS	checkBlacklist	10.221.33.54	user	system	call	292	fail	0	p90	14	...	qps	0,97
+
+const soapStatsSlotFormat = "2006-01-02 '15:04'"
+
+// soapStatsAll marks the row aggregated over all nodes
+const soapStatsAll = "<ALL>"
+
+// soapStatsRow is the stats of the method for one time slot
+type soapStatsRow struct {
+	Slot    time.Time
+	Service string
+	Method  string
+	Node    string
+	User    string
+	System  string
+	Call    int
+	Fail    int
+	P90     int
+	P95     int
+	P99     int
+	Avg     int
+	Max     int
+	Min     int
+	QPS     float64
+}
+
+func (r *soapStatsRow) aggregated() bool {
+	return r.Node == soapStatsAll
+}
+
+type soapStats struct {
+	Rows []*soapStatsRow
+}
+
+func parseSoapStats(in io.Reader) (*soapStats, error) {
+	scanner := bufio.NewScanner(in)
+	res := new(soapStats)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		fields := strings.Split(strings.TrimRight(scanner.Text(), "\r"), "\t")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		// пустые интервалы — только дата и время
+		if len(fields) < 6 || fields[1] == "" {
+			continue
+		}
+		row, err := parseSoapStatsRow(fields)
+		if err != nil {
+			return nil, fmt.Errorf("cdi-soap-stats.log line %d: %w", lineNumber, err)
+		}
+		res.Rows = append(res.Rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(res.Rows) == 0 {
+		return nil, fmt.Errorf("no stats in cdi-soap-stats.log")
+	}
+	return res, nil
+}
+
+func parseSoapStatsRow(fields []string) (*soapStatsRow, error) {
+	slot, err := time.Parse(soapStatsSlotFormat, fields[0])
+	if err != nil {
+		return nil, err
+	}
+	row := &soapStatsRow{Slot: slot, Service: fields[1], Method: fields[2], Node: fields[3], User: fields[4], System: fields[5]}
+	ints := map[string]*int{
+		"call": &row.Call, "fail": &row.Fail,
+		"p90": &row.P90, "p95": &row.P95, "p99": &row.P99,
+		"avg": &row.Avg, "max": &row.Max, "min": &row.Min,
+	}
+	// дальше пары «имя — значение», незнакомые пропускаем
+	for i := 6; i+1 < len(fields); i += 2 {
+		name, value := fields[i], fields[i+1]
+		if name == "qps" {
+			row.QPS, err = strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad qps %q", value)
+			}
+			continue
+		}
+		target, ok := ints[name]
+		if !ok {
+			continue
+		}
+		*target, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s %q", name, value)
+		}
+	}
+	return row, nil
+}
+
+// soapMethodStats is the stats of the method over the whole period of the diagnostic
+type soapMethodStats struct {
+	Service string
+	Method  string
+	Calls   int
+	Fails   int
+	// the worst p99 of the time slots, percentiles cannot be merged honestly
+	P99 int
+	Max int
+	// weighted by the calls
+	Avg         float64
+	First, Last time.Time
+}
+
+func (m *soapMethodStats) failRate() float64 {
+	if m.Calls == 0 {
+		return 0
+	}
+	return float64(m.Fails) / float64(m.Calls)
+}
+
+// methods merges the time slots of every method.
+// Uses the rows aggregated over all nodes, or the node rows if there are no aggregated ones
+func (s *soapStats) methods() []*soapMethodStats {
+	hasAggregated := false
+	for _, r := range s.Rows {
+		if r.aggregated() {
+			hasAggregated = true
+			break
+		}
+	}
+	byMethod := map[string]*soapMethodStats{}
+	res := make([]*soapMethodStats, 0)
+	for _, r := range s.Rows {
+		if r.aggregated() != hasAggregated {
+			continue
+		}
+		key := r.Service + "." + r.Method
+		m, ok := byMethod[key]
+		if !ok {
+			m = &soapMethodStats{Service: r.Service, Method: r.Method, First: r.Slot}
+			byMethod[key] = m
+			res = append(res, m)
+		}
+		if m.Calls+r.Call != 0 {
+			m.Avg = (m.Avg*float64(m.Calls) + float64(r.Avg*r.Call)) / float64(m.Calls+r.Call)
+		}
+		m.Calls += r.Call
+		m.Fails += r.Fail
+		if r.P99 > m.P99 {
+			m.P99 = r.P99
+		}
+		if r.Max > m.Max {
+			m.Max = r.Max
+		}
+		if r.Slot.Before(m.First) {
+			m.First = r.Slot
+		}
+		if r.Slot.After(m.Last) {
+			m.Last = r.Slot
+		}
+	}
+	return res
+}
+
+// period of the diagnostic
+func (s *soapStats) period() (time.Time, time.Time) {
+	first, last := s.Rows[0].Slot, s.Rows[0].Slot
+	for _, r := range s.Rows {
+		if r.Slot.Before(first) {
+			first = r.Slot
+		}
+		if r.Slot.After(last) {
+			last = r.Slot
+		}
+	}
+	return first, last
+}
+
+func (s *soapStats) worstByP99(n int) []*soapMethodStats {
+	methods := s.methods()
+	sort.SliceStable(methods, func(i, j int) bool {
+		return methods[i].P99 > methods[j].P99
+	})
+	return firstMethods(methods, n)
+}
+
+// only methods with failures
+func (s *soapStats) worstByFailRate(n int) []*soapMethodStats {
+	methods := make([]*soapMethodStats, 0)
+	for _, m := range s.methods() {
+		if m.Fails != 0 {
+			methods = append(methods, m)
+		}
+	}
+	sort.SliceStable(methods, func(i, j int) bool {
+		return methods[i].failRate() > methods[j].failRate()
+	})
+	return firstMethods(methods, n)
+}
+
+func firstMethods(methods []*soapMethodStats, n int) []*soapMethodStats {
+	if len(methods) > n {
+		return methods[:n]
+	}
+	return methods
+}
+
+var soapStatsMessages = struct {
+	header   string
+	byP99    string
+	byFail   string
+	noFails  string
+	p99Line  string
+	failLine string
+}{
+	header:   "SOAP из диагностики за %s — %s:",
+	byP99:    "Самые медленные по p99:",
+	byFail:   "Чаще всего падают:",
+	noFails:  "Упавших вызовов нет",
+	p99Line:  "• %s.%s — p99 %d мс, max %d мс, avg %.0f мс, вызовов %d",
+	failLine: "• %s.%s — %.1f%% (%d из %d)",
+}
+
+func (s *soapStats) report(n int) string {
+	first, last := s.period()
+	lines := []string{
+		fmt.Sprintf(soapStatsMessages.header, first.Format("2006-01-02 15:04"), last.Format("2006-01-02 15:04")),
+		"",
+		soapStatsMessages.byP99,
+	}
+	for _, m := range s.worstByP99(n) {
+		lines = append(lines, fmt.Sprintf(soapStatsMessages.p99Line, m.Service, m.Method, m.P99, m.Max, m.Avg, m.Calls))
+	}
+	lines = append(lines, "", soapStatsMessages.byFail)
+	failed := s.worstByFailRate(n)
+	if len(failed) == 0 {
+		lines = append(lines, soapStatsMessages.noFails)
+	}
+	for _, m := range failed {
+		lines = append(lines, fmt.Sprintf(soapStatsMessages.failLine, m.Service, m.Method, 100*m.failRate(), m.Fails, m.Calls))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// сколько методов показывает /soapstats по умолчанию и сколько самое большее
+const (
+	defaultSoapStatsMethods = 5
+	maxSoapStatsMethods     = 50
+)
+
+// N from /soapstats N
+func soapStatsCount(args []string) int {
+	if len(args) == 0 {
+		return defaultSoapStatsMethods
+	}
+	n, err := strconv.Atoi(args[0])
+	switch {
+	case err != nil || n <= 0:
+		return defaultSoapStatsMethods
+	case n > maxSoapStatsMethods:
+		return maxSoapStatsMethods
+	}
+	return n
+}
+
+// /soapstats [N] – the worst SOAP methods of the diagnostic of the session
+func (as *activeSession) handleSoapStats(update tgbotapi.Update, args []string) {
+	chatID := update.Message.Chat.ID
+	text := doloresMessages.noSoapStats
+	stats := as.getSoapStats()
+	switch {
+	case !as.isOwner(chatID):
+		text = doloresMessages.soapStatsNotOwner
+	case stats != nil:
+		text = stats.report(soapStatsCount(args))
+	}
+	for _, part := range splitMessage(text) {
+		_, err := as.bot.Send(newMessage(chatID, part))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Автотесты на разбор cdi-soap-stats.log
+
+func TestParseSoapStats(t *testing.T) {
+	handle, err := os.Open("test_data/cdi-soap-stats.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	stats, err := parseSoapStats(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// пустые интервалы пропускаем
+	if len(stats.Rows) != 20 {
+		t.Errorf("parseSoapStats() rows = %d, want 20", len(stats.Rows))
+	}
+	want := &soapStatsRow{
+		Slot:    stats.Rows[0].Slot,
+		Service: "soap_PartyWS", Method: "search", Node: "192.168.43.2", User: "ats_write",
+		Call: 1, P90: 1441, P95: 1441, P99: 1441, Avg: 1441, Max: 1441, Min: 1441,
+	}
+	if !reflect.DeepEqual(stats.Rows[0], want) {
+		t.Errorf("parseSoapStats() first row = %+v, want %+v", stats.Rows[0], want)
+	}
+
+	names := func(methods []*soapMethodStats) []string {
+		res := make([]string, 0, len(methods))
+		for _, m := range methods {
+			res = append(res, m.Method)
+		}
+		return res
+	}
+	if got := names(stats.worstByP99(5)); !reflect.DeepEqual(got, []string{"saveAndMerge", "search"}) {
+		t.Errorf("worstByP99() = %v", got)
+	}
+	failed := stats.worstByFailRate(1)
+	if len(failed) != 1 || failed[0].Method != "saveAndMerge" || failed[0].Fails != 2 || failed[0].Calls != 4 {
+		t.Errorf("worstByFailRate() = %+v", failed)
+	}
+	if report := stats.report(5); !strings.Contains(report, "• soap_PartyWS.search — 30.0% (3 из 10)") {
+		t.Errorf("report() = %s", report)
+	}
+}
+
+func TestParseSoapStatsBadLine(t *testing.T) {
+	_, err := parseSoapStats(strings.NewReader("2020-02-13 '11:02'\tsoap_PartyWS\tsearch\t<ALL>\t<ALL>\t<ALL>\tcall\tmany\n"))
+	if err == nil {
+		t.Error("parseSoapStats() want error for bad number")
+	}
+}
+
+func Test_soapStatsCount(t *testing.T) {
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{args: nil, want: defaultSoapStatsMethods},
+		{args: []string{"10"}, want: 10},
+		{args: []string{"0"}, want: defaultSoapStatsMethods},
+		{args: []string{"много"}, want: defaultSoapStatsMethods},
+		{args: []string{"100000"}, want: maxSoapStatsMethods},
+	}
+	for _, tt := range tests {
+		if got := soapStatsCount(tt.args); got != tt.want {
+			t.Errorf("soapStatsCount(%v) = %d, want %d", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Цепочка задач после старта стенда, см. taskChain в dolores.go.
+// Задачу можно запускать по условию (заказчик, есть файлы, шаблон when), не останавливать цепочку,
+// если она упала (continueOnError), и запускать несколько задач параллельно (group).
+// Что получилось у каждой задачи, в конце пишем одним отчетом
+
+var taskChainMessages = struct {
+	report         string
+	done           string
+	failed         string
+	skipped        string
+	notRun         string
+	noFiles        string
+	notForCustomer string
+	conditionFalse string
+}{
+	report:         "Задачи на стенде:",
+	done:           "+ %s: %s",
+	failed:         "- %s: %s",
+	skipped:        "~ %s: пропустила, %s",
+	notRun:         "~ %s: не запускала, цепочка остановилась",
+	noFiles:        "в диагностике нет файлов %s",
+	notForCustomer: "не для заказчика %s",
+	conditionFalse: "условие не выполнено",
+}
+
+// taskResult is the line of the report: the task (with the file for forEach) and what happened to it
+type taskResult struct {
+	name    string
+	status  string
+	failed  bool
+	skipped bool
+	notRun  bool
+}
+
+func (r taskResult) String() string {
+	switch {
+	case r.notRun:
+		return fmt.Sprintf(taskChainMessages.notRun, r.name)
+	case r.skipped:
+		return fmt.Sprintf(taskChainMessages.skipped, r.name, r.status)
+	case r.failed:
+		return fmt.Sprintf(taskChainMessages.failed, r.name, r.status)
+	}
+	return fmt.Sprintf(taskChainMessages.done, r.name, r.status)
+}
+
+// skipReason says why the task is not run with this data, empty if it is run
+func (t taskToRun) skipReason(data taskParamsData) (string, error) {
+	if len(t.customers) != 0 && !containsFold(t.customers, data.Customer) {
+		return fmt.Sprintf(taskChainMessages.notForCustomer, data.Customer), nil
+	}
+	for _, param := range []string{t.ifFiles, t.forEach} {
+		if param != "" && len(data.Files[param]) == 0 {
+			return fmt.Sprintf(taskChainMessages.noFiles, param), nil
+		}
+	}
+	if t.when == "" {
+		return "", nil
+	}
+	res, err := renderTaskTemplate(t.taskName+" when", t.when, data)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(res) != "true" {
+		return taskChainMessages.conditionFalse, nil
+	}
+	return "", nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// taskSteps splits the chain into the steps: the neighbour tasks with the same group are run together
+func taskSteps(chain []taskToRun) [][]taskToRun {
+	var res [][]taskToRun
+	for i, task := range chain {
+		if i > 0 && task.group != "" && task.group == chain[i-1].group {
+			res[len(res)-1] = append(res[len(res)-1], task)
+			continue
+		}
+		res = append(res, []taskToRun{task})
+	}
+	return res
+}
+
+// run task chain and return error if any task without continueOnError fails.
+// Each task is waited no longer than its timeout, all of them – while the session is active
+func (as *activeSession) runTasks(update tgbotapi.Update) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	as.setCancelTasks(cancel)
+	defer as.setCancelTasks(nil)
+	// клиент берем один раз: если сессию закроют, ctx отменится, а задачи договорят со своим стендом
+	cdi, ok := as.getCdi()
+	if !ok {
+		return errNoStand
+	}
+	err := as.chooseTaskWSVersion(ctx, update, cdi)
+	if err != nil {
+		return err
+	}
+	data := newTaskParamsData(as.getExtractedFiles(), as.getVersions(), as.getUser())
+	steps := taskSteps(taskChain)
+	var report []taskResult
+	var failed []string
+	for i, step := range steps {
+		results := make([][]taskResult, len(step))
+		stop := make([]bool, len(step))
+		var wg sync.WaitGroup
+		for j, task := range step {
+			wg.Add(1)
+			go func(j int, task taskToRun) {
+				defer wg.Done()
+				results[j], stop[j] = as.runChainTask(ctx, update, cdi, task, data)
+			}(j, task)
+		}
+		wg.Wait()
+		// сессию закрыли, пока задачи шли, — писать уже некому
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		for j := range step {
+			report = append(report, results[j]...)
+			if !stop[j] {
+				continue
+			}
+			for _, r := range results[j] {
+				if r.failed {
+					failed = append(failed, fmt.Sprintf("%s: %s", r.name, r.status))
+				}
+			}
+		}
+		if len(failed) == 0 {
+			continue
+		}
+		for _, rest := range steps[i+1:] {
+			for _, task := range rest {
+				report = append(report, taskResult{name: task.taskName, notRun: true})
+			}
+		}
+		break
+	}
+	as.sendTaskReport(update.Message.Chat.ID, report)
+	if len(failed) != 0 {
+		status := strings.Join(failed, "; ")
+		_, err := as.bot.Send(
+			newMessageWithButton(update.Message.Chat.ID,
+				fmt.Sprintf(doloresMessages.taskFailed, as.standUIURL(), status), "Удалить контейнер", as.getCustomer()))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		return fmt.Errorf("error in running task: %v", status)
+	}
+	return nil
+}
+
+// runChainTask runs the task for each of its files and reports about each run.
+// Even if some file failed the rest are run; true means the chain should stop here
+func (as *activeSession) runChainTask(ctx context.Context, update tgbotapi.Update, cdi cdiChecker, task taskToRun, data taskParamsData) ([]taskResult, bool) {
+	chatID := update.Message.Chat.ID
+	reason, err := task.skipReason(data)
+	if err != nil {
+		return []taskResult{as.taskParamsFailed(chatID, task, err)}, !task.continueOnError
+	}
+	if reason != "" {
+		return []taskResult{{name: task.taskName, status: reason, skipped: true}}, false
+	}
+	var results []taskResult
+	failed := false
+	for _, current := range task.invocations(data.Files) {
+		data.Current = current
+		params, err := renderTaskParams(task.taskParams, data)
+		if err != nil {
+			return append(results, as.taskParamsFailed(chatID, task, err)), !task.continueOnError
+		}
+		name := task.taskName
+		message := task.message
+		if current != "" {
+			name = fmt.Sprintf("%s (%s)", task.taskName, path.Base(current))
+			message = fmt.Sprintf("%s (%s)", task.message, path.Base(current))
+		}
+		progress := func(id string, elapsed time.Duration) {
+			_, err := as.bot.Send(newMessage(chatID, fmt.Sprintf(doloresMessages.taskStillRunning, name, id, int(elapsed.Minutes()))))
+			if err != nil {
+				log.Println("ERROR: ", err)
+			}
+		}
+		taskCtx, taskCancel := context.WithTimeout(ctx, task.deadline())
+		status, err := cdi.runTaskAndWait(taskCtx, task.taskName, params, progress)
+		taskCancel()
+		if err != nil {
+			log.Println(err)
+			if ctx.Err() != nil {
+				return results, true
+			}
+			failed = true
+			status = taskFailureReason(err)
+			results = append(results, taskResult{name: name, status: status, failed: true})
+			if current != "" {
+				_, err := as.bot.Send(newMessage(chatID, fmt.Sprintf(doloresMessages.taskFailedForFile, path.Base(current), status)))
+				if err != nil {
+					log.Println("ERROR: ", err)
+				}
+			}
+			continue
+		}
+		results = append(results, taskResult{name: name, status: status})
+		_, err = as.bot.Send(newMessage(chatID, fmt.Sprintf("%s: %s", message, status)))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+	}
+	return results, failed && !task.continueOnError
+}
+
+// the params or the condition of the task are wrong, it is the failure of the task
+func (as *activeSession) taskParamsFailed(chatID int64, task taskToRun, err error) taskResult {
+	log.Println(err)
+	_, sendErr := as.bot.Send(newMessage(chatID, fmt.Sprintf(doloresMessages.taskParamsFail, task.taskName, err)))
+	if sendErr != nil {
+		log.Println("ERROR: ", sendErr)
+	}
+	return taskResult{name: task.taskName, status: err.Error(), failed: true}
+}
+
+func (as *activeSession) sendTaskReport(chatID int64, report []taskResult) {
+	if len(report) == 0 {
+		return
+	}
+	lines := make([]string, 0, len(report)+1)
+	lines = append(lines, taskChainMessages.report)
+	for _, r := range report {
+		lines = append(lines, r.String())
+	}
+	_, err := as.bot.Send(newMessage(chatID, strings.Join(lines, "\n")))
+	if err != nil {
+		log.Println("ERROR: ", err)
+	}
+}
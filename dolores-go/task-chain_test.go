@@ -0,0 +1,155 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Автотесты на цепочку задач: условия, группы и continueOnError
+
+func Test_taskToRun_skipReason(t *testing.T) {
+	data := newTaskParamsData(extractedFiles{"dataSets": {"/opt/diag/sql.party.xls"}},
+		&applicationVersions{CustomerName: "demo", FactorTagVersion: "21.19"}, "tester")
+	tests := []struct {
+		name    string
+		task    taskToRun
+		want    string
+		wantErr bool
+	}{
+		{name: "no conditions", task: taskToRun{taskName: "enginesFullRebuild"}},
+		{name: "customer", task: taskToRun{customers: []string{"bank", "Demo"}}},
+		{name: "other customer", task: taskToRun{customers: []string{"bank"}}, want: "не для заказчика demo"},
+		{name: "files", task: taskToRun{ifFiles: "dataSets"}},
+		{name: "no files", task: taskToRun{ifFiles: "dictionaries"}, want: "в диагностике нет файлов dictionaries"},
+		{name: "forEach without files", task: taskToRun{forEach: "configs"}, want: "в диагностике нет файлов configs"},
+		{name: "when", task: taskToRun{when: `{{eq .Versions.FactorTagVersion "21.19"}}`}},
+		{name: "when false", task: taskToRun{when: `{{ne .User "tester"}}`}, want: "условие не выполнено"},
+		{name: "bad when", task: taskToRun{when: "{{.Unknown}}"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.task.skipReason(data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("skipReason() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("skipReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_taskSteps(t *testing.T) {
+	chain := []taskToRun{
+		{taskName: "a"},
+		{taskName: "b", group: "rebuild"},
+		{taskName: "c", group: "rebuild"},
+		{taskName: "d"},
+		{taskName: "e", group: "rebuild"},
+	}
+	var got [][]string
+	for _, step := range taskSteps(chain) {
+		var names []string
+		for _, task := range step {
+			names = append(names, task.taskName)
+		}
+		got = append(got, names)
+	}
+	want := [][]string{{"a"}, {"b", "c"}, {"d"}, {"e"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("taskSteps() = %v, want %v", got, want)
+	}
+}
+
+func Test_activeSession_runTasks_chain(t *testing.T) {
+	defer func(chain []taskToRun) { taskChain = chain }(taskChain)
+	files := extractedFiles{"dataSets": {"/opt/diag/sql.party.xls"}}
+	update := tgbotapi.Update{Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1}}}
+	tests := []struct {
+		name     string
+		chain    []taskToRun
+		fail     string
+		wantRuns []string
+		wantErr  bool
+	}{
+		{
+			name: "conditions and versions in params",
+			chain: []taskToRun{
+				{taskName: "bankOnly", customers: []string{"bank"}},
+				{taskName: "importDictionaries", ifFiles: "dictionaries"},
+				{taskName: "importDataSetTask", taskParams: []*TaskParam{
+					{ParamName: "dataSetFile", ParamValue: "{{.File.dataSets}}"},
+					{ParamName: "factor", ParamValue: "{{.Versions.FactorTagVersion}}"},
+				}},
+			},
+			wantRuns: []string{"importDataSetTask dataSetFile=/opt/diag/sql.party.xls factor=21.19"},
+		},
+		{
+			name: "continue on error",
+			chain: []taskToRun{
+				{taskName: "cleanCaches", taskParams: []*TaskParam{{ParamName: "mode", ParamValue: "all"}}, continueOnError: true},
+				{taskName: "enginesFullRebuild"},
+			},
+			fail:     "all",
+			wantRuns: []string{"cleanCaches mode=all", "enginesFullRebuild"},
+		},
+		{
+			name: "failed group stops the chain",
+			chain: []taskToRun{
+				{taskName: "rebuildParty", taskParams: []*TaskParam{{ParamName: "entity", ParamValue: "party"}}, group: "rebuild"},
+				{taskName: "rebuildAddress", taskParams: []*TaskParam{{ParamName: "entity", ParamValue: "address"}}, group: "rebuild"},
+				{taskName: "enginesFullRebuild"},
+			},
+			fail: "party",
+			// вторая задача группы все равно отрабатывает, а после группы не идем
+			wantRuns: []string{"rebuildAddress entity=address", "rebuildParty entity=party"},
+			wantErr:  true,
+		},
+		{
+			name: "bad template",
+			chain: []taskToRun{
+				{taskName: "importDataSetTask", taskParams: []*TaskParam{{ParamName: "dataSetFile", ParamValue: "{{.File.configs}}"}}},
+				{taskName: "enginesFullRebuild"},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taskChain = tt.chain
+			cdi := &testCdiChecker{fail: tt.fail}
+			as := newASFromFields(fields{user: newTelegramUser("1", 1)})
+			as.cdi = cdi
+			as.extracted = files
+			as.versions = &applicationVersions{CustomerName: "demo", FactorTagVersion: "21.19"}
+			err := as.runTasks(update)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("runTasks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			sort.Strings(cdi.runs)
+			if !reflect.DeepEqual(cdi.runs, tt.wantRuns) {
+				t.Errorf("runTasks() runs = %v, want %v", cdi.runs, tt.wantRuns)
+			}
+		})
+	}
+}
+
+func Test_taskResult_String(t *testing.T) {
+	tests := []struct {
+		result taskResult
+		want   string
+	}{
+		{result: taskResult{name: "enginesFullRebuild", status: "FINISHED: done"}, want: "+ enginesFullRebuild: FINISHED: done"},
+		{result: taskResult{name: "importDataSetTask (sql.party.xls)", status: "ERROR: failed", failed: true}, want: "- importDataSetTask (sql.party.xls): ERROR: failed"},
+		{result: taskResult{name: "bankOnly", status: "не для заказчика demo", skipped: true}, want: "~ bankOnly: пропустила, не для заказчика demo"},
+		{result: taskResult{name: "enginesFullRebuild", notRun: true}, want: "~ enginesFullRebuild: не запускала, цепочка остановилась"},
+	}
+	for _, tt := range tests {
+		if got := tt.result.String(); got != tt.want {
+			t.Errorf("taskResult.String() = %q, want %q", got, tt.want)
+		}
+	}
+}
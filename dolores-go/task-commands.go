@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Задачи стенда из чата, без админки ЕК:
+// /task {name} key=value ... – запустить задачу из adHocTasks на готовом стенде, /task без аргументов – что уже запускали
+// Только для владельца стенда
+
+const (
+	// сколько ждем ответа TaskWS на команду из чата
+	taskCommandTimeout = 30 * time.Second
+	// сколько последних запусков /task показываем
+	maxAdHocHistory = 10
+)
+
+// имя параметра задачи в /task: name=value
+var taskParamNameTemplate = regexp.MustCompile(`^[A-Za-z][\w.]{0,63}$`)
+
+var taskCommandsMessages = struct {
+	notOwner   string
+	failed     string
+	noStand    string
+	taskUsage  string
+	allowed    string
+	notReady   string
+	notAllowed string
+	badParam   string
+	busy       string
+	started    string
+	finished   string
+	history    string
+	historyRun string
+	running    string
+}{
+	notOwner:   "Задачами можно управлять только на своем развернутом стенде",
+	failed:     "Не получилось: %s",
+	noStand:    "Стенд еще не запущен, задач на нем нет",
+	taskUsage:  "Напиши задачу и параметры: /task {name} key=value ... Повтори key, чтобы передать список",
+	allowed:    "Можно запускать: %s",
+	notReady:   "Стенд еще не готов, задачи запускаю после «Все готово»",
+	notAllowed: "Задачу %s из чата не запускаю. Можно: %s",
+	badParam:   "Не понимаю параметр %s, пиши key=value",
+	busy:       "На стенде уже идет задача, дождись ее",
+	started:    "Запускаю %s, жду до %d мин",
+	finished:   "%s: %s (%s)",
+	history:    "Запускала из чата:",
+	historyRun: "%s %s%s: %s",
+	running:    "идет",
+}
+
+// adHocRun is the task run by /task, the history lives while the session is active
+type adHocRun struct {
+	name    string
+	params  []*TaskParam
+	started time.Time
+	elapsed time.Duration
+	// "" while the task is running
+	status string
+}
+
+func (r adHocRun) String() string {
+	var params strings.Builder
+	for _, p := range r.params {
+		fmt.Fprintf(&params, " %s=%v", p.ParamName, p.ParamValue)
+	}
+	status := taskCommandsMessages.running
+	if r.status != "" {
+		status = fmt.Sprintf("%s (%s)", r.status, r.elapsed.Round(time.Second))
+	}
+	return fmt.Sprintf(taskCommandsMessages.historyRun, r.started.Format("15:04"), r.name, params.String(), status)
+}
+
+func (as *activeSession) sendTaskCommandResult(chatID int64, text string, err error) {
+	if err != nil {
+		log.Println(err)
+		text = fmt.Sprintf(taskCommandsMessages.failed, taskFailureReason(err))
+	}
+	_, err = as.bot.Send(newMessage(chatID, text))
+	if err != nil {
+		log.Println("ERROR: ", err)
+	}
+}
+
+// only the owner manages the tasks of the stand, and only when the container is run.
+// Returns the client of the stand
+func (as *activeSession) checkTaskOwner(chatID int64) (cdiChecker, bool) {
+	if !as.isOwner(chatID) {
+		as.sendTaskCommandResult(chatID, taskCommandsMessages.notOwner, nil)
+		return nil, false
+	}
+	cdi, ok := as.getCdi()
+	if !ok {
+		as.sendTaskCommandResult(chatID, taskCommandsMessages.noStand, nil)
+		return nil, false
+	}
+	return cdi, true
+}
+
+// badTaskArgError is the argument of /task which is not key=value
+type badTaskArgError struct {
+	Arg string
+}
+
+func (e *badTaskArgError) Error() string {
+	return fmt.Sprintf("%v %q", errBadTaskParam, e.Arg)
+}
+
+func (e *badTaskArgError) Unwrap() error {
+	return errBadTaskParam
+}
+
+// parseAdHocParams reads key=value, the repeated key makes the list of values
+func parseAdHocParams(args []string) ([]*TaskParam, error) {
+	var res []*TaskParam
+	byName := map[string]*TaskParam{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || !taskParamNameTemplate.MatchString(parts[0]) {
+			return nil, &badTaskArgError{Arg: arg}
+		}
+		name, value := parts[0], parts[1]
+		p, ok := byName[name]
+		if !ok {
+			p = &TaskParam{ParamName: name, ParamValue: value}
+			byName[name] = p
+			res = append(res, p)
+			continue
+		}
+		switch values := p.ParamValue.(type) {
+		case string:
+			p.ParamValue = []string{values, value}
+		case []string:
+			p.ParamValue = append(values, value)
+		}
+	}
+	return res, nil
+}
+
+// the task from the chain is waited as long as in the chain
+func adHocTaskDeadline(name string) time.Duration {
+	for _, task := range taskChain {
+		if task.taskName == name {
+			return task.deadline()
+		}
+	}
+	return defaultTaskTimeout
+}
+
+// claim the stand for the task from the chat, false if some task of the session is already running
+func (as *activeSession) claimTasks(cancel context.CancelFunc) bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.cancelTasks != nil {
+		return false
+	}
+	as.cancelTasks = cancel
+	return true
+}
+
+func (as *activeSession) addAdHocRun(run adHocRun) int {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.adHocRuns = append(as.adHocRuns, run)
+	return len(as.adHocRuns) - 1
+}
+
+func (as *activeSession) finishAdHocRun(i int, status string, elapsed time.Duration) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	// сессия могла закончиться, пока задача шла
+	if i < len(as.adHocRuns) {
+		as.adHocRuns[i].status = status
+		as.adHocRuns[i].elapsed = elapsed
+	}
+}
+
+// the usage and the last runs of /task
+func (as *activeSession) adHocSummary() string {
+	lines := []string{taskCommandsMessages.taskUsage, fmt.Sprintf(taskCommandsMessages.allowed, strings.Join(adHocTasks, ", "))}
+	as.mu.Lock()
+	runs := append([]adHocRun{}, as.adHocRuns...)
+	as.mu.Unlock()
+	if len(runs) == 0 {
+		return strings.Join(lines, "\n")
+	}
+	if len(runs) > maxAdHocHistory {
+		runs = runs[len(runs)-maxAdHocHistory:]
+	}
+	lines = append(lines, "", taskCommandsMessages.history)
+	for _, r := range runs {
+		lines = append(lines, r.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// /task {name} key=value ... – run the allowed task on the ready stand and report how it goes
+func (as *activeSession) handleTask(update tgbotapi.Update, args []string) {
+	chatID := update.Message.Chat.ID
+	cdi, ok := as.checkTaskOwner(chatID)
+	if !ok {
+		return
+	}
+	if len(args) == 0 {
+		as.sendTaskCommandResult(chatID, as.adHocSummary(), nil)
+		return
+	}
+	if !as.isStandReady() {
+		as.sendTaskCommandResult(chatID, taskCommandsMessages.notReady, nil)
+		return
+	}
+	name := args[0]
+	if !containsString(adHocTasks, name) {
+		as.sendTaskCommandResult(chatID, fmt.Sprintf(taskCommandsMessages.notAllowed, name, strings.Join(adHocTasks, ", ")), nil)
+		return
+	}
+	params, err := parseAdHocParams(args[1:])
+	var badArg *badTaskArgError
+	if errors.As(err, &badArg) {
+		as.sendTaskCommandResult(chatID, fmt.Sprintf(taskCommandsMessages.badParam, badArg.Arg), nil)
+		return
+	}
+	deadline := adHocTaskDeadline(name)
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+	if !as.claimTasks(cancel) {
+		as.sendTaskCommandResult(chatID, taskCommandsMessages.busy, nil)
+		return
+	}
+	defer as.setCancelTasks(nil)
+
+	started := time.Now()
+	i := as.addAdHocRun(adHocRun{name: name, params: params, started: started})
+	log.Printf("run task %s for the user %s\n", name, update.Message.From.String())
+	as.sendTaskCommandResult(chatID, fmt.Sprintf(taskCommandsMessages.started, name, int(deadline.Minutes())), nil)
+	progress := func(id string, elapsed time.Duration) {
+		as.sendTaskCommandResult(chatID, fmt.Sprintf(doloresMessages.taskStillRunning, name, id, int(elapsed.Minutes())), nil)
+	}
+	status, err := cdi.runTaskAndWait(ctx, name, params, progress)
+	if err != nil {
+		log.Println(err)
+		// сессию закрыли, пока задача шла, — писать уже некому
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return
+		}
+		status = taskFailureReason(err)
+	}
+	elapsed := time.Since(started)
+	as.finishAdHocRun(i, status, elapsed)
+	as.sendTaskCommandResult(chatID, fmt.Sprintf(taskCommandsMessages.finished, name, status, elapsed.Round(time.Second)), nil)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func Test_parseAdHocParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    []*TaskParam
+		wantErr bool
+	}{
+		{name: "no params", args: nil, want: nil},
+		{
+			name: "values",
+			args: []string{"schemaName=cdi_temp_user_1", "dataSetFile=/opt/diag/a=b.xls", "comment="},
+			want: []*TaskParam{
+				{ParamName: "schemaName", ParamValue: "cdi_temp_user_1"},
+				{ParamName: "dataSetFile", ParamValue: "/opt/diag/a=b.xls"},
+				{ParamName: "comment", ParamValue: ""},
+			},
+		},
+		{
+			name: "list",
+			args: []string{"entity=party", "full=true", "entity=address", "entity=contact"},
+			want: []*TaskParam{
+				{ParamName: "entity", ParamValue: []string{"party", "address", "contact"}},
+				{ParamName: "full", ParamValue: "true"},
+			},
+		},
+		{name: "no value", args: []string{"schemaName"}, wantErr: true},
+		{name: "bad name", args: []string{"<x>=1"}, wantErr: true},
+		{name: "no name", args: []string{"=1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAdHocParams(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAdHocParams() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errBadTaskParam) {
+				t.Errorf("parseAdHocParams() error = %v, want errBadTaskParam", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAdHocParams() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_activeSession_handleTask(t *testing.T) {
+	defer func(tasks []string) { adHocTasks = tasks }(adHocTasks)
+	adHocTasks = []string{"enginesFullRebuild", "importDataSetTask"}
+	owner := &tgbotapi.Update{Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1}, From: &tgbotapi.User{ID: 1}}}
+	stranger := &tgbotapi.Update{Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 2}, From: &tgbotapi.User{ID: 2}}}
+	cdi := &testCdiChecker{fail: "broken.xls"}
+	as := newASFromFields(fields{user: newTelegramUser("1", 1), status: ACTIVE, q: newSessionsQueue()})
+	as.cdi = cdi
+
+	as.handleTask(*owner, []string{"enginesFullRebuild"})
+	as.setStandReady()
+	as.handleTask(*stranger, []string{"enginesFullRebuild"})
+	as.handleTask(*owner, []string{"dropSchema"})
+	as.handleTask(*owner, []string{"importDataSetTask", "dataSetFile"})
+	as.handleTask(*owner, []string{"enginesFullRebuild"})
+	as.handleTask(*owner, []string{"importDataSetTask", "dataSetFile=broken.xls"})
+	cancel := func() {}
+	as.setCancelTasks(cancel)
+	as.handleTask(*owner, []string{"enginesFullRebuild"})
+	as.setCancelTasks(nil)
+
+	// до готовности стенда, чужим, не из списка, с кривыми параметрами и поверх другой задачи не запускаем
+	want := []string{"enginesFullRebuild", "importDataSetTask dataSetFile=broken.xls"}
+	if !reflect.DeepEqual(cdi.runs, want) {
+		t.Errorf("TaskWS calls = %v, want %v", cdi.runs, want)
+	}
+	if len(as.adHocRuns) != 2 || as.adHocRuns[0].status != "FINISHED: done" || as.adHocRuns[1].status != "ERROR: failed" {
+		t.Errorf("history = %+v", as.adHocRuns)
+	}
+	summary := as.adHocSummary()
+	if !strings.Contains(summary, "enginesFullRebuild: FINISHED: done") || !strings.Contains(summary, "importDataSetTask dataSetFile=broken.xls: ERROR: failed") {
+		t.Errorf("adHocSummary() = %q", summary)
+	}
+	if as.cancelTasks != nil {
+		t.Errorf("the task from the chat still holds the stand")
+	}
+
+	as.deactivate()
+	if as.adHocRuns != nil {
+		t.Errorf("history is kept after the session: %+v", as.adHocRuns)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Запросы к TaskWS. Раньше конверт собирался через text/template, и значение параметра с <, & или кавычками
+// ломало XML, а то и дописывало в запрос что-то свое. Теперь запросы — структуры, их экранирует encoding/xml.
+// Значения параметров задач бывают:
+// * строка
+// * число (int*, uint*, float*)
+// * bool – true/false
+// * время – time.Time как xs:dateTime, taskDate как xs:date
+// * список из этого всего – слайс, каждое значение в своем <value>
+
+const soapEnvelopeNS = "http://schemas.xmlsoap.org/soap/envelope/"
+
+var errBadTaskParam = errors.New("bad task parameter")
+
+// taskDate is the parameter value which is sent as a date without time
+type taskDate struct {
+	time.Time
+}
+
+type soapEnvelope struct {
+	XMLName   xml.Name `xml:"soapenv:Envelope"`
+	SoapenvNS string   `xml:"xmlns:soapenv,attr"`
+	NS        string   `xml:"xmlns,attr"`
+	Header    struct{} `xml:"soapenv:Header"`
+	Body      struct {
+		Request interface{}
+	} `xml:"soapenv:Body"`
+}
+
+type executeTaskRequest struct {
+	XMLName    xml.Name        `xml:"executeTaskRequest"`
+	Name       string          `xml:"name"`
+	Parameters []taskParameter `xml:"parameters"`
+}
+
+type taskParameter struct {
+	Name   string   `xml:"name,attr"`
+	Values []string `xml:"value"`
+}
+
+// taskIDRequest is getTaskStatusRequest: only the id of the task
+type taskIDRequest struct {
+	XMLName xml.Name
+	ID      string `xml:",chardata"`
+}
+
+func newTaskIDRequest(operation, id string) taskIDRequest {
+	return taskIDRequest{XMLName: xml.Name{Local: operation}, ID: id}
+}
+
+// marshalEnvelope wraps the request into the SOAP envelope with the namespace of the TaskWS version
+func marshalEnvelope(namespace string, request interface{}) ([]byte, error) {
+	envelope := soapEnvelope{SoapenvNS: soapEnvelopeNS, NS: namespace}
+	envelope.Body.Request = request
+	res, err := xml.Marshal(envelope)
+	if err != nil {
+		return nil, fmt.Errorf("TaskWS request %T: %w", request, err)
+	}
+	return append([]byte(xml.Header), res...), nil
+}
+
+func newExecuteTaskRequest(name string, params []*TaskParam) (*executeTaskRequest, error) {
+	res := &executeTaskRequest{Name: name, Parameters: make([]taskParameter, 0, len(params))}
+	for _, p := range params {
+		values, err := formatParamValue(p.ParamValue)
+		if err != nil {
+			return nil, fmt.Errorf("%w %s of %s: %v", errBadTaskParam, p.ParamName, name, err)
+		}
+		res.Parameters = append(res.Parameters, taskParameter{Name: p.ParamName, Values: values})
+	}
+	return res, nil
+}
+
+// formatParamValue returns the text of each <value> of the parameter
+func formatParamValue(value interface{}) ([]string, error) {
+	if value == nil {
+		return nil, errors.New("no value")
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		s, err := formatScalarValue(value)
+		if err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	}
+	res := make([]string, 0, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		s, err := formatScalarValue(v.Index(i).Interface())
+		if err != nil {
+			return nil, fmt.Errorf("item %d: %w", i, err)
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+func formatScalarValue(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case time.Time:
+		return value.Format(time.RFC3339), nil
+	case taskDate:
+		return value.Format("2006-01-02"), nil
+	case *taskDate, *time.Time:
+		return "", fmt.Errorf("pointer %T, pass the value", value)
+	}
+	if value == nil {
+		return "", errors.New("no value")
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return "", fmt.Errorf("not a number %v", f)
+		}
+		return strconv.FormatFloat(f, 'f', -1, v.Type().Bits()), nil
+	}
+	return "", fmt.Errorf("unsupported type %T", value)
+}
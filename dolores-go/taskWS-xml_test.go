@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Автотесты на запросы к TaskWS: значения параметров, экранирование и разбор ответов, записанных со стенда, из test_data/taskws
+
+type testCustomerName string
+
+func Test_formatParamValue(t *testing.T) {
+	moscow := time.FixedZone("MSK", 3*60*60)
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    []string
+		wantErr bool
+	}{
+		{name: "string", value: `a<b & "c"`, want: []string{`a<b & "c"`}},
+		{name: "named string", value: testCustomerName("demo"), want: []string{"demo"}},
+		{name: "int", value: -42, want: []string{"-42"}},
+		{name: "uint8", value: uint8(7), want: []string{"7"}},
+		{name: "float", value: 0.25, want: []string{"0.25"}},
+		{name: "float32", value: float32(1.1), want: []string{"1.1"}},
+		{name: "bool", value: true, want: []string{"true"}},
+		{name: "time", value: time.Date(2022, 4, 6, 18, 30, 0, 0, moscow), want: []string{"2022-04-06T18:30:00+03:00"}},
+		{name: "date", value: taskDate{time.Date(2022, 4, 6, 18, 30, 0, 0, moscow)}, want: []string{"2022-04-06"}},
+		{name: "list", value: []string{"party", "address"}, want: []string{"party", "address"}},
+		{name: "mixed list", value: []interface{}{1, "a", false}, want: []string{"1", "a", "false"}},
+		{name: "empty list", value: []int{}, want: []string{}},
+		{name: "nil", value: nil, wantErr: true},
+		{name: "nan", value: math.NaN(), wantErr: true},
+		{name: "map", value: map[string]string{"a": "b"}, wantErr: true},
+		{name: "nested list", value: [][]string{{"a"}}, wantErr: true},
+		{name: "pointer", value: &time.Time{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := formatParamValue(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("formatParamValue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("formatParamValue() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// то, что увидит TaskWS в нашем запросе
+type receivedRequest struct {
+	XMLName xml.Name
+	Execute *struct {
+		XMLName    xml.Name
+		Name       string `xml:"name"`
+		Parameters []struct {
+			Name   string   `xml:"name,attr"`
+			Values []string `xml:"value"`
+		} `xml:"parameters"`
+	} `xml:"Body>executeTaskRequest"`
+}
+
+func Test_marshalEnvelope_roundTrip(t *testing.T) {
+	injection := `</value></parameters><parameters name="schemaName"><value>public`
+	request, err := newExecuteTaskRequest("importDataSetTask", []*TaskParam{
+		{ParamName: "dataSetFile", ParamValue: "/opt/diag/sql & party's <1>.xls"},
+		{ParamName: "comment", ParamValue: injection},
+		{ParamName: "entities", ParamValue: []string{"party", "address"}},
+		{ParamName: "limit", ParamValue: 1000},
+		{ParamName: "from", ParamValue: taskDate{time.Date(2022, 4, 6, 0, 0, 0, 0, time.UTC)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := marshalEnvelope(taskWSNamespace("15_3"), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got receivedRequest
+	if err := xml.Unmarshal(payload, &got); err != nil {
+		t.Fatalf("TaskWS cannot parse the request: %v\n%s", err, payload)
+	}
+	if got.XMLName.Space != soapEnvelopeNS || got.XMLName.Local != "Envelope" {
+		t.Errorf("envelope = %+v", got.XMLName)
+	}
+	if got.Execute == nil || got.Execute.XMLName.Space != "http://hflabs.ru/cdi/task/15_3" {
+		t.Fatalf("executeTaskRequest is not in the TaskWS namespace:\n%s", payload)
+	}
+	params := map[string][]string{}
+	for _, p := range got.Execute.Parameters {
+		params[p.Name] = p.Values
+	}
+	want := map[string][]string{
+		"dataSetFile": {"/opt/diag/sql & party's <1>.xls"},
+		"comment":     {injection},
+		"entities":    {"party", "address"},
+		"limit":       {"1000"},
+		"from":        {"2022-04-06"},
+	}
+	if !reflect.DeepEqual(params, want) {
+		t.Errorf("parameters = %#v, want %#v", params, want)
+	}
+
+	if _, err := newExecuteTaskRequest("importDataSetTask", []*TaskParam{{ParamName: "x", ParamValue: struct{}{}}}); !errors.Is(err, errBadTaskParam) {
+		t.Errorf("newExecuteTaskRequest() with unsupported value: %v", err)
+	}
+}
+
+// TaskWS на ответах, записанных со стенда: test_data/taskws/{версия}/, как их снять — в README.md там же.
+// На каждый запрос — свой файл, на задачу unknown — SOAP Fault
+var capturedResponses = map[string]string{
+	"executeTaskRequest":   "execute-response.xml",
+	"getTaskStatusRequest": "status-response.xml",
+}
+
+func newCapturedTaskWS(t *testing.T, dir, version string) *connectToCdi {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Body struct {
+				Request struct {
+					XMLName xml.Name
+					Name    string `xml:"name"`
+				} `xml:",any"`
+			}
+		}
+		payload, _ := io.ReadAll(r.Body)
+		if err := xml.Unmarshal(payload, &request); err != nil {
+			t.Errorf("bad request: %v", err)
+		}
+		name, ok := capturedResponses[request.Body.Request.XMLName.Local]
+		if !ok || request.Body.Request.Name == "unknown" {
+			name = "fault-response.xml"
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Error(err)
+		}
+		_, _ = w.Write(content)
+	}))
+	t.Cleanup(server.Close)
+	cdi := newTestConnectToCdi(t)
+	cdi.baseURL = server.URL
+	cdi.version = version
+	cdi.pollInterval = time.Millisecond
+	return cdi
+}
+
+// Ответы, написанные руками, проверяли бы только сами себя, поэтому версию без записанных ответов пропускаем
+func Test_capturedResponses(t *testing.T) {
+	for _, version := range configuredTaskWSVersions {
+		t.Run(version, func(t *testing.T) {
+			dir := filepath.Join("test_data", "taskws", version)
+			for _, name := range []string{"execute-response.xml", "status-response.xml", "fault-response.xml"} {
+				if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+					t.Skipf("no captured %s of TaskWS %s, see test_data/taskws/README.md", name, version)
+				}
+			}
+			cdi := newCapturedTaskWS(t, dir, version)
+			ctx := context.Background()
+
+			status, err := cdi.runTaskAndWait(ctx, "enginesFullRebuild", nil, nil)
+			var failed *taskFailedError
+			if err != nil && !errors.As(err, &failed) {
+				t.Errorf("runTaskAndWait() = %q, %v", status, err)
+			}
+			var fault *soapFault
+			if _, err := cdi.runTaskAndWait(ctx, "unknown", nil, nil); !errors.As(err, &fault) || fault.String == "" {
+				t.Errorf("runTaskAndWait() of the unknown task: %v", err)
+			}
+		})
+	}
+}
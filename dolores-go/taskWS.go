@@ -2,54 +2,99 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
-	"text/template"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 // Код для вызова задач CDI по API
 
-// Шаблон для запроса "запусти задачу такую-то"
-var executeTemplate = `
-<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns="http://hflabs.ru/cdi/task/15_3">
-    <soapenv:Header/>
-    <soapenv:Body>
-        <executeTaskRequest>
-            <name>{{.Name}}</name>
-            {{range .TaskParams}}
-            <parameters name="{{.ParamName}}">
-            <value>{{.ParamValue}}</value>
-            </parameters>
-            {{end}}
-        </executeTaskRequest>
-    </soapenv:Body>
-</soapenv:Envelope>
-`
-
-// Шаблон для запроса проверки статуса работы задачи
-var statusTemplate = `
-<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns="http://hflabs.ru/cdi/task/15_3">
-   <soapenv:Header/>
-   <soapenv:Body>
-      <getTaskStatusRequest>{{.ID}}</getTaskStatusRequest>
-   </soapenv:Body>
-</soapenv:Envelope>
-`
+const (
+	// больше ответ TaskWS не читаем, там только id или статус задачи
+	maxResponseSize = 1 << 20
+	// столько ответа показываем в ошибке, если статус не 200
+	maxBodyExcerpt = 200
+)
 
+// Ошибки TaskWS. Раньше doRequest их только логировал, и задача падала с пустым статусом ": "
 var (
-	tmplExecute = template.Must(template.New("execute").Parse(executeTemplate))
-	tmplStatus  = template.Must(template.New("status").Parse(statusTemplate))
+	// запрос не ушел или ответ не дочитали: ЕК не поднялся, упал, сеть
+	errTaskWSTransport = errors.New("TaskWS is unavailable")
+	// ответ пришел, но это не то, что мы ждали
+	errTaskWSDecode = errors.New("bad TaskWS response")
+	// стенд не отдает ни одну из версий TaskWS, которые мы знаем
+	errTaskWSUnsupported = errors.New("no supported TaskWS version")
 )
 
-// WSApi interface to work with CDI api
+// httpStatusError is the non-200 response without SOAP Fault in it
+type httpStatusError struct {
+	Status string
+	// the start of the body, to see what answered: the proxy, the login page, the stack trace
+	Body string
+}
+
+func (e *httpStatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("TaskWS: HTTP %s", e.Status)
+	}
+	return fmt.Sprintf("TaskWS: HTTP %s: %s", e.Status, e.Body)
+}
+
+// soapFault is the SOAP 1.1 Fault from TaskWS, for example the unknown task or the bad parameter
+type soapFault struct {
+	Code   string `xml:"faultcode"`
+	String string `xml:"faultstring"`
+}
+
+func (e *soapFault) Error() string {
+	return fmt.Sprintf("TaskWS: SOAP Fault %s: %s", e.Code, e.String)
+}
+
+// taskTimeoutError is the task which is still running when its timeout is over.
+// The task is not stopped: it goes on on the stand, the user can stop it in the UI of the stand
+type taskTimeoutError struct {
+	Name    string
+	ID      string
+	Elapsed time.Duration
+}
+
+func (e *taskTimeoutError) Error() string {
+	return fmt.Sprintf("task %s (%s) is still running after %v", e.Name, e.ID, e.Elapsed.Round(time.Second))
+}
+
+func (e *taskTimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// taskFailedError is the task which CDI finished not successfully
+type taskFailedError struct {
+	Status string
+	Desc   string
+}
+
+func (e *taskFailedError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Status, e.Desc)
+}
+
+// the beginning of the body in one line
+func bodyExcerpt(body []byte) string {
+	res := strings.Join(strings.Fields(string(body)), " ")
+	if runes := []rune(res); len(runes) > maxBodyExcerpt {
+		return string(runes[:maxBodyExcerpt]) + "…"
+	}
+	return res
+}
+
+// WSApi interface to work with CDI api: the response of TaskWS, see taskWS-xml.go for the requests
 type WSApi interface {
-	createRequest(tmpl *template.Template) []byte
-	parseResponse(body io.Reader)
+	parseResponse(body io.Reader) error
 }
 
 // Task struct to store task fields
@@ -65,36 +110,32 @@ type Task struct {
 
 // TaskParam parameters of the task
 type TaskParam struct {
-	ParamName  string
+	ParamName string
+	// string, number, bool, time.Time, taskDate or the slice of them, see taskWS-xml.go
 	ParamValue interface{}
 }
 
-// Создаем реквест
-func (t *Task) createRequest(tmpl *template.Template) []byte {
-	var res bytes.Buffer
-	if err := tmpl.Execute(&res, t); err != nil {
-		log.Println(err)
-	}
-
-	return res.Bytes()
-}
-
 // Проверяем ответ
-func (t *Task) parseResponse(body io.Reader) {
-	err := xml.NewDecoder(body).Decode(t)
-	if err != nil {
-		log.Println(err)
-	}
+func (t *Task) parseResponse(body io.Reader) error {
+	return decodeXML(body, t)
 }
 
-// Метод для выполнения запроса
-func (cdi *connectToCdi) doRequest(api WSApi, tmpl *template.Template) {
+// Метод для выполнения запроса. Ошибки:
+// * errTaskWSTransport – запрос не дошел или ответ не дочитали
+// * *soapFault – TaskWS ответил ошибкой, обычно вместе с HTTP 500
+// * *httpStatusError – не 200 и не SOAP, например прокси или страница логина
+// * errTaskWSDecode – ответ не разобрали
+func (cdi *connectToCdi) doRequest(ctx context.Context, request interface{}, api WSApi) error {
 	httpMethod := "POST"
-	payload := api.createRequest(tmpl)
+	version := cdi.getVersion()
+	payload, err := marshalEnvelope(taskWSNamespace(version), request)
+	if err != nil {
+		return err
+	}
 
-	r, err := http.NewRequest(httpMethod, cdi.url, bytes.NewReader(payload))
+	r, err := http.NewRequestWithContext(ctx, httpMethod, cdi.endpoint(version), bytes.NewReader(payload))
 	if err != nil {
-		log.Println(err)
+		return fmt.Errorf("TaskWS request %T: %w", request, err)
 	}
 
 	r.Header.Set("Content-type", "text/xml")
@@ -102,19 +143,40 @@ func (cdi *connectToCdi) doRequest(api WSApi, tmpl *template.Template) {
 
 	resp, err := cdi.client.Do(r)
 	if err != nil {
-		log.Println(err)
-		return
+		// запрос оборвали сами: кончилось время задачи или закрыли сессию
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%w: %v", errTaskWSTransport, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errTaskWSTransport, err)
+	}
+
+	var fault struct {
+		Fault *soapFault `xml:"Body>Fault"`
+	}
+	if xml.Unmarshal(body, &fault) == nil && fault.Fault != nil {
+		return fault.Fault
 	}
 	if resp.StatusCode != http.StatusOK {
-		log.Println(err)
+		return &httpStatusError{Status: resp.Status, Body: bodyExcerpt(body)}
 	}
-	defer resp.Body.Close()
 
-	api.parseResponse(resp.Body)
+	return api.parseResponse(bytes.NewReader(body))
 }
 
 type cdiChecker interface {
-	runTaskAndWait(taskName string, taskParams []*TaskParam) (string, bool)
+	// runTaskAndWait returns the final status of the finished task,
+	// or the error: TaskWS failure (see doRequest), *taskFailedError, *taskTimeoutError if ctx deadline is over
+	// (the task still runs on the stand then) or ctx.Err() if it is cancelled. progress is called every progressInterval while the task is running
+	runTaskAndWait(ctx context.Context, taskName string, taskParams []*TaskParam, progress func(id string, elapsed time.Duration)) (string, error)
+	// useVersion chooses the TaskWS version the stand has, the preferred one if possible
+	useVersion(ctx context.Context, preferred string) (string, error)
+	// uiAvailable returns nil when CDI of the stand is started
+	uiAvailable(ctx context.Context) error
 }
 
 // Создаем новое соединение
@@ -122,58 +184,325 @@ type connectToCdi struct {
 	client   *http.Client
 	username string
 	password string
-	url      string
+	// scheme://host:port of the stand
+	baseURL string
+	// TaskWS version, see taskWSVersions
+	mu      sync.RWMutex
+	version string
+	// how often to check the status of the running task: pollInterval first,
+	// then twice as rare after each check, but not rarer than maxPollInterval
+	pollInterval    time.Duration
+	maxPollInterval time.Duration
+	// how often to tell that the task is still running
+	progressInterval time.Duration
+}
+
+func decodeXML(body io.Reader, v interface{}) error {
+	if err := xml.NewDecoder(body).Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", errTaskWSDecode, err)
+	}
+	return nil
 }
 
-func newConnectToCdi(username, password, domain, port string) *connectToCdi {
+// newConnectToCdi makes the client of the stand, see cdi-stand.go
+func newConnectToCdi(stand cdiStand) (*connectToCdi, error) {
+	client, err := newCdiHTTPClient(stand)
+	if err != nil {
+		return nil, err
+	}
 	return &connectToCdi{
-		client: &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true, //nolint:gosec
-				},
-			},
-		},
-		username: username,
-		password: password,
-		url:      fmt.Sprintf("http://%s:%s/cdi/soap/services/15_3/TaskWS", domain, port),
+		client:           client,
+		username:         stand.username,
+		password:         stand.password,
+		baseURL:          stand.baseURL(),
+		version:          defaultTaskWSVersion(),
+		pollInterval:     taskPollInterval,
+		maxPollInterval:  taskMaxPollInterval,
+		progressInterval: taskProgressInterval,
+	}, nil
+}
+
+// uiAvailable checks that the login page of the stand answers, CDI is started then
+func (cdi *connectToCdi) uiAvailable(ctx context.Context) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, cdi.baseURL+"/cdi/ui", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := cdi.client.Do(r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errTaskWSTransport, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+		return &httpStatusError{Status: resp.Status, Body: bodyExcerpt(body)}
 	}
+	return nil
 }
 
 // Для запуска задачи нужно будет выполнить doRequest
-func (t *Task) run() {
-	t.cdi.doRequest(t, tmplExecute)
+func (t *Task) run(ctx context.Context) error {
+	t.ID = ""
+	request, err := newExecuteTaskRequest(t.Name, t.TaskParams)
+	if err != nil {
+		return err
+	}
+	err = t.cdi.doRequest(ctx, request, t)
 	t.TimeStamp = time.Now()
+	if err == nil && t.ID == "" {
+		err = fmt.Errorf("%w: no task id in executeTaskResponse", errTaskWSDecode)
+	}
+	return err
 }
 
 // Для проверки статуса — метод checkStatus
-func (t *Task) checkStatus() {
-	t.cdi.doRequest(t, tmplStatus)
+func (t *Task) checkStatus(ctx context.Context) error {
+	t.Status, t.Desc = "", ""
+	err := t.cdi.doRequest(ctx, newTaskIDRequest("getTaskStatusRequest", t.ID), t)
 	t.TimeStamp = time.Now()
+	if err == nil && t.Status == "" {
+		err = fmt.Errorf("%w: no state in getTaskStatusResponse", errTaskWSDecode)
+	}
+	return err
 }
 
-// Запускаем задачи — выполяем функции run() и checkStatus(). Статус выверяем
-func (cdi *connectToCdi) runTaskAndWait(taskName string, taskParams []*TaskParam) (string, bool) {
+// Запускаем задачи — выполяем функции run() и checkStatus(). Статус выверяем.
+// Статус спрашиваем все реже, а ждем не дольше, чем позволяет ctx
+func (cdi *connectToCdi) runTaskAndWait(ctx context.Context, taskName string, taskParams []*TaskParam, progress func(id string, elapsed time.Duration)) (string, error) {
 	task := &Task{
 		cdi:        cdi,
 		Name:       taskName,
 		TaskParams: taskParams,
 	}
-	task.run()
+	started := time.Now()
+	// ошибку ctx превращаем в понятную: время вышло или сессию закрыли
+	stopped := func(err error) error {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return &taskTimeoutError{Name: taskName, ID: task.ID, Elapsed: time.Since(started)}
+		}
+		return fmt.Errorf("%s (%s) is not waited for: %w", taskName, task.ID, err)
+	}
+	if err := task.run(ctx); err != nil {
+		if ctx.Err() != nil {
+			return "", stopped(err)
+		}
+		return "", fmt.Errorf("start %s: %w", taskName, err)
+	}
+	interval := cdi.pollInterval
+	nextProgress := started.Add(cdi.progressInterval)
 	for {
-		time.Sleep(5 * time.Second)
-		task.checkStatus()
+		select {
+		case <-ctx.Done():
+			return "", stopped(ctx.Err())
+		case <-time.After(interval):
+		}
+		if err := task.checkStatus(ctx); err != nil {
+			if ctx.Err() != nil {
+				return "", stopped(err)
+			}
+			return "", fmt.Errorf("status of %s (%s): %w", taskName, task.ID, err)
+		}
 		switch task.Status {
 		case "RUNNING":
+			if progress != nil && cdi.progressInterval > 0 && !time.Now().Before(nextProgress) {
+				progress(task.ID, time.Since(started))
+				nextProgress = nextProgress.Add(cdi.progressInterval)
+			}
+			interval *= 2
+			if interval > cdi.maxPollInterval {
+				interval = cdi.maxPollInterval
+			}
 			continue
-		case "FINISHED":
-			return fmt.Sprintf("%s: %s", task.Status, task.Desc), true
-		case "SKIPPED":
-			return fmt.Sprintf("%s: %s", task.Status, task.Desc), true
-		case "ERROR":
-			return fmt.Sprintf("%s: %s", task.Status, task.Desc), false
+		case "FINISHED", "SKIPPED":
+			return fmt.Sprintf("%s: %s", task.Status, task.Desc), nil
 		default:
-			return fmt.Sprintf("%s: %s", task.Status, task.Desc), false
+			return "", &taskFailedError{Status: task.Status, Desc: task.Desc}
+		}
+	}
+}
+
+func taskWSNamespace(version string) string {
+	return "http://hflabs.ru/cdi/task/" + version
+}
+
+func (cdi *connectToCdi) endpoint(version string) string {
+	return fmt.Sprintf("%s/cdi/soap/services/%s/TaskWS", cdi.baseURL, version)
+}
+
+func (cdi *connectToCdi) getVersion() string {
+	cdi.mu.RLock()
+	defer cdi.mu.RUnlock()
+	return cdi.version
+}
+
+// the version from the profile or the newest known one
+func defaultTaskWSVersion() string {
+	if taskWSVersion != "" {
+		return taskWSVersion
+	}
+	return newestVersion(taskWSVersions)
+}
+
+func newestVersion(versions []string) string {
+	res := ""
+	for _, v := range versions {
+		if res == "" || compareVersions(v, res) > 0 {
+			res = v
+		}
+	}
+	return res
+}
+
+// taskWSVersionFor is the TaskWS version for the application: the one from the profile
+// or the newest known which is not newer than the factor version, "" if unknown
+func taskWSVersionFor(versions *applicationVersions) string {
+	if taskWSVersion != "" {
+		return taskWSVersion
+	}
+	if versions == nil || versions.FactorTagVersion == "" {
+		return ""
+	}
+	var older []string
+	for _, v := range taskWSVersions {
+		if compareVersions(v, versions.FactorTagVersion) <= 0 {
+			older = append(older, v)
+		}
+	}
+	return newestVersion(older)
+}
+
+// compare the versions like 15_3 and 20.12 by the numbers, not the digits
+func compareVersions(a, b string) int {
+	split := func(v string) []string {
+		return strings.FieldsFunc(v, func(r rune) bool { return r == '.' || r == '_' || r == '-' })
+	}
+	as, bs := split(a), split(b)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		switch {
+		case aErr != nil || bErr != nil:
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+		case an != bn:
+			if an < bn {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
+
+// probeVersions asks the stand for WSDL of every known TaskWS version and returns the ones it has
+func (cdi *connectToCdi) probeVersions(ctx context.Context) ([]string, error) {
+	var res []string
+	for _, version := range taskWSVersions {
+		resp, body, err := cdi.get(ctx, cdi.endpoint(version)+"?wsdl")
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK && bytes.Contains(body, []byte(taskWSNamespace(version))) {
+			res = append(res, version)
+		}
+	}
+	return res, nil
+}
+
+// get reads the body of GET url, the status is not checked
+func (cdi *connectToCdi) get(ctx context.Context, url string) (*http.Response, []byte, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.SetBasicAuth(cdi.username, cdi.password)
+	resp, err := cdi.client.Do(r)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, fmt.Errorf("%w: %v", errTaskWSTransport, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errTaskWSTransport, err)
+	}
+	return resp, body, nil
+}
+
+// useVersion probes the stand and switches to the preferred TaskWS version if the stand has it,
+// otherwise to the newest one the stand has. Returns the version in use
+func (cdi *connectToCdi) useVersion(ctx context.Context, preferred string) (string, error) {
+	supported, err := cdi.probeVersions(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(supported) == 0 {
+		return "", fmt.Errorf("%w: tried %s", errTaskWSUnsupported, strings.Join(taskWSVersions, ", "))
+	}
+	version := preferred
+	if !containsString(supported, preferred) {
+		version = newestVersion(supported)
+	}
+	cdi.mu.Lock()
+	defer cdi.mu.Unlock()
+	cdi.version = version
+	return version, nil
+}
+
+var taskWSMessages = struct {
+	transport   string
+	httpStatus  string
+	fault       string
+	decode      string
+	timeout     string
+	notStarted  string
+	unsupported string
+}{
+	transport:   "ЕК не отвечает на запрос к TaskWS",
+	httpStatus:  "TaskWS ответил HTTP %s: %s",
+	fault:       "TaskWS вернул ошибку %s: %s",
+	decode:      "Не поняла ответ TaskWS",
+	timeout:     "Задача %s (id %s) не закончилась за %d мин, больше не жду. Она еще идет на стенде, остановить ее можно в UI",
+	notStarted:  "Задача %s не запустилась за %d мин",
+	unsupported: "Стенд не отдает ни одну из версий TaskWS, которые я знаю: %s",
+}
+
+// taskFailureReason is the reason of the failure for the user
+func taskFailureReason(err error) string {
+	var (
+		failed  *taskFailedError
+		timeout *taskTimeoutError
+		fault   *soapFault
+		status  *httpStatusError
+	)
+	switch {
+	case errors.As(err, &failed):
+		return failed.Error()
+	case errors.As(err, &timeout):
+		minutes := int(timeout.Elapsed.Minutes())
+		if timeout.ID == "" {
+			return fmt.Sprintf(taskWSMessages.notStarted, timeout.Name, minutes)
 		}
+		return fmt.Sprintf(taskWSMessages.timeout, timeout.Name, timeout.ID, minutes)
+	case errors.As(err, &fault):
+		return fmt.Sprintf(taskWSMessages.fault, fault.Code, fault.String)
+	case errors.As(err, &status):
+		return fmt.Sprintf(taskWSMessages.httpStatus, status.Status, status.Body)
+	case errors.Is(err, errTaskWSUnsupported):
+		return fmt.Sprintf(taskWSMessages.unsupported, strings.Join(taskWSVersions, ", "))
+	case errors.Is(err, errTaskWSTransport):
+		return fmt.Sprintf("%s: %v", taskWSMessages.transport, err)
+	case errors.Is(err, errTaskWSDecode):
+		return fmt.Sprintf("%s: %v", taskWSMessages.decode, err)
 	}
+	return err.Error()
 }
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Автотесты на клиент TaskWS: сервер отвечает на запуск задачи и на первый запрос статуса
+
+const (
+	executeResponse = `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>
+<executeTaskResponse xmlns="http://hflabs.ru/cdi/task/15_3"><id>42</id></executeTaskResponse>
+</soap:Body></soap:Envelope>`
+	statusResponse = `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>
+<getTaskStatusResponse xmlns="http://hflabs.ru/cdi/task/15_3"><state>%s</state><description>%s</description></getTaskStatusResponse>
+</soap:Body></soap:Envelope>`
+	faultResponse = `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>
+<soap:Fault><faultcode>soap:Client</faultcode><faultstring>Task LoadParty not found</faultstring></soap:Fault>
+</soap:Body></soap:Envelope>`
+)
+
+// the client of the plain http stand, the tests point it to their server through baseURL
+func newTestConnectToCdi(t *testing.T) *connectToCdi {
+	cdi, err := newConnectToCdi(cdiStand{scheme: "http", host: "localhost", port: "8080", username: "user", password: "password", timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cdi
+}
+
+type taskWSReply struct {
+	code int
+	body string
+}
+
+func newTestTaskWS(t *testing.T, execute, status taskWSReply) *connectToCdi {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := io.ReadAll(r.Body)
+		reply := status
+		if strings.Contains(string(payload), "executeTaskRequest") {
+			reply = execute
+		}
+		w.WriteHeader(reply.code)
+		fmt.Fprint(w, reply.body)
+	}))
+	t.Cleanup(server.Close)
+	cdi := newTestConnectToCdi(t)
+	cdi.baseURL = server.URL
+	cdi.pollInterval = time.Millisecond
+	return cdi
+}
+
+func Test_connectToCdi_runTaskAndWait(t *testing.T) {
+	ok := taskWSReply{http.StatusOK, executeResponse}
+	tests := []struct {
+		name       string
+		execute    taskWSReply
+		status     taskWSReply
+		want       string
+		wantErr    func(err error) bool
+		wantReason string
+	}{
+		{
+			name:    "finished",
+			execute: ok,
+			status:  taskWSReply{http.StatusOK, fmt.Sprintf(statusResponse, "FINISHED", "loaded 10 parties")},
+			want:    "FINISHED: loaded 10 parties",
+		},
+		{
+			name:       "task error",
+			execute:    ok,
+			status:     taskWSReply{http.StatusOK, fmt.Sprintf(statusResponse, "ERROR", "bad file")},
+			wantErr:    func(err error) bool { var e *taskFailedError; return errors.As(err, &e) },
+			wantReason: "ERROR: bad file",
+		},
+		{
+			name:       "soap fault",
+			execute:    taskWSReply{http.StatusInternalServerError, faultResponse},
+			wantErr:    func(err error) bool { var e *soapFault; return errors.As(err, &e) && e.Code == "soap:Client" },
+			wantReason: "TaskWS вернул ошибку soap:Client: Task LoadParty not found",
+		},
+		{
+			name:       "http status",
+			execute:    taskWSReply{http.StatusBadGateway, "<html>\n  <h1>502 Bad Gateway</h1>\n</html>"},
+			wantErr:    func(err error) bool { var e *httpStatusError; return errors.As(err, &e) },
+			wantReason: "TaskWS ответил HTTP 502 Bad Gateway: <html> <h1>502 Bad Gateway</h1> </html>",
+		},
+		{
+			name:       "not xml",
+			execute:    taskWSReply{http.StatusOK, "Login page"},
+			wantErr:    func(err error) bool { return errors.Is(err, errTaskWSDecode) },
+			wantReason: "Не поняла ответ TaskWS",
+		},
+		{
+			name:       "no state",
+			execute:    ok,
+			status:     taskWSReply{http.StatusOK, executeResponse},
+			wantErr:    func(err error) bool { return errors.Is(err, errTaskWSDecode) },
+			wantReason: "Не поняла ответ TaskWS",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cdi := newTestTaskWS(t, tt.execute, tt.status)
+			got, err := cdi.runTaskAndWait(context.Background(), "LoadParty", []*TaskParam{{ParamName: "file", ParamValue: "/opt/diag/sql.party.xls"}}, nil)
+			if tt.wantErr == nil {
+				if err != nil || got != tt.want {
+					t.Errorf("runTaskAndWait() = %q, %v, want %q", got, err, tt.want)
+				}
+				return
+			}
+			if !tt.wantErr(err) {
+				t.Fatalf("runTaskAndWait() error = %v", err)
+			}
+			if reason := taskFailureReason(err); !strings.HasPrefix(reason, tt.wantReason) {
+				t.Errorf("taskFailureReason() = %q, want %q", reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func Test_connectToCdi_unavailable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	cdi := newTestConnectToCdi(t)
+	cdi.baseURL = server.URL
+	_, err := cdi.runTaskAndWait(context.Background(), "LoadParty", nil, nil)
+	if !errors.Is(err, errTaskWSTransport) {
+		t.Fatalf("runTaskAndWait() error = %v, want errTaskWSTransport", err)
+	}
+	if reason := taskFailureReason(err); !strings.HasPrefix(reason, "ЕК не отвечает") {
+		t.Errorf("taskFailureReason() = %q", reason)
+	}
+}
+
+func Test_connectToCdi_runTaskAndWait_deadline(t *testing.T) {
+	var checks int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(payload), "executeTaskRequest") {
+			fmt.Fprint(w, executeResponse)
+			return
+		}
+		// задачу по таймауту не останавливаем: на стенде только статус
+		if !strings.Contains(string(payload), "getTaskStatusRequest") {
+			t.Errorf("unexpected request after timeout: %s", payload)
+		}
+		atomic.AddInt32(&checks, 1)
+		fmt.Fprintf(w, statusResponse, "RUNNING", "")
+	}))
+	defer server.Close()
+	cdi := newTestConnectToCdi(t)
+	cdi.baseURL = server.URL
+	cdi.version = "15_3"
+	cdi.pollInterval = time.Millisecond
+	cdi.maxPollInterval = time.Hour
+	cdi.progressInterval = 20 * time.Millisecond
+
+	var reports []time.Duration
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := cdi.runTaskAndWait(ctx, "enginesFullRebuild", nil, func(id string, elapsed time.Duration) {
+		reports = append(reports, elapsed)
+	})
+	var timeout *taskTimeoutError
+	if !errors.As(err, &timeout) || timeout.ID != "42" || timeout.Name != "enginesFullRebuild" || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("runTaskAndWait() error = %v, want taskTimeoutError", err)
+	}
+	// 1, 2, 4, ... 128 мс — без backoff за 200 мс было бы около двухсот запросов
+	if n := atomic.LoadInt32(&checks); n > 10 {
+		t.Errorf("status checked %d times, no backoff", n)
+	}
+	if len(reports) == 0 {
+		t.Errorf("no progress reports")
+	}
+	want := "Задача enginesFullRebuild (id 42) не закончилась за 0 мин, больше не жду. Она еще идет на стенде, остановить ее можно в UI"
+	if reason := taskFailureReason(err); reason != want {
+		t.Errorf("taskFailureReason() = %q, want %q", reason, want)
+	}
+
+	// сессию закрыли — это не таймаут
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = cdi.runTaskAndWait(ctx, "enginesFullRebuild", nil, nil)
+	if !errors.Is(err, context.Canceled) || errors.As(err, &timeout) {
+		t.Errorf("runTaskAndWait() after cancel: %v", err)
+	}
+}
+
+func Test_bodyExcerpt(t *testing.T) {
+	long := strings.Repeat("я", maxBodyExcerpt+10)
+	if got := bodyExcerpt([]byte(long)); got != strings.Repeat("я", maxBodyExcerpt)+"…" {
+		t.Errorf("bodyExcerpt() of the long body = %q", got)
+	}
+	if got := bodyExcerpt([]byte(" a\n\tb ")); got != "a b" {
+		t.Errorf("bodyExcerpt() = %q, want %q", got, "a b")
+	}
+}
+
+func Test_compareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"15_3", "15.3", 0},
+		{"15_3", "20.12", -1},
+		{"20.12", "20.6", 1},
+		{"21_4", "21.19", -1},
+		{"20", "20.1", -1},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func Test_taskWSVersionFor(t *testing.T) {
+	taskWSVersions = []string{"15_3", "21_4", "20_6"}
+	defer func() { taskWSVersions = nil }()
+	tests := []struct {
+		name    string
+		profile string
+		factor  string
+		want    string
+	}{
+		{name: "newest not newer", factor: "20.12", want: "20_6"},
+		{name: "same", factor: "21.4", want: "21_4"},
+		{name: "newer than all", factor: "22.1", want: "21_4"},
+		{name: "older than all", factor: "14.9", want: ""},
+		{name: "unknown", factor: "", want: ""},
+		{name: "profile", profile: "15_3", factor: "21.19", want: "15_3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taskWSVersion = tt.profile
+			defer func() { taskWSVersion = "" }()
+			if got := taskWSVersionFor(&applicationVersions{FactorTagVersion: tt.factor}); got != tt.want {
+				t.Errorf("taskWSVersionFor() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_connectToCdi_useVersion(t *testing.T) {
+	taskWSVersions = []string{"15_3", "20_6", "21_4"}
+	defer func() { taskWSVersions = nil }()
+	// стенд отдает 15_3 и 20_6, на 21_4 — страница логина
+	requests := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, version := range []string{"15_3", "20_6"} {
+			if r.URL.Path != "/cdi/soap/services/"+version+"/TaskWS" {
+				continue
+			}
+			if r.URL.RawQuery == "wsdl" {
+				fmt.Fprintf(w, `<definitions targetNamespace="%s"/>`, taskWSNamespace(version))
+				return
+			}
+			payload, _ := io.ReadAll(r.Body)
+			requests <- version + " " + string(payload)
+			fmt.Fprint(w, strings.ReplaceAll(executeResponse, "task/15_3", "task/"+version))
+			return
+		}
+		fmt.Fprint(w, "<html>login</html>")
+	}))
+	defer server.Close()
+	cdi := newTestConnectToCdi(t)
+	cdi.baseURL = server.URL
+	ctx := context.Background()
+
+	// по порядку: запрос ниже уходит в версию последнего вызова
+	for _, tt := range []struct{ preferred, want string }{{"15_3", "15_3"}, {"21_4", "20_6"}, {"", "20_6"}} {
+		got, err := cdi.useVersion(ctx, tt.preferred)
+		if err != nil || got != tt.want {
+			t.Errorf("useVersion(%q) = %q, %v, want %q", tt.preferred, got, err, tt.want)
+		}
+	}
+	task := &Task{cdi: cdi, Name: "enginesFullRebuild"}
+	if err := task.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// конверт с namespace той версии, на которую переключились
+	if got := <-requests; !strings.HasPrefix(got, "20_6 ") || !strings.Contains(got, `xmlns="http://hflabs.ru/cdi/task/20_6"`) {
+		t.Errorf("request = %s", got)
+	}
+
+	taskWSVersions = []string{"21_4"}
+	if _, err := cdi.useVersion(ctx, "21_4"); !errors.Is(err, errTaskWSUnsupported) {
+		t.Errorf("useVersion() without supported versions: %v", err)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Повторные загрузки. Одну и ту же диагностику часто присылают дважды — например, два тестировщика по одной задаче.
+// Каждую загрузку считаем по sha256 (см. uploads.key) и запоминаем в uploadsIndexFile: версии, собранный образ и снапшоты.
+// Если такой архив уже был, предлагаем поднять снапшот или взять готовый образ, а не разбирать и собирать все заново
+
+// callback data of the reuse button: reuse:<number of the option>, reuse:new builds from scratch
+const reuseCallbackPrefix = "reuse:"
+
+var uploadsIndex = newUploadIndex()
+
+// uploadRecord is what we know about the diagnostic with the checksum
+type uploadRecord struct {
+	SHA256 string    `json:"sha256"`
+	Files  []string  `json:"files"`
+	Users  []string  `json:"users"`
+	First  time.Time `json:"first"`
+	Last   time.Time `json:"last"`
+	Count  int       `json:"count"`
+	// the last parsed versions
+	Versions string `json:"versions,omitempty"`
+	// the image built from the diagnostic and its versions, see buildImage
+	Image         string   `json:"image,omitempty"`
+	ImageVersions string   `json:"imageVersions,omitempty"`
+	Snapshots     []string `json:"snapshots,omitempty"`
+}
+
+type uploadIndex struct {
+	mu      sync.Mutex
+	path    string
+	records map[string]*uploadRecord
+}
+
+func newUploadIndex() *uploadIndex {
+	return &uploadIndex{records: map[string]*uploadRecord{}}
+}
+
+// load reads the index from the file, no file means no uploads yet
+func (ui *uploadIndex) load(path string) error {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	ui.path = path
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var records []*uploadRecord
+	if err := json.Unmarshal(content, &records); err != nil {
+		return fmt.Errorf("bad uploads index %s: %w", path, err)
+	}
+	ui.records = map[string]*uploadRecord{}
+	for _, r := range records {
+		if r.SHA256 == "" {
+			return fmt.Errorf("bad uploads index %s: record without sha256", path)
+		}
+		ui.records[r.SHA256] = r
+	}
+	return nil
+}
+
+// save is called under the lock, the records are sorted by the first upload
+func (ui *uploadIndex) save() error {
+	if ui.path == "" {
+		return nil
+	}
+	records := make([]*uploadRecord, 0, len(ui.records))
+	for _, r := range ui.records {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].First.Before(records[j].First)
+	})
+	content, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ui.path, append(content, '\n'))
+}
+
+// get the copy of the record
+func (ui *uploadIndex) get(key string) (uploadRecord, bool) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	r, ok := ui.records[key]
+	if !ok {
+		return uploadRecord{}, false
+	}
+	res := *r
+	res.Files = append([]string{}, r.Files...)
+	res.Users = append([]string{}, r.Users...)
+	res.Snapshots = append([]string{}, r.Snapshots...)
+	return res, true
+}
+
+// update the record, creating it if needed, and save the index
+func (ui *uploadIndex) update(key string, change func(r *uploadRecord)) error {
+	if key == "" {
+		return nil
+	}
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	r, ok := ui.records[key]
+	if !ok {
+		r = &uploadRecord{SHA256: key}
+		ui.records[key] = r
+	}
+	change(r)
+	return ui.save()
+}
+
+// add the upload of the diagnostic by the user
+func (ui *uploadIndex) add(key, user string, files []string, now time.Time) error {
+	return ui.update(key, func(r *uploadRecord) {
+		if r.First.IsZero() {
+			r.First = now
+		}
+		r.Last = now
+		r.Count++
+		r.Files = files
+		if !containsString(r.Users, user) {
+			r.Users = append(r.Users, user)
+		}
+	})
+}
+
+func (ui *uploadIndex) setVersions(key, versions string) error {
+	return ui.update(key, func(r *uploadRecord) {
+		r.Versions = versions
+	})
+}
+
+func (ui *uploadIndex) setImage(key, image, versions string) error {
+	return ui.update(key, func(r *uploadRecord) {
+		r.Image = image
+		r.ImageVersions = versions
+	})
+}
+
+func (ui *uploadIndex) addSnapshot(key, name string) error {
+	return ui.update(key, func(r *uploadRecord) {
+		if !containsString(r.Snapshots, name) {
+			r.Snapshots = append(r.Snapshots, name)
+		}
+	})
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// names of the archives for the index, without the session dir
+func archiveNames(archives []string) []string {
+	res := make([]string, 0, len(archives))
+	for _, path := range archives {
+		res = append(res, filepath.Base(path))
+	}
+	return res
+}
+
+// reuseOption is what can be taken instead of the build: the snapshot or the image, nothing means build
+type reuseOption struct {
+	snapshot *snapshot
+	image    string
+	// versions of the image, the image is used only if the parsed versions are the same
+	versions string
+}
+
+// options for the known diagnostic which are still in docker, snapshots first, newest first
+func (as *activeSession) reuseOptions(record uploadRecord) []reuseOption {
+	var res []reuseOption
+	if len(record.Snapshots) != 0 {
+		snapshots, err := as.listSnapshots()
+		if err != nil {
+			log.Println(err)
+		}
+		for _, s := range snapshots {
+			if containsString(record.Snapshots, s.name) {
+				res = append(res, reuseOption{snapshot: s})
+			}
+		}
+	}
+	if record.Image != "" {
+		exists, err := as.docker.ImageExists(record.Image)
+		if err != nil {
+			log.Println(err)
+		}
+		if exists {
+			res = append(res, reuseOption{image: record.Image, versions: record.ImageVersions})
+		}
+	}
+	return res
+}
+
+func (as *activeSession) setReuseChoice(choice chan int) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.reuseChoice = choice
+}
+
+// offerReuse asks the owner what to do with the diagnostic which was uploaded before.
+// The empty option means build from scratch: there is nothing to reuse, the owner wants it or did not answer
+func (as *activeSession) offerReuse(update tgbotapi.Update, key string) reuseOption {
+	record, ok := uploadsIndex.get(key)
+	if !ok {
+		return reuseOption{}
+	}
+	chatID := update.Message.Chat.ID
+	options := as.reuseOptions(record)
+	text := fmt.Sprintf(doloresMessages.knownUpload, strings.Join(record.Users, ", "), record.Last.Format("2006-01-02 15:04"))
+	if record.Versions != "" {
+		text += fmt.Sprintf(doloresMessages.knownUploadVersions, record.Versions)
+	}
+	if len(options) == 0 {
+		_, err := as.bot.Send(newMessage(chatID, text+doloresMessages.nothingToReuse))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		return reuseOption{}
+	}
+
+	buttons := make([]inlineButton, 0, len(options)+1)
+	for i, o := range options {
+		label := fmt.Sprintf(doloresMessages.reuseImage, o.image)
+		if o.snapshot != nil {
+			label = fmt.Sprintf(doloresMessages.reuseSnapshot, o.snapshot.name)
+		}
+		buttons = append(buttons, inlineButton{text: label, action: reuseCallbackPrefix + strconv.Itoa(i)})
+	}
+	buttons = append(buttons, inlineButton{text: doloresMessages.reuseNothing, action: reuseCallbackPrefix + "new"})
+
+	choice := make(chan int, 1)
+	as.setReuseChoice(choice)
+	defer as.setReuseChoice(nil)
+	_, err := as.bot.Send(newMessageWithButtons(chatID,
+		text+fmt.Sprintf(doloresMessages.chooseReuse, int(as.choiceTimeout.Minutes())), buttons))
+	if err != nil {
+		log.Println("ERROR: ", err)
+	}
+	select {
+	case i := <-choice:
+		if i >= 0 && i < len(options) {
+			return options[i]
+		}
+	case <-time.After(as.choiceTimeout):
+		_, err := as.bot.Send(newMessage(chatID, doloresMessages.reuseTimeout))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+	}
+	return reuseOption{}
+}
+
+// the reuse button is pressed
+func (as *activeSession) handleReuseCallback(update tgbotapi.Update) {
+	userID := int64(update.CallbackQuery.From.ID)
+	data := strings.TrimPrefix(update.CallbackQuery.Data, reuseCallbackPrefix)
+	i, err := strconv.Atoi(data)
+	if data == "new" {
+		i, err = -1, nil
+	}
+	as.mu.Lock()
+	choice := as.reuseChoice
+	as.mu.Unlock()
+	if !as.isOwner(userID) || choice == nil || err != nil {
+		_, err := as.bot.Send(newMessage(userID, doloresMessages.reuseTooLate))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		return
+	}
+	// выбор принимаем только первый
+	select {
+	case choice <- i:
+	default:
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func Test_uploadIndex_addAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uploads.json")
+	index := newUploadIndex()
+	if err := index.load(path); err != nil {
+		t.Fatal(err)
+	}
+	first := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	second := first.Add(time.Hour)
+	if err := index.add("abc", "tester1", []string{"diag.zip"}, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.add("abc", "tester2", []string{"diag.zip"}, second); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.add("abc", "tester1", []string{"diag.zip"}, second); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.setImage("abc", "bank-1.2-1", "bank-1.2 (r1, core r2)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.addSnapshot("abc", "bank-snapshot-1"); err != nil {
+		t.Fatal(err)
+	}
+	// без ключа ничего не запоминаем
+	if err := index.add("", "tester1", nil, first); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newUploadIndex()
+	if err := loaded.load(path); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := loaded.get("abc")
+	if !ok {
+		t.Fatal("get(abc) after load: not found")
+	}
+	want := uploadRecord{
+		SHA256:        "abc",
+		Files:         []string{"diag.zip"},
+		Users:         []string{"tester1", "tester2"},
+		First:         first,
+		Last:          second,
+		Count:         3,
+		Image:         "bank-1.2-1",
+		ImageVersions: "bank-1.2 (r1, core r2)",
+		Snapshots:     []string{"bank-snapshot-1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("get(abc) = %+v, want %+v", got, want)
+	}
+	if _, ok := loaded.get(""); ok {
+		t.Errorf("get() of the empty key found the record")
+	}
+
+	bad := filepath.Join(t.TempDir(), "uploads.json")
+	if err := os.WriteFile(bad, []byte(`[{"files": ["diag.zip"]}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := newUploadIndex().load(bad); err == nil {
+		t.Errorf("load() of the record without sha256: no error")
+	}
+}
+
+func Test_activeSession_offerReuse(t *testing.T) {
+	uploadsIndex = newUploadIndex()
+	defer func() { uploadsIndex = newUploadIndex() }()
+	update := tgbotapi.Update{Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1}}}
+	as := newASFromFields(fields{user: newTelegramUser("1", 1), status: ACTIVE, q: newSessionsQueue()})
+
+	if got := as.offerReuse(update, "new"); got != (reuseOption{}) {
+		t.Errorf("offerReuse() of the new diagnostic = %+v", got)
+	}
+	// образ из индекса докер уже удалил — предлагать нечего
+	if err := uploadsIndex.setImage("known", "bank-1.2-1", "bank-1.2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := as.offerReuse(update, "known"); got != (reuseOption{}) {
+		t.Errorf("offerReuse() without images = %+v", got)
+	}
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Большие диагностики присылают частями: разрезанным архивом (diag.zip.001, diag.zip.002, ...)
+// или несколькими отдельными архивами. В сессии собираем все присланные файлы,
+// разрезанные архивы склеиваем, когда пришли все части, и только потом разбираем диагностику.
+// Сколько всего частей, по именам не понять. Считаем, что части кончились, если последняя меньше остальных,
+// а остальные одного размера — так режут 7-Zip, WinRAR и split. Если не угадали, есть /go
+
+const (
+	// ждем столько после последнего файла: альбом из нескольких документов приходит отдельными сообщениями
+	uploadQuietPeriod = 5 * time.Second
+)
+
+var (
+	// diag.zip.001 – первая часть diag.zip
+	splitVolumeTemplate = regexp.MustCompile(`^(.+)\.(\d{3})$`)
+
+	errIncompleteSplit = errors.New("not all parts of the split archive")
+	errNoUploads       = errors.New("nothing is uploaded")
+	// сессия закончилась или диагностика уже разворачивается, файл не берем
+	errUploadsClosed = errors.New("uploads are closed")
+)
+
+// volumePart is one part of the split archive on the disk
+type volumePart struct {
+	path string
+	size int64
+}
+
+// splitArchive is the parts of the archive received so far
+type splitArchive struct {
+	name  string
+	parts map[int]*volumePart
+}
+
+// the biggest part number received
+func (s *splitArchive) last() int {
+	res := 0
+	for n := range s.parts {
+		if n > res {
+			res = n
+		}
+	}
+	return res
+}
+
+func (s *splitArchive) missing() []int {
+	res := make([]int, 0)
+	for n := 1; n <= s.last(); n++ {
+		if _, ok := s.parts[n]; !ok {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+// all parts are here: no gaps and the last part is smaller than the others of the same size
+func (s *splitArchive) complete() bool {
+	last := s.last()
+	if last < 2 || len(s.missing()) != 0 {
+		return false
+	}
+	size := s.parts[1].size
+	for n := 2; n < last; n++ {
+		if s.parts[n].size != size {
+			return false
+		}
+	}
+	return s.parts[last].size < size
+}
+
+// glue the parts in order to target and remove them, returns sha256 of the whole archive
+func (s *splitArchive) join(target string) (string, error) {
+	if missing := s.missing(); len(missing) != 0 || len(s.parts) == 0 {
+		return "", fmt.Errorf("%w %s: missing %v", errIncompleteSplit, s.name, missing)
+	}
+	out, err := os.Create(target)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	hash := sha256.New()
+	for n := 1; n <= s.last(); n++ {
+		if err := appendFile(io.MultiWriter(out, hash), s.parts[n].path); err != nil {
+			return "", err
+		}
+	}
+	for _, part := range s.parts {
+		os.Remove(part.path)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func appendFile(out io.Writer, path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// uploads are the files of the diagnostic received in the session
+type uploads struct {
+	dir string
+	// whole archives in the order of upload
+	archives []string
+	// split archives by the name without the part number
+	splits map[string]*splitArchive
+	// sha256 of the whole archives by the path
+	sums map[string]string
+	// every upload increases it, the quiet period is counted from the last one
+	generation int
+	// the diagnostic is being deployed, no more uploads
+	started bool
+}
+
+func newUploads(dir string) *uploads {
+	return &uploads{dir: dir, splits: map[string]*splitArchive{}, sums: map[string]string{}}
+}
+
+// the file name for the upload which does not overwrite the previous ones
+func (u *uploads) target(name string) string {
+	name = sanitizeFileName(name)
+	res := filepath.Join(u.dir, name)
+	for i := 2; ; i++ {
+		if _, err := os.Stat(res); errors.Is(err, os.ErrNotExist) {
+			return res
+		}
+		res = filepath.Join(u.dir, fmt.Sprintf("%d-%s", i, name))
+	}
+}
+
+// add the downloaded file: a part of the split archive by the name or a whole archive by the content
+func (u *uploads) add(name, path string, size int64, sum string) error {
+	u.generation++
+	if m := splitVolumeTemplate.FindStringSubmatch(sanitizeFileName(name)); m != nil {
+		n, _ := strconv.Atoi(m[2])
+		if n == 0 {
+			return fmt.Errorf("%w: part 000", errUnknownArchive)
+		}
+		s, ok := u.splits[m[1]]
+		if !ok {
+			s = &splitArchive{name: m[1], parts: map[int]*volumePart{}}
+			u.splits[m[1]] = s
+		}
+		// ту же часть прислали заново — берем новую
+		if old, ok := s.parts[n]; ok {
+			os.Remove(old.path)
+		}
+		s.parts[n] = &volumePart{path: path, size: size}
+		return nil
+	}
+	if _, err := detectArchiveFile(path); err != nil {
+		os.Remove(path)
+		return err
+	}
+	u.archives = append(u.archives, path)
+	u.sums[path] = sum
+	return nil
+}
+
+func (u *uploads) splitNames() []string {
+	names := make([]string, 0, len(u.splits))
+	for name := range u.splits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// everything is received
+func (u *uploads) ready() bool {
+	if len(u.archives)+len(u.splits) == 0 {
+		return false
+	}
+	for _, s := range u.splits {
+		if !s.complete() {
+			return false
+		}
+	}
+	return true
+}
+
+// assemble glues the split archives and returns all archives of the diagnostic.
+// force – do not wait for the smaller last part, but the gaps are still an error
+func (u *uploads) assemble(force bool) ([]string, error) {
+	if len(u.archives)+len(u.splits) == 0 {
+		return nil, errNoUploads
+	}
+	res := append([]string{}, u.archives...)
+	for _, name := range u.splitNames() {
+		s := u.splits[name]
+		if !s.complete() && !force {
+			return nil, fmt.Errorf("%w %s", errIncompleteSplit, name)
+		}
+		target := u.target(name)
+		sum, err := s.join(target)
+		if err != nil {
+			return nil, err
+		}
+		u.sums[target] = sum
+		if _, err := detectArchiveFile(target); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		res = append(res, target)
+	}
+	return res, nil
+}
+
+// key of the diagnostic in the uploads index: sha256 of the archive,
+// or of the sorted sums if there are several archives
+func (u *uploads) key(archives []string) string {
+	sums := make([]string, 0, len(archives))
+	for _, path := range archives {
+		sums = append(sums, u.sums[path])
+	}
+	if len(sums) == 1 {
+		return sums[0]
+	}
+	sort.Strings(sums)
+	hash := sha256.Sum256([]byte(strings.Join(sums, "\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+var uploadsMessages = struct {
+	archives    string
+	splitDone   string
+	splitGaps   string
+	splitWait   string
+	waiting     string
+	assembled   string
+	incomplete  string
+	started     string
+	nothingToGo string
+	notOwner    string
+	expired     string
+}{
+	archives:    "Архивов: %d",
+	splitDone:   "%s: все %d частей",
+	splitGaps:   "%s: есть %d из %d, не хватает %s",
+	splitWait:   "%s: есть части 1–%d, жду следующие",
+	waiting:     "Жду остальное, присылай сюда же. Если больше ничего не будет — /go",
+	assembled:   "Собрала %s из %d частей",
+	incomplete:  "Не могу собрать архив: %v. Пришли недостающие части",
+	started:     "Я уже разворачиваю то, что ты прислал раньше. Новые файлы — в следующей сессии",
+	nothingToGo: "Сначала пришли диагностику, потом /go",
+	notOwner:    "/go — для того, кто сейчас присылает диагностику",
+	expired:     "Жду остальное уже %d мин, а диагностика так и не собралась:\n%s\nЗакрываю сессию, стенд нужен другим. Пришли диагностику заново целиком",
+}
+
+// progress lists what is received
+func (u *uploads) progress() string {
+	lines := make([]string, 0)
+	if len(u.archives) != 0 {
+		lines = append(lines, fmt.Sprintf(uploadsMessages.archives, len(u.archives)))
+	}
+	for _, name := range u.splitNames() {
+		s := u.splits[name]
+		missing := s.missing()
+		switch {
+		case s.complete():
+			lines = append(lines, fmt.Sprintf(uploadsMessages.splitDone, name, s.last()))
+		case len(missing) != 0:
+			lines = append(lines, fmt.Sprintf(uploadsMessages.splitGaps, name, len(s.parts), s.last(), joinInts(missing)))
+		default:
+			lines = append(lines, fmt.Sprintf(uploadsMessages.splitWait, name, s.last()))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func joinInts(values []int) string {
+	res := make([]string, 0, len(values))
+	for _, v := range values {
+		res = append(res, strconv.Itoa(v))
+	}
+	return strings.Join(res, ", ")
+}
+
+func (as *activeSession) setUploads(u *uploads) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.uploads = u
+}
+
+// the owner is sending the files of the diagnostic
+func (as *activeSession) isUploading(userID int64) bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return as.uploadingBy(userID)
+}
+
+// the same under the lock
+func (as *activeSession) uploadingBy(userID int64) bool {
+	return as.uploads != nil && as.user != nil && as.status == ACTIVE && as.user.id == userID
+}
+
+// receiveUpload downloads the file of the diagnostic from the message and adds it to the uploads.
+// The user is told about every error, the caller decides whether to end the session
+func (as *activeSession) receiveUpload(update tgbotapi.Update) error {
+	chatID := update.Message.Chat.ID
+	send := func(text string) {
+		_, err := as.bot.Send(newMessage(chatID, text))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+	}
+	as.mu.Lock()
+	// сессию могли закрыть, пока шло сообщение
+	if !as.uploadingBy(chatID) {
+		as.mu.Unlock()
+		return errUploadsClosed
+	}
+	u := as.uploads
+	if u.started {
+		as.mu.Unlock()
+		send(uploadsMessages.started)
+		return errUploadsClosed
+	}
+	target := ""
+	source, err := diagSourceFromMessage(update.Message)
+	if err == nil {
+		// место под файл занимаем сразу, документы из альбома качаются параллельно
+		target = u.target(source.name)
+		err = os.WriteFile(target, nil, 0o644)
+	}
+	as.mu.Unlock()
+	if err != nil {
+		log.Println(err)
+		send(fmt.Sprintf(doloresMessages.badDiagSource, err))
+		return err
+	}
+
+	file, err := source.fetch(as.bot, as.httpClient, target)
+	if err != nil {
+		log.Println(err)
+		os.Remove(target)
+		text := doloresMessages.cannotDownload
+		switch {
+		case errors.Is(err, errFileTooBig):
+			text = doloresMessages.tooBigFile
+		case errors.Is(err, errChecksumMismatch):
+			text = doloresMessages.checksumMismatch
+		case errors.Is(err, errNoDownloadLink):
+			text = doloresMessages.cannotGetDownloadLink
+		case errors.Is(err, errBadDiagSource):
+			text = fmt.Sprintf(doloresMessages.badDiagSource, err)
+		}
+		send(text)
+		return err
+	}
+	log.Printf("downloaded %s: %d bytes, sha256 %s\n", target, file.size, file.sha256)
+
+	as.mu.Lock()
+	// пока качали, сессию закрыли или начали разворачивать то, что было
+	if as.uploads != u || u.started {
+		started := as.uploads == u
+		as.mu.Unlock()
+		os.Remove(target)
+		if started {
+			send(uploadsMessages.started)
+		}
+		return errUploadsClosed
+	}
+	err = u.add(source.name, target, file.size, file.sha256)
+	as.mu.Unlock()
+	if err != nil {
+		// the format is detected by the content, not by the extension
+		log.Printf("user %+v sent not an archive: %v\n", update.Message.From, err)
+		send(doloresMessages.onlyArchives)
+		return err
+	}
+	send(fmt.Sprintf(doloresMessages.fileChecksum, filepath.Base(target), units.HumanSize(float64(file.size)), file.sha256))
+	return nil
+}
+
+// deployWhenReady waits for the quiet period and deploys the diagnostic if everything is received.
+// Of the several uploads in a row only the last one gets here
+func (as *activeSession) deployWhenReady(update tgbotapi.Update) {
+	as.mu.Lock()
+	if as.uploads == nil {
+		as.mu.Unlock()
+		return
+	}
+	generation := as.uploads.generation
+	quiet := as.uploadQuietPeriod
+	as.mu.Unlock()
+	time.Sleep(quiet)
+
+	as.mu.Lock()
+	u := as.uploads
+	if u == nil || u.generation != generation || u.started {
+		as.mu.Unlock()
+		return
+	}
+	ready := u.ready()
+	progress := u.progress()
+	timeout := as.uploadTimeout
+	as.mu.Unlock()
+	if !ready {
+		_, err := as.bot.Send(newMessage(update.Message.Chat.ID, progress+"\n\n"+uploadsMessages.waiting))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		if timeout > 0 {
+			time.AfterFunc(timeout, func() {
+				as.expireUploads(update, u, generation)
+			})
+		}
+		return
+	}
+	as.startDeploy(update, false)
+}
+
+// expireUploads ends the session if nothing was uploaded since the generation:
+// the stand is not kept for the diagnostic which never comes
+func (as *activeSession) expireUploads(update tgbotapi.Update, u *uploads, generation int) {
+	as.mu.Lock()
+	if as.uploads != u || u.generation != generation || u.started {
+		as.mu.Unlock()
+		return
+	}
+	progress := u.progress()
+	timeout := as.uploadTimeout
+	as.mu.Unlock()
+	log.Printf("uploads of the user %s expired\n", update.Message.From.String())
+	_, err := as.bot.Send(newMessage(update.Message.Chat.ID,
+		fmt.Sprintf(uploadsMessages.expired, int(timeout.Minutes()), progress)))
+	if err != nil {
+		log.Println("ERROR: ", err)
+	}
+	as.deactivate()
+}
+
+// startDeploy assembles the uploads and runs the whole pipeline
+func (as *activeSession) startDeploy(update tgbotapi.Update, force bool) {
+	chatID := update.Message.Chat.ID
+	as.mu.Lock()
+	u := as.uploads
+	if u == nil || u.started {
+		as.mu.Unlock()
+		return
+	}
+	splits := map[string]int{}
+	for name, s := range u.splits {
+		splits[name] = s.last()
+	}
+	// занимаем загрузки: новые файлы, /go и таймер их больше не трогают,
+	// так что склеивать гигабайты можно без блокировки
+	u.started = true
+	as.mu.Unlock()
+	archives, err := u.assemble(force)
+	key := ""
+	if err == nil {
+		key = u.key(archives)
+	}
+
+	as.mu.Lock()
+	// пока склеивали, сессию закрыли
+	if as.uploads != u {
+		as.mu.Unlock()
+		return
+	}
+	if err != nil {
+		u.started = false
+	} else {
+		as.archives = archives
+		as.diagKey = key
+	}
+	as.mu.Unlock()
+	if err != nil {
+		log.Println(err)
+		text := fmt.Sprintf(uploadsMessages.incomplete, err)
+		if errors.Is(err, errUnknownArchive) {
+			text = doloresMessages.onlyArchives
+		}
+		_, err := as.bot.Send(newMessage(chatID, text))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		return
+	}
+	for _, name := range sortedKeys(splits) {
+		_, err := as.bot.Send(newMessage(chatID, fmt.Sprintf(uploadsMessages.assembled, name, splits[name])))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+	}
+	// такую диагностику уже присылали — может, готовый стенд или образ подойдет
+	reuse := as.offerReuse(update, key)
+	err = uploadsIndex.add(key, update.Message.From.String(), archiveNames(archives), time.Now())
+	if err != nil {
+		log.Println("ERROR: could not save uploads index: ", err)
+	}
+	switch {
+	case reuse.snapshot != nil:
+		as.restoreSnapshot(update, reuse.snapshot)
+		return
+	case reuse.image != "":
+		as.setReusedImage(reuse.image, reuse.versions)
+	}
+
+	archives, err = as.decryptArchives(update, archives)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	as.mu.Lock()
+	as.archives = archives
+	as.mu.Unlock()
+	as.deploy(update)
+}
+
+func sortedKeys(m map[string]int) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// /go – deploy what is received, without waiting for more parts
+func (as *activeSession) handleGo(update tgbotapi.Update, args []string) {
+	chatID := update.Message.Chat.ID
+	if !as.isUploading(chatID) {
+		text := uploadsMessages.nothingToGo
+		if as.isActive(chatID) {
+			text = uploadsMessages.notOwner
+		}
+		_, err := as.bot.Send(newMessage(chatID, text))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		return
+	}
+	as.startDeploy(update, true)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Автотесты на сборку диагностики из нескольких файлов
+
+func Test_splitArchive_complete(t *testing.T) {
+	parts := func(sizes ...int64) *splitArchive {
+		s := &splitArchive{name: "diag.zip", parts: map[int]*volumePart{}}
+		for i, size := range sizes {
+			if size >= 0 {
+				s.parts[i+1] = &volumePart{size: size}
+			}
+		}
+		return s
+	}
+	tests := []struct {
+		name        string
+		split       *splitArchive
+		want        bool
+		wantMissing []int
+	}{
+		{name: "all parts", split: parts(100, 100, 30), want: true, wantMissing: []int{}},
+		{name: "gap", split: parts(100, -1, 30), wantMissing: []int{2}},
+		{name: "last of the same size", split: parts(100, 100), wantMissing: []int{}},
+		{name: "only the first", split: parts(100), wantMissing: []int{}},
+		{name: "different sizes", split: parts(100, 90, 30), wantMissing: []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.split.complete(); got != tt.want {
+				t.Errorf("complete() = %v, want %v", got, tt.want)
+			}
+			if got := tt.split.missing(); !reflect.DeepEqual(got, tt.wantMissing) {
+				t.Errorf("missing() = %v, want %v", got, tt.wantMissing)
+			}
+		})
+	}
+}
+
+// разрезаем архив на части по size байт, как split или 7-Zip
+func splitFile(t *testing.T, source, dir string, size int) []string {
+	content, err := os.ReadFile(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := make([]string, 0)
+	for i := 0; len(content) != 0; i++ {
+		n := size
+		if n > len(content) {
+			n = len(content)
+		}
+		part := filepath.Join(dir, filepath.Base(source)+"."+[]string{"001", "002", "003", "004"}[i])
+		if err := os.WriteFile(part, content[:n], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, part)
+		content = content[n:]
+	}
+	return res
+}
+
+func Test_uploads_assemble(t *testing.T) {
+	info, err := os.Stat("test_data/diag_good.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	parts := splitFile(t, "test_data/diag_good.zip", t.TempDir(), int(info.Size()/3)+1)
+	if len(parts) != 3 {
+		t.Fatalf("split into %d parts", len(parts))
+	}
+
+	u := newUploads(dir)
+	add := func(source string) {
+		content, err := os.ReadFile(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := u.target(filepath.Base(source))
+		if err := os.WriteFile(target, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := u.add(filepath.Base(source), target, int64(len(content)), fmt.Sprintf("%x", sha256.Sum256(content))); err != nil {
+			t.Fatalf("add(%s) = %v", source, err)
+		}
+	}
+	// части приходят в любом порядке
+	add(parts[2])
+	add(parts[0])
+	if u.ready() {
+		t.Errorf("ready() without the second part")
+	}
+	if _, err := u.assemble(true); !errors.Is(err, errIncompleteSplit) {
+		t.Errorf("assemble() with a gap: %v", err)
+	}
+	add(parts[1])
+	add("test_data/diag_without_versions.zip")
+	if !u.ready() {
+		t.Fatalf("ready() = false, progress: %s", u.progress())
+	}
+	archives, err := u.assemble(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "diag_without_versions.zip"), filepath.Join(dir, "diag_good.zip")}
+	if !reflect.DeepEqual(archives, want) {
+		t.Fatalf("assemble() = %v, want %v", archives, want)
+	}
+	// склеенный архив считается так же, как если бы его прислали целиком
+	good, err := os.ReadFile("test_data/diag_good.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := u.key(archives[1:]), fmt.Sprintf("%x", sha256.Sum256(good)); got != want {
+		t.Errorf("key() of the assembled archive = %v, want %v", got, want)
+	}
+	if u.key(archives) != u.key([]string{archives[1], archives[0]}) {
+		t.Errorf("key() depends on the order of the archives")
+	}
+	diag, err := parseArchives(archives, t.TempDir())
+	if err != nil {
+		t.Fatalf("parseArchives() = %v", err)
+	}
+	if diag.versions.CustomerName == "" {
+		t.Errorf("parseArchives() did not find the versions in the assembled archive")
+	}
+
+	notes := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(notes, []byte("not an archive"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.add("notes.txt", notes, 14, ""); !errors.Is(err, errUnknownArchive) {
+		t.Errorf("add() not an archive: %v", err)
+	}
+}
+
+func Test_activeSession_receiveUpload_closed(t *testing.T) {
+	update := tgbotapi.Update{Message: &tgbotapi.Message{
+		Chat:     &tgbotapi.Chat{ID: 1},
+		From:     &tgbotapi.User{ID: 1},
+		Document: &tgbotapi.Document{FileID: "file_1", FileName: "diag.zip.002"},
+	}}
+	dir := t.TempDir()
+	as := newASFromFields(fields{user: newTelegramUser("1", 1), status: ACTIVE, q: newSessionsQueue()})
+
+	// сессию закрыли, пока сообщение шло
+	if err := as.receiveUpload(update); !errors.Is(err, errUploadsClosed) {
+		t.Errorf("receiveUpload() without uploads = %v", err)
+	}
+	// уже разворачиваем — файл не берем и место под него не занимаем
+	u := newUploads(dir)
+	u.started = true
+	as.setUploads(u)
+	if err := as.receiveUpload(update); !errors.Is(err, errUploadsClosed) {
+		t.Errorf("receiveUpload() after the start = %v", err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("receiveUpload() after the start left %d files", len(files))
+	}
+}
+
+func Test_activeSession_expireUploads(t *testing.T) {
+	update := tgbotapi.Update{Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1}, From: &tgbotapi.User{ID: 1}}}
+	as := newASFromFields(fields{user: newTelegramUser("1", 1), status: ACTIVE, q: newSessionsQueue()})
+	as.uploadTimeout = 50 * time.Millisecond
+	u := newUploads(t.TempDir())
+	if err := u.add("diag.zip.001", filepath.Join(u.dir, "diag.zip.001"), 10, ""); err != nil {
+		t.Fatal(err)
+	}
+	as.setUploads(u)
+
+	as.deployWhenReady(update)
+	deadline := time.Now().Add(5 * time.Second)
+	for as.isUploading(1) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if as.isUploading(1) || as.status != DISACTIVE {
+		t.Errorf("the session waits for the missing parts forever: status %v", as.status)
+	}
+}
+
+func Test_activeSession_startDeploy_incomplete(t *testing.T) {
+	update := tgbotapi.Update{Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1}, From: &tgbotapi.User{ID: 1}}}
+	as := newASFromFields(fields{user: newTelegramUser("1", 1), status: ACTIVE, q: newSessionsQueue()})
+	u := newUploads(t.TempDir())
+	path := filepath.Join(u.dir, "diag.zip.001")
+	if err := os.WriteFile(path, []byte("part"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.add("diag.zip.001", path, 4, ""); err != nil {
+		t.Fatal(err)
+	}
+	as.setUploads(u)
+
+	// архив не собрался — ждем остальные части дальше
+	as.startDeploy(update, false)
+	if u.started || !as.isUploading(1) {
+		t.Errorf("uploads are closed after the failed assemble: started %v", u.started)
+	}
+	if as.archives != nil || as.diagKey != "" {
+		t.Errorf("the failed assemble set archives %v, key %q", as.archives, as.diagKey)
+	}
+}
+
+func Test_activeSession_finishDeploy_closesUploads(t *testing.T) {
+	update := tgbotapi.Update{Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1}, From: &tgbotapi.User{ID: 1}}}
+	as := newASFromFields(fields{user: newTelegramUser("1", 1), status: ACTIVE, q: newSessionsQueue()})
+	u := newUploads(t.TempDir())
+	u.started = true
+	as.setUploads(u)
+
+	// стенд готов — следующий файл уже новая диагностика, а не «уже разворачиваю»
+	as.finishDeploy(update)
+	if as.isUploading(1) {
+		t.Errorf("uploads are still open after the deploy")
+	}
+}
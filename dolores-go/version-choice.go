@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Выбор версии для развертывания. В lifecycle-логе видно все обновления стенда заказчика,
+// а ошибка могла случиться и на одной из прошлых версий. Если версий несколько — показываем
+// клавиатуру, по умолчанию (и если пользователь молчит) разворачиваем последнюю
+
+const (
+	// callback data of the version button: version:<index in the history>
+	versionCallbackPrefix = "version:"
+	// the keyboard shows only the latest versions
+	maxVersionButtons = 8
+	choiceTimeout     = 2 * time.Minute
+)
+
+func versionButtonText(s *lifecycleStart, latest bool) string {
+	v := s.Versions
+	text := fmt.Sprintf("%s (%s, core %s) — %s", v.FactorTagVersion, v.CustomerRevision, v.CoreRevision, s.Last.Format("2006-01-02"))
+	if latest {
+		text += doloresMessages.versionLatest
+	}
+	return text
+}
+
+// buttons for the latest versions, the newest first
+func versionButtons(history []*lifecycleStart) []inlineButton {
+	buttons := make([]inlineButton, 0, maxVersionButtons)
+	for i := len(history) - 1; i >= 0 && len(buttons) < maxVersionButtons; i-- {
+		buttons = append(buttons, inlineButton{
+			text:   versionButtonText(history[i], i == len(history)-1),
+			action: versionCallbackPrefix + strconv.Itoa(i),
+		})
+	}
+	return buttons
+}
+
+func (as *activeSession) setVersionChoice(choice chan int) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.versionChoice = choice
+}
+
+// chooseVersion asks the owner which version to deploy if the lifecycle log has several.
+// Blocks until the choice or the timeout, the latest version is the default
+func (as *activeSession) chooseVersion(update tgbotapi.Update) error {
+	chatID := update.Message.Chat.ID
+	history := as.getHistory()
+	if len(history) < 2 {
+		return nil
+	}
+	choice := make(chan int, 1)
+	as.setVersionChoice(choice)
+	defer as.setVersionChoice(nil)
+	_, err := as.bot.Send(newMessageWithButtons(chatID,
+		fmt.Sprintf(doloresMessages.chooseVersion, len(history), int(as.choiceTimeout.Minutes())),
+		versionButtons(history)))
+	if err != nil {
+		log.Println("ERROR: ", err)
+	}
+
+	latest := len(history) - 1
+	index := latest
+	select {
+	case index = <-choice:
+	case <-time.After(as.choiceTimeout):
+		log.Printf("no version chosen by %s, deploy the latest\n", as.getUser())
+	}
+	if index == latest {
+		return nil
+	}
+
+	start := history[index]
+	if start.Versions.CustomerName == "" {
+		_, err := as.bot.Send(newMessage(chatID, fmt.Sprintf(doloresMessages.versionUnknownCustomer, start.Versions.CustomerTitle)))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		as.deactivate()
+		return fmt.Errorf("unknown customer %s", start.Versions.CustomerTitle)
+	}
+	// cdi.versions и factor.versions сняты с текущей версии, к прошлым не относятся
+	versions, _ := mergeVersions(&start.Versions, nil, nil)
+	as.setVersions(versions)
+	as.setCustomer(versions.CustomerName, versions.FactorTagVersion, chatID)
+	_, err = as.bot.Send(newMessage(chatID, fmt.Sprintf(doloresMessages.versionChosen, as.getVersionsString())))
+	if err != nil {
+		log.Println("ERROR: ", err)
+	}
+	return nil
+}
+
+// the button of the version is pressed
+func (as *activeSession) handleVersionCallback(update tgbotapi.Update) {
+	userID := int64(update.CallbackQuery.From.ID)
+	index, err := strconv.Atoi(strings.TrimPrefix(update.CallbackQuery.Data, versionCallbackPrefix))
+	as.mu.Lock()
+	choice := as.versionChoice
+	valid := err == nil && index >= 0 && index < len(as.history)
+	as.mu.Unlock()
+	if !as.isOwner(userID) || choice == nil || !valid {
+		_, err := as.bot.Send(newMessage(userID, doloresMessages.versionTooLate))
+		if err != nil {
+			log.Println("ERROR: ", err)
+		}
+		return
+	}
+	// выбор принимаем только первый
+	select {
+	case choice <- index:
+	default:
+	}
+}
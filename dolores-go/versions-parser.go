@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Код для обработки файлов с версиями из диагностики:
+// - cdi.versions — версии и ревизии модулей CDI: сначала core, потом сборка заказчика, потом библиотеки
+// - factor.versions — ответ getBuildInfoResponse от Фактора: версия, ревизия и время сборки
+// Они нужны как запасной источник, если lifecycle-лога нет, и как сверка, если он есть
+
+// where the version fields came from
+const (
+	sourceLifecycle      = "cdi-lifecycle.log"
+	sourceCdiVersions    = "cdi.versions"
+	sourceFactorVersions = "factor.versions"
+	// the repository of the customer is chosen from the keyboard, see customer-choice.go
+	sourceUser = "выбор пользователя"
+)
+
+var (
+	// 20.12-SNAPSHOT (2c980808)
+	cdiVersionsBlockTemplate = regexp.MustCompile(`^(\S+?)(-SNAPSHOT)? \(([0-9a-z]+)\)$`)
+	// cdi-api-demo-20.12-SNAPSHOT.jar
+	cdiVersionsJarTemplate = regexp.MustCompile(`^\s+(\S+)\.(?:jar|war)$`)
+)
+
+type cdiVersionsBlock struct {
+	version  string
+	revision string
+	// names of the modules without the version
+	modules []string
+}
+
+// the last part of the module name if it is the same for all modules
+// cdi-api-demo, cdi-web-demo -> demo
+func (b *cdiVersionsBlock) commonSuffix() string {
+	if len(b.modules) < 2 {
+		return ""
+	}
+	suffix := ""
+	for _, module := range b.modules {
+		if !strings.HasPrefix(module, "cdi-") {
+			return ""
+		}
+		parts := strings.Split(module, "-")
+		last := parts[len(parts)-1]
+		if suffix != "" && suffix != last {
+			return ""
+		}
+		suffix = last
+	}
+	return suffix
+}
+
+func (b *cdiVersionsBlock) isCdi() bool {
+	for _, module := range b.modules {
+		if !strings.HasPrefix(module, "cdi-") {
+			return false
+		}
+	}
+	return len(b.modules) != 0
+}
+
+func parseCdiVersions(in io.Reader) (*applicationVersions, error) {
+	scanner := bufio.NewScanner(in)
+	blocks := make([]*cdiVersionsBlock, 0)
+	var current *cdiVersionsBlock
+	fullVersion := ""
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if m := cdiVersionsBlockTemplate.FindStringSubmatch(line); m != nil {
+			current = &cdiVersionsBlock{version: m[1], revision: m[3]}
+			fullVersion = m[1] + m[2]
+			blocks = append(blocks, current)
+			continue
+		}
+		m := cdiVersionsJarTemplate.FindStringSubmatch(line)
+		if m == nil || current == nil {
+			continue
+		}
+		current.modules = append(current.modules, strings.TrimSuffix(m[1], "-"+fullVersion))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	res := new(applicationVersions)
+	for _, b := range blocks {
+		if !b.isCdi() {
+			continue
+		}
+		// у сборки заказчика все модули заканчиваются на имя заказчика, у core — нет.
+		// Имя из модулей проверяем по алиасам, как и имя из лога: неизвестное спросим у пользователя
+		if name := b.commonSuffix(); name != "" {
+			if res.CustomerRevision == "" {
+				res.CustomerTitle = name
+				res.CustomerName, _ = clientsAliases.resolve(name)
+				res.CustomerRevision = b.revision
+			}
+			continue
+		}
+		if res.CoreRevision == "" {
+			res.CoreRevision = b.revision
+			res.FactorTagVersion = b.version
+		}
+	}
+	if res.CoreRevision == "" && res.CustomerRevision == "" {
+		return nil, fmt.Errorf("cdi versions not found in cdi.versions")
+	}
+	return res, nil
+}
+
+// factorBuildInfo is the build info of Factor from getBuildInfoResponse
+type factorBuildInfo struct {
+	Version   string `xml:"Body>getBuildInfoResponse>buildInfo>version"`
+	Revision  string `xml:"Body>getBuildInfoResponse>buildInfo>revision"`
+	BuildTime string `xml:"Body>getBuildInfoResponse>buildInfo>buildTime"`
+}
+
+func parseFactorVersions(in io.Reader) (*factorBuildInfo, error) {
+	res := new(factorBuildInfo)
+	if err := xml.NewDecoder(in).Decode(res); err != nil {
+		return nil, fmt.Errorf("could not parse factor.versions: %w", err)
+	}
+	if res.Version == "" {
+		return nil, fmt.Errorf("factor version not found in factor.versions")
+	}
+	return res, nil
+}
+
+// mergeVersions takes the fields from the lifecycle log first
+// and fills the missing ones from cdi.versions and factor.versions.
+// Customer names are compared after the alias lookup, the Factor version is checked against both sources.
+// Any source can be nil. Returns warnings if the sources disagree
+func mergeVersions(lifecycle, cdi *applicationVersions, factor *factorBuildInfo) (*applicationVersions, []string) {
+	res := &applicationVersions{Sources: map[string]string{}}
+	warnings := make([]string, 0)
+
+	merge := func(field string, target *string, get func(v *applicationVersions) string) {
+		var fromLifecycle, fromCdi string
+		if lifecycle != nil {
+			fromLifecycle = get(lifecycle)
+		}
+		if cdi != nil {
+			fromCdi = get(cdi)
+		}
+		switch {
+		case fromLifecycle != "":
+			*target = fromLifecycle
+			res.Sources[field] = sourceLifecycle
+		case fromCdi != "":
+			*target = fromCdi
+			res.Sources[field] = sourceCdiVersions
+		}
+		if fromLifecycle != "" && fromCdi != "" && fromLifecycle != fromCdi {
+			warnings = append(warnings, fmt.Sprintf("%s: %s в %s, но %s в %s", field, fromLifecycle, sourceLifecycle, fromCdi, sourceCdiVersions))
+		}
+	}
+	merge("CustomerName", &res.CustomerName, func(v *applicationVersions) string { return v.CustomerName })
+	merge("CustomerRevision", &res.CustomerRevision, func(v *applicationVersions) string { return v.CustomerRevision })
+	merge("CoreRevision", &res.CoreRevision, func(v *applicationVersions) string { return v.CoreRevision })
+	merge("FactorTagVersion", &res.FactorTagVersion, func(v *applicationVersions) string { return v.FactorTagVersion })
+
+	// имя до алиаса: показать, какой алиас подставили, или спросить репозиторий, если алиаса нет
+	switch {
+	case lifecycle != nil && lifecycle.CustomerTitle != "":
+		res.CustomerTitle = lifecycle.CustomerTitle
+		res.Sources["CustomerTitle"] = sourceLifecycle
+	case cdi != nil && cdi.CustomerTitle != "":
+		res.CustomerTitle = cdi.CustomerTitle
+		res.Sources["CustomerTitle"] = sourceCdiVersions
+	}
+
+	if factor != nil {
+		for _, source := range []struct {
+			name     string
+			versions *applicationVersions
+		}{{sourceLifecycle, lifecycle}, {sourceCdiVersions, cdi}} {
+			if source.versions == nil || source.versions.FactorTagVersion == "" {
+				continue
+			}
+			if source.versions.FactorTagVersion != strings.TrimSuffix(factor.Version, "-SNAPSHOT") {
+				warnings = append(warnings, fmt.Sprintf("FactorTagVersion: %s в %s, но %s в %s",
+					source.versions.FactorTagVersion, source.name, factor.Version, sourceFactorVersions))
+			}
+		}
+		res.FactorVersion = factor.Version
+		res.FactorRevision = factor.Revision
+		res.FactorBuildTime = factor.BuildTime
+		res.Sources["FactorVersion"] = sourceFactorVersions
+		res.Sources["FactorRevision"] = sourceFactorVersions
+		res.Sources["FactorBuildTime"] = sourceFactorVersions
+	}
+	return res, warnings
+}
+
+// fields needed to build the image which are not filled
+func (v *applicationVersions) missingFields() []string {
+	res := make([]string, 0)
+	if v.CustomerName == "" {
+		res = append(res, "имя заказчика")
+	}
+	if v.CustomerRevision == "" {
+		res = append(res, "ревизию сборки заказчика")
+	}
+	if v.CoreRevision == "" {
+		res = append(res, "ревизию core")
+	}
+	if v.FactorTagVersion == "" {
+		res = append(res, "версию CDI")
+	}
+	return res
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Автотесты на разбор cdi.versions и factor.versions и на слияние версий из разных источников
+
+func TestParseCdiVersions(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    *applicationVersions
+		wantErr bool
+	}{
+		{
+			name: "core and customer",
+			in: "20.12-SNAPSHOT (2c980808)\n" +
+				"   cdi-api-core-20.12-SNAPSHOT.jar\n" +
+				"   cdi-services-20.12-SNAPSHOT.jar\n" +
+				"20.12-SNAPSHOT (01fbd6f4)\n" +
+				"   cdi-api-bank-20.12-SNAPSHOT.jar\n" +
+				"   cdi-web-bank-20.12-SNAPSHOT.war\n" +
+				"20.10-SNAPSHOT (5e64ee7a)\n" +
+				"   utils-log-20.10-SNAPSHOT.jar\n",
+			want: &applicationVersions{
+				CoreRevision:     "2c980808",
+				CustomerRevision: "01fbd6f4",
+				CustomerName:     "bank",
+				CustomerTitle:    "bank",
+				FactorTagVersion: "20.12",
+			},
+		},
+		{
+			name: "windows line endings",
+			in: "21.3 (2c980808)\r\n" +
+				"   cdi-api-core-21.3.jar\r\n" +
+				"   cdi-services-21.3.jar\r\n",
+			want: &applicationVersions{
+				CoreRevision:     "2c980808",
+				FactorTagVersion: "21.3",
+			},
+		},
+		{
+			name: "unknown customer is not taken as the repository",
+			in: "20.12-SNAPSHOT (01fbd6f4)\n" +
+				"   cdi-api-sony-20.12-SNAPSHOT.jar\n" +
+				"   cdi-web-sony-20.12-SNAPSHOT.war\n",
+			want: &applicationVersions{
+				CustomerRevision: "01fbd6f4",
+				CustomerTitle:    "sony",
+			},
+		},
+		{
+			name:    "only libraries",
+			in:      "20.10-SNAPSHOT (5e64ee7a)\n   utils-log-20.10-SNAPSHOT.jar\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCdiVersions(strings.NewReader(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseCdiVersions() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCdiVersions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseVersionsFiles(t *testing.T) {
+	cdi, err := os.Open("test_data/cdi.versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cdi.Close()
+	gotCdi, err := parseCdiVersions(cdi)
+	if err != nil {
+		t.Fatalf("parseCdiVersions() error = %v", err)
+	}
+	wantCdi := &applicationVersions{
+		CoreRevision:     "2c980808",
+		CustomerRevision: "01fbd6f4",
+		CustomerName:     "demo",
+		CustomerTitle:    "demo",
+		FactorTagVersion: "20.12",
+	}
+	if !reflect.DeepEqual(gotCdi, wantCdi) {
+		t.Errorf("parseCdiVersions() = %+v, want %+v", gotCdi, wantCdi)
+	}
+
+	factor, err := os.Open("test_data/factor.versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer factor.Close()
+	gotFactor, err := parseFactorVersions(factor)
+	if err != nil {
+		t.Fatalf("parseFactorVersions() error = %v", err)
+	}
+	wantFactor := &factorBuildInfo{
+		Version:   "20.06",
+		Revision:  "9ca5f232",
+		BuildTime: "2020-07-08T17:55:00.000+03:00",
+	}
+	if !reflect.DeepEqual(gotFactor, wantFactor) {
+		t.Errorf("parseFactorVersions() = %+v, want %+v", gotFactor, wantFactor)
+	}
+}
+
+func TestMergeVersions(t *testing.T) {
+	tests := []struct {
+		name         string
+		lifecycle    *applicationVersions
+		cdi          *applicationVersions
+		factor       *factorBuildInfo
+		want         *applicationVersions
+		wantWarnings int
+	}{
+		{
+			name:      "lifecycle only",
+			lifecycle: &applicationVersions{CustomerName: "demo", CustomerRevision: "01fbd6f4", CoreRevision: "2c980808", FactorTagVersion: "20.12"},
+			want: &applicationVersions{
+				CustomerName: "demo", CustomerRevision: "01fbd6f4", CoreRevision: "2c980808", FactorTagVersion: "20.12",
+				Sources: map[string]string{
+					"CustomerName": sourceLifecycle, "CustomerRevision": sourceLifecycle,
+					"CoreRevision": sourceLifecycle, "FactorTagVersion": sourceLifecycle,
+				},
+			},
+		},
+		{
+			name:      "unknown alias is filled from cdi.versions",
+			lifecycle: &applicationVersions{CustomerName: "", CustomerRevision: "01fbd6f4", CoreRevision: "2c980808", FactorTagVersion: "20.12"},
+			cdi:       &applicationVersions{CustomerName: "demo", CustomerRevision: "01fbd6f4", CoreRevision: "2c980808", FactorTagVersion: "20.12"},
+			want: &applicationVersions{
+				CustomerName: "demo", CustomerRevision: "01fbd6f4", CoreRevision: "2c980808", FactorTagVersion: "20.12",
+				Sources: map[string]string{
+					"CustomerName": sourceCdiVersions, "CustomerRevision": sourceLifecycle,
+					"CoreRevision": sourceLifecycle, "FactorTagVersion": sourceLifecycle,
+				},
+			},
+		},
+		{
+			name:      "sources disagree",
+			lifecycle: &applicationVersions{CustomerName: "demo", CustomerRevision: "01fbd6f4", CoreRevision: "2c980808", FactorTagVersion: "20.12"},
+			cdi:       &applicationVersions{CustomerName: "demo", CustomerRevision: "eb02e922", CoreRevision: "badfd026", FactorTagVersion: "20.12"},
+			want: &applicationVersions{
+				CustomerName: "demo", CustomerRevision: "01fbd6f4", CoreRevision: "2c980808", FactorTagVersion: "20.12",
+				Sources: map[string]string{
+					"CustomerName": sourceLifecycle, "CustomerRevision": sourceLifecycle,
+					"CoreRevision": sourceLifecycle, "FactorTagVersion": sourceLifecycle,
+				},
+			},
+			wantWarnings: 2,
+		},
+		{
+			name:      "customer names are compared after the aliases",
+			lifecycle: &applicationVersions{CustomerName: "name", CustomerTitle: "Long name", FactorTagVersion: "20.12"},
+			cdi:       &applicationVersions{CustomerName: "demo", CustomerTitle: "demo", FactorTagVersion: "20.12"},
+			want: &applicationVersions{
+				CustomerName: "name", CustomerTitle: "Long name", FactorTagVersion: "20.12",
+				Sources: map[string]string{
+					"CustomerName": sourceLifecycle, "CustomerTitle": sourceLifecycle, "FactorTagVersion": sourceLifecycle,
+				},
+			},
+			wantWarnings: 1,
+		},
+		{
+			name:      "unknown customer in both sources is left for the user",
+			lifecycle: &applicationVersions{CustomerTitle: "Sony", FactorTagVersion: "20.12"},
+			cdi:       &applicationVersions{CustomerTitle: "sony", FactorTagVersion: "20.12"},
+			want: &applicationVersions{
+				CustomerTitle: "Sony", FactorTagVersion: "20.12",
+				Sources: map[string]string{"CustomerTitle": sourceLifecycle, "FactorTagVersion": sourceLifecycle},
+			},
+		},
+		{
+			name:      "factor version differs from both sources",
+			lifecycle: &applicationVersions{FactorTagVersion: "20.12"},
+			cdi:       &applicationVersions{FactorTagVersion: "20.12"},
+			factor:    &factorBuildInfo{Version: "20.06-SNAPSHOT"},
+			want: &applicationVersions{
+				FactorTagVersion: "20.12", FactorVersion: "20.06-SNAPSHOT",
+				Sources: map[string]string{
+					"FactorTagVersion": sourceLifecycle, "FactorVersion": sourceFactorVersions,
+					"FactorRevision": sourceFactorVersions, "FactorBuildTime": sourceFactorVersions,
+				},
+			},
+			wantWarnings: 2,
+		},
+		{
+			name:   "factor version agrees",
+			cdi:    &applicationVersions{FactorTagVersion: "20.12"},
+			factor: &factorBuildInfo{Version: "20.12-SNAPSHOT"},
+			want: &applicationVersions{
+				FactorTagVersion: "20.12", FactorVersion: "20.12-SNAPSHOT",
+				Sources: map[string]string{
+					"FactorTagVersion": sourceCdiVersions, "FactorVersion": sourceFactorVersions,
+					"FactorRevision": sourceFactorVersions, "FactorBuildTime": sourceFactorVersions,
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, warnings := mergeVersions(tt.lifecycle, tt.cdi, tt.factor)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeVersions() = %+v, want %+v", got, tt.want)
+			}
+			if len(warnings) != tt.wantWarnings {
+				t.Errorf("mergeVersions() warnings = %v, want %d", warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
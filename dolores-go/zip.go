@@ -1,85 +1,194 @@
 package main
 
 import (
-	"archive/zip"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"path"
 	"path/filepath"
+	"strings"
 )
 
-// Парсим архив, который передали Долорес
+// Парсим архив, который передали Долорес (zip, tar, tar.gz или 7z, см. archive.go)
 
-func parseZipFile(zippath string) (*applicationVersions, error) {
-	z, err := zip.OpenReader(zippath)
+var errNotDeployable = errors.New("diagnostic cannot be deployed")
+
+// the diagnostic can be deployed, but we have to ask the user about the repository of the customer
+var errUnknownCustomer = errors.New("unknown customer alias")
+
+// diagnostic is what we have found in the archive
+type diagnostic struct {
+	format archiveFormat
+	files  diagFiles
+	// paths of the diagnostic files found in the archive
+	found []string
+	// merged versions, can be incomplete
+	versions *applicationVersions
+	// versions started according to the lifecycle log, the current one is the last
+	history []*lifecycleStart
+	// the version sources disagree or cannot be parsed
+	warnings []string
+	// reasons why the archive cannot be deployed
+	problems []string
+	// files to put to the stand by the extraction rules
+	extraction *extraction
+	// errors and warnings from cdi.log, nil if there is no log
+	cdiLog *logSummary
+	// SOAP stats from cdi-soap-stats.log, nil if there is no log
+	soapStats *soapStats
+	// the customer name from the log which has no alias
+	unknownCustomer string
+}
+
+func (d *diagnostic) deployable() bool {
+	return len(d.problems) == 0
+}
+
+func parseZipFile(zippath, diagDir string) (*diagnostic, error) {
+	return parseArchives([]string{zippath}, diagDir)
+}
+
+// returns the diagnostic even in case of error to tell the user what was found
+// * paths – the archives of the diagnostic, usually one, but large ones come in several
+// * diagDir – where to extract the files to mount into the container
+func parseArchives(paths []string, diagDir string) (*diagnostic, error) {
+	z, err := openArchives(paths)
 	if err != nil {
-		return nil, fmt.Errorf("could not open zip file: %w", err)
+		return nil, err
 	}
 	defer z.Close()
 
-	parseVersions := false
-	parsePartyDiag := false
-	versions := new(applicationVersions)
-
-	for _, f := range z.File {
-		switch f.Name {
-		//  Если в папке cdi.logs обнаружили cdi-lifecycle.log — считываем его
-		case "cdi.logs/cdi-lifecycle.log":
-			handle, err := f.Open()
-			if err != nil {
-				return nil, fmt.Errorf("could not open lifecycle log: %w", err)
-			}
-			defer func() {
-				if err := handle.Close(); err != nil {
-					panic(err)
-				}
-			}()
-			versions, err = parseapplicationVersions(handle)
-			if err != nil {
-				return nil, err
-			}
-			parseVersions = true
-		// Если в корне архива обнаружили sql.party.xls (диагностика) — считываем её
-		case "sql.party.xls":
-			handle, err := f.Open()
-			if err != nil {
-				return nil, fmt.Errorf("could not open sql.party.xls: %w", err)
-			}
-			defer func() {
-				if err := handle.Close(); err != nil {
-					panic(err)
-				}
-			}()
-			// Куда сохранить файл
-			pathToSave := filepath.Join(dirToSave, f.Name) //nolint:gosec
-			fLocal, err := os.OpenFile(pathToSave, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-			if err != nil {
-				return nil, fmt.Errorf("could not create sql.party.xls file to copy: %w", err)
-			}
-			_, err = io.Copy(fLocal, handle) //nolint:gosec
-			if err != nil {
-				return nil, err
-			}
-			parsePartyDiag = true
+	files := locateDiagFiles(z.Entries())
+	diag := &diagnostic{format: z.Format(), files: files, found: files.found()}
+
+	//  Если нашли cdi-lifecycle.log (и его ротированные копии) — считываем их от старых к новым
+	var lifecycleVersions *applicationVersions
+	if len(files[diagLifecycleLog]) != 0 {
+		handle, err := files.openMerged(diagLifecycleLog)
+		if err == nil {
+			diag.history, err = parseLifecycleHistory(handle)
+			handle.Close()
+		}
+		if err != nil {
+			diag.warnings = append(diag.warnings, err.Error())
+		} else {
+			lifecycleVersions = &diag.history[len(diag.history)-1].Versions
 		}
 	}
 
-	if !parseVersions && !parsePartyDiag {
-		return nil, fmt.Errorf("there is no sql.party.xls file in the zip and versions did not parsed correctly")
+	// cdi.versions и factor.versions — запасной источник версий и сверка с lifecycle-логом
+	var cdiVersions *applicationVersions
+	if f := files.first(diagCdiVersions); f != nil {
+		handle, err := f.Open()
+		if err == nil {
+			cdiVersions, err = parseCdiVersions(handle)
+			handle.Close()
+		}
+		if err != nil {
+			diag.warnings = append(diag.warnings, err.Error())
+		}
+	}
+	var factorVersions *factorBuildInfo
+	if f := files.first(diagFactorVersions); f != nil {
+		handle, err := f.Open()
+		if err == nil {
+			factorVersions, err = parseFactorVersions(handle)
+			handle.Close()
+		}
+		if err != nil {
+			diag.warnings = append(diag.warnings, err.Error())
+		}
+	}
+	// cdi.log не влияет на то, можно ли разворачивать, только попадает в отчет
+	if len(files[diagCdiLog]) != 0 {
+		handle, err := files.openMerged(diagCdiLog)
+		if err == nil {
+			diag.cdiLog, err = parseCdiLog(handle)
+			handle.Close()
+		}
+		if err != nil {
+			diag.warnings = append(diag.warnings, fmt.Sprintf("не смогла прочитать cdi.log: %v", err))
+		}
 	}
 
-	if !parseVersions {
-		err := os.Remove(path.Join(dirToSave, "sql.party.xls"))
+	if len(files[diagSoapStats]) != 0 {
+		handle, err := files.openMerged(diagSoapStats)
+		if err == nil {
+			diag.soapStats, err = parseSoapStats(handle)
+			handle.Close()
+		}
 		if err != nil {
-			return nil, fmt.Errorf("there is no lifecycle log and cannot remove sql.party: %v", err)
+			diag.warnings = append(diag.warnings, fmt.Sprintf("не смогла прочитать cdi-soap-stats.log: %v", err))
 		}
-		return nil, fmt.Errorf("there is no lifecycle log file in the zip")
 	}
 
-	if !parsePartyDiag {
-		return nil, fmt.Errorf("there is no sql.party.xls file in the zip")
+	versions, warnings := mergeVersions(lifecycleVersions, cdiVersions, factorVersions)
+	diag.versions = versions
+	diag.warnings = append(diag.warnings, warnings...)
+
+	// Собираем все причины, по которым разворачивать нельзя, а не только первую
+	missing := versions.missingFields()
+	if versions.CustomerName == "" && versions.CustomerTitle != "" {
+		// репозиторий можно спросить у пользователя, если больше ничего не мешает
+		diag.unknownCustomer = versions.CustomerTitle
+		// имя заказчика — первое в списке
+		missing = missing[1:]
+	}
+	if len(missing) != 0 {
+		diag.problems = append(diag.problems, fmt.Sprintf("не смогла определить: %s", strings.Join(missing, ", ")))
+	}
+	diag.extraction = planExtraction(z.Entries(), extractionRules)
+	diag.warnings = append(diag.warnings, diag.extraction.warnings...)
+	for _, rule := range diag.extraction.missing() {
+		diag.problems = append(diag.problems, fmt.Sprintf("нет %s, а без него никак (%s)", rule.pattern, rule.purpose))
+	}
+	if !diag.deployable() {
+		if diag.unknownCustomer != "" {
+			diag.problems = append([]string{fmt.Sprintf("не знаю репозиторий для заказчика «%s»", diag.unknownCustomer)}, diag.problems...)
+		}
+		return diag, errNotDeployable
 	}
 
-	return versions, nil
+	// Если всё на месте — достаем файлы по правилам
+	err = diag.extraction.extract(diagDir)
+	if err != nil {
+		return diag, err
+	}
+	if diag.unknownCustomer != "" {
+		return diag, errUnknownCustomer
+	}
+
+	return diag, nil
+}
+
+// copy the file from the archive to the dir
+// * the name cannot escape the dir
+// * the file mode from the archive is ignored
+// * the real size is limited too, the declared one can lie
+func extractFile(f *archiveEntry, dir, name string) error {
+	pathToSave, err := safeJoin(dir, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(pathToSave), 0o755); err != nil {
+		return err
+	}
+	handle, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("could not open %s: %w", f.Name, err)
+	}
+	defer handle.Close()
+	fLocal, err := os.OpenFile(pathToSave, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("could not create %s file to copy: %w", pathToSave, err)
+	}
+	defer fLocal.Close()
+	n, err := io.Copy(fLocal, io.LimitReader(handle, maxUncompressedSize+1))
+	if err != nil {
+		return err
+	}
+	if n > maxUncompressedSize {
+		return fmt.Errorf("%w: %s", errArchiveTooBig, f.Name)
+	}
+	return nil
 }
@@ -11,14 +11,14 @@ import (
 )
 
 // Тестируем распаковку диагностики на тестовых данных
-func checkDiagPartyExistence() bool {
-	files, err := ioutil.ReadDir(dirToSave)
+func checkDiagPartyExistence(dir string) bool {
+	files, err := ioutil.ReadDir(dir)
 	if err != nil {
 		log.Fatal(err)
 	}
 	for _, f := range files {
 		if strings.Contains(f.Name(), "sql.party.xls") {
-			err := os.Remove(path.Join(dirToSave, f.Name()))
+			err := os.Remove(path.Join(dir, f.Name()))
 			if err != nil {
 				panic(err)
 			}
@@ -28,8 +28,29 @@ func checkDiagPartyExistence() bool {
 	return false
 }
 
+// откуда берутся версии в хороших архивах: версии CDI из cdiSource, версии Фактора из factor.versions
+func goodSources(cdiSource string) map[string]string {
+	return map[string]string{
+		"CustomerName":     cdiSource,
+		"CustomerTitle":    cdiSource,
+		"CustomerRevision": cdiSource,
+		"CoreRevision":     cdiSource,
+		"FactorTagVersion": cdiSource,
+		"FactorVersion":    sourceFactorVersions,
+		"FactorRevision":   sourceFactorVersions,
+		"FactorBuildTime":  sourceFactorVersions,
+	}
+}
+
+// правила как в профиле по умолчанию, только то, что есть в тестовых архивах
+var testExtractionRules = []extractionRule{
+	{pattern: "sql.party.xls", target: "sql.party.xls", required: true, param: "dataSets", purpose: "данные для заливки"},
+	{pattern: "sql.*.xls", target: "datasets/", param: "dataSets", purpose: "другие датасеты"},
+}
+
 func TestParseZipFile(t *testing.T) {
-	dirToSave = "test_data"
+	extractionRules = testExtractionRules
+	diagDir := t.TempDir()
 	tests := []struct {
 		name            string
 		zippath         string
@@ -44,7 +65,66 @@ func TestParseZipFile(t *testing.T) {
 				CoreRevision:     "2c980808",
 				CustomerRevision: "01fbd6f4",
 				CustomerName:     "demo",
+				CustomerTitle:    "Demo",
+				FactorTagVersion: "20.12",
+				FactorVersion:    "20.06",
+				FactorRevision:   "9ca5f232",
+				FactorBuildTime:  "2020-07-08T17:55:00.000+03:00",
+				Sources:          goodSources(sourceLifecycle),
+			},
+			wantDiagProfile: true,
+			wantErr:         false,
+		},
+		{
+			name:    "good tar.gz", // то же самое, но в tar.gz
+			zippath: "test_data/diag_good.tar.gz",
+			want: &applicationVersions{
+				CoreRevision:     "2c980808",
+				CustomerRevision: "01fbd6f4",
+				CustomerName:     "demo",
+				CustomerTitle:    "Demo",
+				FactorTagVersion: "20.12",
+				FactorVersion:    "20.06",
+				FactorRevision:   "9ca5f232",
+				FactorBuildTime:  "2020-07-08T17:55:00.000+03:00",
+				Sources:          goodSources(sourceLifecycle),
+			},
+			wantDiagProfile: true,
+			wantErr:         false,
+		},
+		{
+			name:    "good 7z", // и в 7z
+			zippath: "test_data/diag_good.7z",
+			want: &applicationVersions{
+				CoreRevision:     "2c980808",
+				CustomerRevision: "01fbd6f4",
+				CustomerName:     "demo",
+				CustomerTitle:    "Demo",
 				FactorTagVersion: "20.12",
+				FactorVersion:    "20.06",
+				FactorRevision:   "9ca5f232",
+				FactorBuildTime:  "2020-07-08T17:55:00.000+03:00",
+				Sources:          goodSources(sourceLifecycle),
+			},
+			wantDiagProfile: true,
+			wantErr:         false,
+		},
+		{
+			name:    "nested", // верхняя папка, обратные слеши и ротированные lifecycle-логи
+			zippath: "test_data/diag_nested.zip",
+			want: &applicationVersions{
+				CoreRevision:     "badfd026",
+				CustomerRevision: "eb02e922",
+				CustomerName:     "name",
+				CustomerTitle:    "Long name",
+				FactorTagVersion: "20.12",
+				Sources: map[string]string{
+					"CustomerName":     sourceLifecycle,
+					"CustomerTitle":    sourceLifecycle,
+					"CustomerRevision": sourceLifecycle,
+					"CoreRevision":     sourceLifecycle,
+					"FactorTagVersion": sourceLifecycle,
+				},
 			},
 			wantDiagProfile: true,
 			wantErr:         false,
@@ -64,24 +144,38 @@ func TestParseZipFile(t *testing.T) {
 			wantErr:         true,
 		},
 		{
-			name:            "without versions", // диагностика есть, логов с версией нет
-			zippath:         "test_data/diag_without_versions.zip",
-			want:            nil,
-			wantDiagProfile: false,
-			wantErr:         true,
+			name:    "without lifecycle log", // диагностика есть, логов с версией нет, версии берем из cdi.versions.txt
+			zippath: "test_data/diag_without_versions.zip",
+			want: &applicationVersions{
+				CoreRevision:     "2c980808",
+				CustomerRevision: "01fbd6f4",
+				CustomerName:     "demo",
+				CustomerTitle:    "demo",
+				FactorTagVersion: "20.12",
+				FactorVersion:    "20.06",
+				FactorRevision:   "9ca5f232",
+				FactorBuildTime:  "2020-07-08T17:55:00.000+03:00",
+				Sources:          goodSources(sourceCdiVersions),
+			},
+			wantDiagProfile: true,
+			wantErr:         false,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := parseZipFile(tt.zippath)
+			diag, err := parseZipFile(tt.zippath, diagDir)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("ParseZipFile() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			var got *applicationVersions
+			if err == nil {
+				got = diag.versions
+			}
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("ParseZipFile() = %v, want %v", got, tt.want)
 			}
-			gotDiag := checkDiagPartyExistence()
+			gotDiag := checkDiagPartyExistence(diagDir)
 			if gotDiag != tt.wantDiagProfile {
 				t.Errorf("ParseZipFile() = %v, wantDiag %v", gotDiag, tt.wantDiagProfile)
 			}